@@ -2,9 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/Financial-Times/upp-exports-rw-s3/service"
@@ -16,11 +21,13 @@ import (
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	cli "github.com/jawher/mow.cli"
+	"github.com/rcrowley/go-metrics"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	spareWorkers = 10 // Workers for things like health check, gtg, count, etc...
+	spareWorkers      = 10 // Workers for things like health check, gtg, count, etc...
+	readHeaderTimeout = 10 * time.Second
 )
 
 func main() {
@@ -61,6 +68,48 @@ func main() {
 		EnvVar: "GENERIC_STORE_RESOURCE_PATH",
 	})
 
+	contentMaxBodySize := app.Int(cli.IntOpt{
+		Name:   "contentMaxBodySize",
+		Value:  10 << 20,
+		Desc:   "Largest request body in bytes accepted by the content resource, 0 for no limit",
+		EnvVar: "CONTENT_MAX_BODY_SIZE",
+	})
+
+	contentAllowedContentTypes := app.Strings(cli.StringsOpt{
+		Name:   "contentAllowedContentTypes",
+		Value:  []string{},
+		Desc:   "Content types accepted by the content resource, e.g. application/json or image/*. Empty allows any",
+		EnvVar: "CONTENT_ALLOWED_CONTENT_TYPES",
+	})
+
+	conceptMaxBodySize := app.Int(cli.IntOpt{
+		Name:   "conceptMaxBodySize",
+		Value:  100 << 20,
+		Desc:   "Largest request body in bytes accepted by the concept resource, 0 for no limit",
+		EnvVar: "CONCEPT_MAX_BODY_SIZE",
+	})
+
+	conceptAllowedContentTypes := app.Strings(cli.StringsOpt{
+		Name:   "conceptAllowedContentTypes",
+		Value:  []string{},
+		Desc:   "Content types accepted by the concept resource. Empty allows any",
+		EnvVar: "CONCEPT_ALLOWED_CONTENT_TYPES",
+	})
+
+	genericStoreMaxBodySize := app.Int(cli.IntOpt{
+		Name:   "genericStoreMaxBodySize",
+		Value:  200 << 20,
+		Desc:   "Largest request body in bytes accepted by the generic store resource, 0 for no limit",
+		EnvVar: "GENERIC_STORE_MAX_BODY_SIZE",
+	})
+
+	genericStoreAllowedContentTypes := app.Strings(cli.StringsOpt{
+		Name:   "genericStoreAllowedContentTypes",
+		Value:  []string{},
+		Desc:   "Content types accepted by the generic store resource. Empty allows any",
+		EnvVar: "GENERIC_STORE_ALLOWED_CONTENT_TYPES",
+	})
+
 	awsRegion := app.String(cli.StringOpt{
 		Name:   "awsRegion",
 		Value:  "eu-west-1",
@@ -82,6 +131,55 @@ func main() {
 		EnvVar: "PRESIGN_TTL",
 	})
 
+	presignMaxTTL := app.Int(cli.IntOpt{
+		Name:   "presignMaxTTL",
+		Value:  604800,
+		Desc:   "Longest TTL in seconds a client may ask for with the ttl param of presign requests",
+		EnvVar: "PRESIGN_MAX_TTL",
+	})
+
+	presignBackend := app.String(cli.StringOpt{
+		Name:   "presignBackend",
+		Value:  service.PresignBackendS3,
+		Desc:   "Where presigned downloads go: s3 for the bucket, or cloudfront for a CloudFront distribution serving the cloudFrontKeyPrefixes",
+		EnvVar: "PRESIGN_BACKEND",
+	})
+
+	cloudFrontDomain := app.String(cli.StringOpt{
+		Name:   "cloudFrontDomain",
+		Value:  "",
+		Desc:   "Domain of the CloudFront distribution in front of the bucket",
+		EnvVar: "CLOUDFRONT_DOMAIN",
+	})
+
+	cloudFrontCookieDomain := app.String(cli.StringOpt{
+		Name:   "cloudFrontCookieDomain",
+		Value:  "",
+		Desc:   "Domain signed cookies are set for, covering the CloudFront distribution and the site using it. Without it signed cookies are only returned in the response body",
+		EnvVar: "CLOUDFRONT_COOKIE_DOMAIN",
+	})
+
+	cloudFrontKeyPairID := app.String(cli.StringOpt{
+		Name:   "cloudFrontKeyPairID",
+		Value:  "",
+		Desc:   "Id of the CloudFront public key, or key pair, that signs URLs and cookies",
+		EnvVar: "CLOUDFRONT_KEY_PAIR_ID",
+	})
+
+	cloudFrontPrivateKeyFile := app.String(cli.StringOpt{
+		Name:   "cloudFrontPrivateKeyFile",
+		Value:  "",
+		Desc:   "PEM file with the private key that signs CloudFront URLs and cookies",
+		EnvVar: "CLOUDFRONT_PRIVATE_KEY_FILE",
+	})
+
+	cloudFrontKeyPrefixes := app.Strings(cli.StringsOpt{
+		Name:   "cloudFrontKeyPrefixes",
+		Value:  []string{},
+		Desc:   "Key prefixes of the bucket the CloudFront distribution serves. Downloads of other keys are presigned for S3",
+		EnvVar: "CLOUDFRONT_KEY_PREFIXES",
+	})
+
 	bucketContentPrefix := app.String(cli.StringOpt{
 		Name:   "bucketContentPrefix",
 		Value:  "",
@@ -103,15 +201,466 @@ func main() {
 		EnvVar: "WORKERS",
 	})
 
+	readTimeout := app.Int(cli.IntOpt{
+		Name:   "readTimeout",
+		Value:  60,
+		Desc:   "Maximum duration in seconds for reading an entire request, including the body",
+		EnvVar: "HTTP_READ_TIMEOUT",
+	})
+
+	writeTimeout := app.Int(cli.IntOpt{
+		Name:   "writeTimeout",
+		Value:  60,
+		Desc:   "Maximum duration in seconds before timing out writes of the response",
+		EnvVar: "HTTP_WRITE_TIMEOUT",
+	})
+
+	idleTimeout := app.Int(cli.IntOpt{
+		Name:   "idleTimeout",
+		Value:  90,
+		Desc:   "Maximum duration in seconds to wait for the next request on a keep-alive connection",
+		EnvVar: "HTTP_IDLE_TIMEOUT",
+	})
+
+	s3ReadTimeout := app.Int(cli.IntOpt{
+		Name:   "s3ReadTimeout",
+		Value:  30,
+		Desc:   "Deadline in seconds for reading an object from S3, including streaming its body",
+		EnvVar: "S3_READ_TIMEOUT",
+	})
+
+	s3WriteTimeout := app.Int(cli.IntOpt{
+		Name:   "s3WriteTimeout",
+		Value:  60,
+		Desc:   "Deadline in seconds for writing an object to S3",
+		EnvVar: "S3_WRITE_TIMEOUT",
+	})
+
+	s3DeleteTimeout := app.Int(cli.IntOpt{
+		Name:   "s3DeleteTimeout",
+		Value:  10,
+		Desc:   "Deadline in seconds for deleting an object from S3",
+		EnvVar: "S3_DELETE_TIMEOUT",
+	})
+
+	s3ListTimeout := app.Int(cli.IntOpt{
+		Name:   "s3ListTimeout",
+		Value:  30,
+		Desc:   "Deadline in seconds for listing objects in S3",
+		EnvVar: "S3_LIST_TIMEOUT",
+	})
+
+	presignTimeout := app.Int(cli.IntOpt{
+		Name:   "presignTimeout",
+		Value:  5,
+		Desc:   "Deadline in seconds for presigning an S3 URL",
+		EnvVar: "PRESIGN_TIMEOUT",
+	})
+
+	assumeRoleTimeout := app.Int(cli.IntOpt{
+		Name:   "assumeRoleTimeout",
+		Value:  10,
+		Desc:   "Deadline in seconds for assuming the whole role chain of a foreign upload",
+		EnvVar: "ASSUME_ROLE_TIMEOUT",
+	})
+
+	s3CopyTimeout := app.Int(cli.IntOpt{
+		Name:   "s3CopyTimeout",
+		Value:  900,
+		Desc:   "Deadline in seconds for copying an object to a foreign bucket, including streaming it when a server-side copy is not permitted",
+		EnvVar: "S3_COPY_TIMEOUT",
+	})
+
+	maxRequestTimeout := app.Int(cli.IntOpt{
+		Name:   "maxRequestTimeout",
+		Value:  120,
+		Desc:   "Upper bound in seconds for the deadline a client can ask for with the X-Request-Timeout header",
+		EnvVar: "MAX_REQUEST_TIMEOUT",
+	})
+
+	rateLimits := app.Strings(cli.StringsOpt{
+		Name:   "rateLimits",
+		Value:  []string{},
+		Desc:   "Rate limits as route=rate:burst:maxInFlight, where route is content, concept, generic, presign or foreign. Use route/* to limit each client separately and route/<client> for a single client",
+		EnvVar: "RATE_LIMITS",
+	})
+
+	hmacSecretsFile := app.String(cli.StringOpt{
+		Name:   "hmacSecretsFile",
+		Value:  "",
+		Desc:   "JSON file mapping client ids to HMAC shared secrets. Request signing is not enforced when empty",
+		EnvVar: "HMAC_SECRETS_FILE",
+	})
+
+	hmacRouteGroups := app.Strings(cli.StringsOpt{
+		Name:   "hmacRouteGroups",
+		Value:  []string{"content", "concept", "generic", "presign", "foreign:all"},
+		Desc:   "Route groups that require signed requests. A group alone protects its write methods, group:all protects every method",
+		EnvVar: "HMAC_ROUTE_GROUPS",
+	})
+
+	hmacMaxSkew := app.Int(cli.IntOpt{
+		Name:   "hmacMaxSkew",
+		Value:  300,
+		Desc:   "Seconds a signed request timestamp may differ from the server clock",
+		EnvVar: "HMAC_MAX_SKEW",
+	})
+
+	authzPolicyFile := app.String(cli.StringOpt{
+		Name:   "authzPolicyFile",
+		Value:  "",
+		Desc:   "JSON file mapping client identities to the operations and key prefixes they may use. Authorization is not enforced when empty",
+		EnvVar: "AUTHZ_POLICY_FILE",
+	})
+
+	tlsCertFile := app.String(cli.StringOpt{
+		Name:   "tlsCertFile",
+		Value:  "",
+		Desc:   "PEM certificate to serve TLS with. The service speaks plain HTTP when empty. The file is reloaded when it changes",
+		EnvVar: "TLS_CERT_FILE",
+	})
+
+	tlsKeyFile := app.String(cli.StringOpt{
+		Name:   "tlsKeyFile",
+		Value:  "",
+		Desc:   "PEM private key matching the TLS certificate",
+		EnvVar: "TLS_KEY_FILE",
+	})
+
+	tlsClientCAFile := app.String(cli.StringOpt{
+		Name:   "tlsClientCAFile",
+		Value:  "",
+		Desc:   "PEM CA certificates used to verify client certificates",
+		EnvVar: "TLS_CLIENT_CA_FILE",
+	})
+
+	tlsClientAuth := app.String(cli.StringOpt{
+		Name:   "tlsClientAuth",
+		Value:  "none",
+		Desc:   "Client certificate policy: none, optional or require",
+		EnvVar: "TLS_CLIENT_AUTH",
+	})
+
+	foreignAllowedRoleChains := app.Strings(cli.StringsOpt{
+		Name:   "foreignAllowedRoleChains",
+		Value:  []string{},
+		Desc:   "Role chains foreign uploads may assume, each written as role ARNs joined by '>'. Empty allows any chain",
+		EnvVar: "FOREIGN_ALLOWED_ROLE_CHAINS",
+	})
+
+	foreignAllowedBuckets := app.Strings(cli.StringsOpt{
+		Name:   "foreignAllowedBuckets",
+		Value:  []string{},
+		Desc:   "Buckets foreign uploads may write to. Empty allows any bucket",
+		EnvVar: "FOREIGN_ALLOWED_BUCKETS",
+	})
+
+	foreignAllowedKeyPrefixes := app.Strings(cli.StringsOpt{
+		Name:   "foreignAllowedKeyPrefixes",
+		Value:  []string{},
+		Desc:   "Key prefixes foreign uploads may write under. Empty allows any key",
+		EnvVar: "FOREIGN_ALLOWED_KEY_PREFIXES",
+	})
+
+	foreignCredentialsExpiryWindow := app.Int(cli.IntOpt{
+		Name:   "foreignCredentialsExpiryWindow",
+		Value:  300,
+		Desc:   "Time in seconds before expiry at which cached assumed-role credentials for foreign buckets are refreshed",
+		EnvVar: "FOREIGN_CREDENTIALS_EXPIRY_WINDOW",
+	})
+
+	foreignRoleOptionsFile := app.String(cli.StringOpt{
+		Name:   "foreignRoleOptionsFile",
+		Value:  "",
+		Desc:   "JSON file of AssumeRole options (externalId, durationSeconds, tags, scopeToBucket) keyed by role ARN. Empty assumes roles with defaults",
+		EnvVar: "FOREIGN_ROLE_OPTIONS_FILE",
+	})
+
+	foreignDestinationsFile := app.String(cli.StringOpt{
+		Name:   "foreignDestinationsFile",
+		Value:  "",
+		Desc:   "JSON file of named foreign destinations, each with region, bucket, roles, keyPrefix and upload options, served under /foreign/{destination}/{key}",
+		EnvVar: "FOREIGN_DESTINATIONS_FILE",
+	})
+
+	foreignQueuePrefix := app.String(cli.StringOpt{
+		Name:   "foreignQueuePrefix",
+		Value:  "foreign-queue",
+		Desc:   "Prefix in our bucket under which asynchronous foreign uploads and their dead letters are spooled",
+		EnvVar: "FOREIGN_QUEUE_PREFIX",
+	})
+
+	foreignQueueWorkers := app.Int(cli.IntOpt{
+		Name:   "foreignQueueWorkers",
+		Value:  2,
+		Desc:   "Number of asynchronous foreign uploads delivered concurrently",
+		EnvVar: "FOREIGN_QUEUE_WORKERS",
+	})
+
+	foreignQueueMaxAttempts := app.Int(cli.IntOpt{
+		Name:   "foreignQueueMaxAttempts",
+		Value:  8,
+		Desc:   "Attempts at delivering an asynchronous foreign upload before it is moved to the dead letters",
+		EnvVar: "FOREIGN_QUEUE_MAX_ATTEMPTS",
+	})
+
+	foreignQueueBackoff := app.Int(cli.IntOpt{
+		Name:   "foreignQueueBackoff",
+		Value:  5,
+		Desc:   "Delay in seconds before the first retry of an asynchronous foreign upload, doubled with every further attempt",
+		EnvVar: "FOREIGN_QUEUE_BACKOFF",
+	})
+
+	foreignQueueMaxBackoff := app.Int(cli.IntOpt{
+		Name:   "foreignQueueMaxBackoff",
+		Value:  600,
+		Desc:   "Longest delay in seconds between retries of an asynchronous foreign upload",
+		EnvVar: "FOREIGN_QUEUE_MAX_BACKOFF",
+	})
+
+	foreignQueueDoneRetention := app.Int(cli.IntOpt{
+		Name:   "foreignQueueDoneRetention",
+		Value:  604800,
+		Desc:   "Seconds delivered asynchronous foreign uploads are kept for their job status, 0 to keep them for good",
+		EnvVar: "FOREIGN_QUEUE_DONE_RETENTION",
+	})
+
+	foreignImportStagingPrefix := app.String(cli.StringOpt{
+		Name:   "foreignImportStagingPrefix",
+		Value:  "foreign-import-staging",
+		Desc:   "Prefix in our bucket under which foreign imports are staged until they are verified",
+		EnvVar: "FOREIGN_IMPORT_STAGING_PREFIX",
+	})
+
+	foreignCopyPartSize := app.Int(cli.IntOpt{
+		Name:   "foreignCopyPartSize",
+		Value:  64 << 20,
+		Desc:   "Part size in bytes for streaming copies to foreign buckets, at least 5MiB. Objects larger than this are uploaded in parts",
+		EnvVar: "FOREIGN_COPY_PART_SIZE",
+	})
+
+	shutdownTimeout := app.Int(cli.IntOpt{
+		Name:   "shutdownTimeout",
+		Value:  25,
+		Desc:   "Time in seconds to let in-flight requests drain on shutdown before outstanding S3 operations are cancelled",
+		EnvVar: "SHUTDOWN_TIMEOUT",
+	})
+
+	shutdownDelay := app.Int(cli.IntOpt{
+		Name:   "shutdownDelay",
+		Value:  10,
+		Desc:   "Time in seconds to keep serving after failing __gtg on shutdown, so load balancers take the instance out of rotation before connections are drained",
+		EnvVar: "SHUTDOWN_DELAY",
+	})
+
 	app.Action = func() {
-		runServer(*port, *conceptResourcePath, *contentResourcePath, *genericStoreResourcePath, *awsRegion, *bucketName, *bucketContentPrefix, *bucketConceptPrefix, *wrkSize, *appSystemCode, *presignTTL)
+		timeouts := serverTimeouts{
+			read:     time.Duration(*readTimeout) * time.Second,
+			write:    time.Duration(*writeTimeout) * time.Second,
+			idle:     time.Duration(*idleTimeout) * time.Second,
+			shutdown: time.Duration(*shutdownTimeout) * time.Second,
+			delay:    time.Duration(*shutdownDelay) * time.Second,
+			request:  time.Duration(*maxRequestTimeout) * time.Second,
+		}
+		opTimeouts := service.OperationTimeouts{
+			Read:       time.Duration(*s3ReadTimeout) * time.Second,
+			Write:      time.Duration(*s3WriteTimeout) * time.Second,
+			Delete:     time.Duration(*s3DeleteTimeout) * time.Second,
+			List:       time.Duration(*s3ListTimeout) * time.Second,
+			Presign:    time.Duration(*presignTimeout) * time.Second,
+			AssumeRole: time.Duration(*assumeRoleTimeout) * time.Second,
+			Copy:       time.Duration(*s3CopyTimeout) * time.Second,
+		}
+		policies := bodyPolicies{
+			content:      service.BodyPolicy{MaxBytes: int64(*contentMaxBodySize), AllowedContentTypes: *contentAllowedContentTypes},
+			concept:      service.BodyPolicy{MaxBytes: int64(*conceptMaxBodySize), AllowedContentTypes: *conceptAllowedContentTypes},
+			genericStore: service.BodyPolicy{MaxBytes: int64(*genericStoreMaxBodySize), AllowedContentTypes: *genericStoreAllowedContentTypes},
+		}
+		limits, err := service.ParseRateLimits(*rateLimits)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid rate limit configuration")
+		}
+		auth, err := newRouteAuth(*hmacSecretsFile, *hmacRouteGroups, time.Duration(*hmacMaxSkew)*time.Second)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid request signing configuration")
+		}
+		var authorizer *service.Authorizer
+		if *authzPolicyFile != "" {
+			policy, err := service.LoadPolicy(*authzPolicyFile)
+			if err != nil {
+				log.WithError(err).Fatal("Invalid authorization policy")
+			}
+			authorizer = service.NewAuthorizer(policy)
+		}
+		tlsConfig, err := newTLSConfig(*tlsCertFile, *tlsKeyFile, *tlsClientCAFile, *tlsClientAuth)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid TLS configuration")
+		}
+		foreign := foreignSettings{
+			policy:        service.NewForeignPolicy(*foreignAllowedRoleChains, *foreignAllowedBuckets, *foreignAllowedKeyPrefixes),
+			expiryWindow:  time.Duration(*foreignCredentialsExpiryWindow) * time.Second,
+			partSize:      int64(*foreignCopyPartSize),
+			stagingPrefix: *foreignImportStagingPrefix,
+			queue: foreignQueueSettings{
+				prefix:      *foreignQueuePrefix,
+				workers:     *foreignQueueWorkers,
+				maxAttempts: *foreignQueueMaxAttempts,
+				backoff:     time.Duration(*foreignQueueBackoff) * time.Second,
+				maxBackoff:  time.Duration(*foreignQueueMaxBackoff) * time.Second,
+				retention:   time.Duration(*foreignQueueDoneRetention) * time.Second,
+			},
+		}
+		if foreign.partSize < service.MinPartSize {
+			log.Fatalf("FOREIGN_COPY_PART_SIZE must be at least %d bytes", service.MinPartSize)
+		}
+		if *foreignDestinationsFile != "" {
+			foreign.destinations, err = service.LoadDestinations(*foreignDestinationsFile)
+			if err == nil {
+				err = foreign.destinations.Check(foreign.policy)
+			}
+			if err != nil {
+				log.WithError(err).Fatal("Invalid foreign destinations")
+			}
+		}
+		if *foreignRoleOptionsFile != "" {
+			foreign.roleOptions, err = service.LoadRoleOptions(*foreignRoleOptionsFile)
+			if err != nil {
+				log.WithError(err).Fatal("Invalid foreign role options")
+			}
+		}
+		if open := foreign.policy.Unrestricted(); len(open) > 0 {
+			log.Warnf("Foreign uploads are not restricted by %s", strings.Join(open, ", "))
+		}
+		var cdn *service.CloudFrontSigner
+		switch *presignBackend {
+		case service.PresignBackendS3:
+		case service.PresignBackendCloudFront:
+			cdn, err = service.LoadCloudFrontSigner(*cloudFrontDomain, *cloudFrontCookieDomain, *cloudFrontKeyPairID, *cloudFrontPrivateKeyFile, *cloudFrontKeyPrefixes)
+			if err != nil {
+				log.WithError(err).Fatal("Invalid CloudFront configuration")
+			}
+		default:
+			log.Fatalf("PRESIGN_BACKEND must be %s or %s", service.PresignBackendS3, service.PresignBackendCloudFront)
+		}
+		runServer(*port, *conceptResourcePath, *contentResourcePath, *genericStoreResourcePath, *awsRegion, *bucketName, *bucketContentPrefix, *bucketConceptPrefix, *wrkSize, *appSystemCode, *presignTTL, *presignMaxTTL, cdn, timeouts, opTimeouts, policies, limits, auth, authorizer, tlsConfig, foreign)
 	}
 	log.SetLevel(log.InfoLevel)
 	log.Infof("Application started with args [concept-resource-path: %s] [content-resource-path: %s] [bucketName: %s] [bucketConceptPrefix: %s] [bucketContentPrefix: %s] [workers: %d]", *conceptResourcePath, *contentResourcePath, *bucketName, *bucketConceptPrefix, *bucketContentPrefix, *wrkSize)
 	app.Run(os.Args)
 }
 
-func runServer(port, conceptResourcePath, contentResourcePath, genericStoreResourcePath, awsRegion, bucketName, bucketContentPrefix, bucketConceptPrefix string, wrks int, appSystemCode string, presignTTL int) {
+type serverTimeouts struct {
+	read     time.Duration
+	write    time.Duration
+	idle     time.Duration
+	shutdown time.Duration
+	delay    time.Duration
+	request  time.Duration
+}
+
+// newTLSConfig returns nil when no certificate is configured, so the server keeps speaking plain HTTP.
+func newTLSConfig(certFile, keyFile, clientCAFile, clientAuth string) (*tls.Config, error) {
+	if certFile == "" {
+		return nil, nil
+	}
+	reloader, err := service.NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	authType, err := service.ParseClientAuth(clientAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+		ClientAuth:     authType,
+	}
+	if authType != tls.NoClientCert {
+		if clientCAFile == "" {
+			return nil, fmt.Errorf("client certificate verification requires a client CA file")
+		}
+		if cfg.ClientCAs, err = service.LoadCertPool(clientCAFile); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// routeAuth applies request signing to the configured route groups.
+type routeAuth struct {
+	authenticator *service.HMACAuthenticator
+	exempt        map[string][]string
+}
+
+// newRouteAuth returns a routeAuth that protects nothing when secretsFile is empty.
+func newRouteAuth(secretsFile string, groups []string, maxSkew time.Duration) (*routeAuth, error) {
+	if secretsFile == "" {
+		return &routeAuth{}, nil
+	}
+	secrets, err := service.LoadClientSecrets(secretsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	exempt := make(map[string][]string)
+	for _, g := range groups {
+		name, mode, _ := strings.Cut(strings.TrimSpace(g), ":")
+		if err := service.CheckRouteGroup(name); err != nil {
+			return nil, err
+		}
+		switch mode {
+		case "":
+			exempt[name] = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+		case "all":
+			exempt[name] = nil
+		default:
+			return nil, fmt.Errorf("unknown mode %q for route group %s", mode, name)
+		}
+	}
+	log.Infof("Request signing enabled for %d clients on route groups %v", len(secrets), groups)
+	return &routeAuth{service.NewHMACAuthenticator(secrets, maxSkew), exempt}, nil
+}
+
+func (a *routeAuth) wrap(group string, h http.Handler) http.Handler {
+	exempt, ok := a.exempt[group]
+	if a.authenticator == nil || !ok {
+		return h
+	}
+	return a.authenticator.Handler(exempt, h)
+}
+
+type bodyPolicies struct {
+	content      service.BodyPolicy
+	concept      service.BodyPolicy
+	genericStore service.BodyPolicy
+}
+
+type foreignSettings struct {
+	policy        *service.ForeignPolicy
+	expiryWindow  time.Duration
+	partSize      int64
+	stagingPrefix string
+	roleOptions   map[string]service.RoleOptions
+	destinations  service.Destinations
+	queue         foreignQueueSettings
+}
+
+type foreignQueueSettings struct {
+	prefix      string
+	workers     int
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	retention   time.Duration
+}
+
+func runServer(port, conceptResourcePath, contentResourcePath, genericStoreResourcePath, awsRegion, bucketName, bucketContentPrefix, bucketConceptPrefix string, wrks int, appSystemCode string, presignTTL, presignMaxTTL int, cdn *service.CloudFrontSigner, timeouts serverTimeouts, opTimeouts service.OperationTimeouts, policies bodyPolicies, limits map[string]service.RouteRateLimits, auth *routeAuth, authorizer *service.Authorizer, tlsConfig *tls.Config, foreign foreignSettings) {
+	// Every request context derives from ctx, so cancelling it aborts the S3 operations still running on shutdown.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	hc := &http.Client{
 		Transport: &http.Transport{
 			Proxy: http.ProxyFromEnvironment,
@@ -127,7 +676,7 @@ func runServer(port, conceptResourcePath, contentResourcePath, genericStoreResou
 		},
 	}
 
-	aws2Config, err := config.LoadDefaultConfig(context.TODO(), config.WithHTTPClient(hc), config.WithRegion(awsRegion))
+	aws2Config, err := config.LoadDefaultConfig(ctx, config.WithHTTPClient(hc), config.WithRegion(awsRegion))
 	if err != nil {
 		log.Fatalf("Failed to create AWS config: %v", err)
 	}
@@ -150,54 +699,202 @@ func runServer(port, conceptResourcePath, contentResourcePath, genericStoreResou
 	svc := s3.New(sess)
 	svcV2 := s3v2.NewFromConfig(aws2Config)
 
-	presigner := service.NewPresigner(svcV2, bucketName, presignTTL)
-	w := service.NewS3Writer(svc, bucketName, bucketContentPrefix, bucketConceptPrefix)
-	r := service.NewS3Reader(svc, bucketName, bucketContentPrefix, bucketConceptPrefix, int16(wrks))
-
-	wh := service.NewWriterHandler(w, r)
-	rh := service.NewReaderHandler(r)
-	ph := service.NewPresignerHandler(presigner)
-	fh := service.NewForeignerHandler(hc)
-
-	servicesRouter := mux.NewRouter()
+	presigner := service.NewPresigner(svcV2, bucketName, bucketContentPrefix, bucketConceptPrefix, presignTTL, presignMaxTTL, opTimeouts)
+	w := service.NewS3Writer(svc, bucketName, bucketContentPrefix, bucketConceptPrefix, opTimeouts)
+	r := service.NewS3Reader(svc, bucketName, bucketContentPrefix, bucketConceptPrefix, int16(wrks), opTimeouts)
+
+	// Generic store keys are kept away from the objects the service keeps in the bucket itself.
+	keys := service.NewKeyPolicy(bucketContentPrefix, bucketConceptPrefix, foreign.queue.prefix, foreign.stagingPrefix)
+	wh := service.NewWriterHandler(w, r, keys)
+	rh := service.NewReaderHandler(r, keys)
+	ph := service.NewPresignerHandler(presigner, r, keys, cdn, map[string]service.BodyPolicy{
+		service.RouteGroupGeneric: policies.genericStore,
+		service.RouteGroupConcept: policies.concept,
+	})
+	foreigner := service.NewForeigner(hc, opTimeouts, foreign.expiryWindow, foreign.roleOptions, appSystemCode, metrics.DefaultRegistry)
+	ours := service.NewS3Client2(svcV2, bucketName, opTimeouts)
+	copier := service.NewForeignCopier(ours, foreigner, foreign.partSize, bucketContentPrefix, bucketConceptPrefix, foreign.stagingPrefix, keys)
+	queue := service.NewForeignQueue(ours, foreign.queue.prefix, foreigner, foreign.policy, foreign.queue.maxAttempts, foreign.queue.backoff, foreign.queue.maxBackoff, foreign.queue.retention, metrics.DefaultRegistry)
+	go func() {
+		if err := queue.Start(ctx, foreign.queue.workers); err != nil {
+			log.WithError(err).Error("Failed to pick up pending asynchronous foreign uploads")
+		}
+	}()
+	fh := service.NewForeignerHandler(foreigner, copier, queue, foreign.policy, foreign.destinations, presignTTL)
+
+	// Routes are matched against the escaped path, so that an escaped '/' in a key isn't taken for a separator.
+	servicesRouter := mux.NewRouter().UseEncodedPath()
 
 	contentMethodHandler := &handlers.MethodHandler{
-		"PUT":    http.HandlerFunc(wh.HandleContentWrite),
+		"PUT":    service.WithBodyPolicy(policies.content, http.HandlerFunc(wh.HandleContentWrite)),
 		"GET":    http.HandlerFunc(rh.HandleContentGet),
 		"DELETE": http.HandlerFunc(wh.HandleContentDelete),
 	}
 
 	conceptMethodHandler := &handlers.MethodHandler{
-		"PUT":    http.HandlerFunc(wh.HandleConceptWrite),
+		"PUT":    service.WithBodyPolicy(policies.concept, http.HandlerFunc(wh.HandleConceptWrite)),
 		"GET":    http.HandlerFunc(rh.HandleConceptGet),
 		"DELETE": http.HandlerFunc(wh.HandleConceptDelete),
 	}
 
 	genericStoreMethodHandler := &handlers.MethodHandler{
-		"PUT":    http.HandlerFunc(wh.HandleGenericStoreWrite),
+		"PUT":    service.WithBodyPolicy(policies.genericStore, http.HandlerFunc(wh.HandleGenericStoreWrite)),
 		"GET":    http.HandlerFunc(rh.HandleGenericStoreGet),
 		"DELETE": http.HandlerFunc(wh.HandleGenericStoreDelete),
 	}
 
-	presignerMethodHandler := &handlers.MethodHandler{
-		"GET": http.HandlerFunc(ph.HandlePresignURL),
-	}
+	// Presign routes share one rate limiter, so they are dispatched by a router of their own.
+	presignerRouter := mux.NewRouter().UseEncodedPath()
+	presignerRouter.Handle("/presign", &handlers.MethodHandler{
+		"GET": http.HandlerFunc(ph.HandleBatchPresign),
+	})
+	presignerRouter.Handle("/presign/content/{uuid}", &handlers.MethodHandler{
+		"GET": http.HandlerFunc(ph.HandlePresignContent),
+	})
+	presignerRouter.Handle("/presign/concept/{fileName}", &handlers.MethodHandler{
+		"GET": http.HandlerFunc(ph.HandlePresignConcept),
+	})
+	// Only POSTs without a 'method' param complete an upload, so that keys ending in /complete can still be presigned.
+	presignerRouter.Handle("/presign/{key:.+}/complete", &handlers.MethodHandler{
+		"POST": http.HandlerFunc(ph.HandlePresignComplete),
+	}).Methods("POST").MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+		return r.URL.Query().Get("method") == ""
+	})
+	// Uploads are presigned with a POST, so that they are signed and rate limited like the writes they allow.
+	presignerRouter.Handle("/presign/{key:.+}", &handlers.MethodHandler{
+		"GET":  http.HandlerFunc(ph.HandlePresignURL),
+		"POST": http.HandlerFunc(ph.HandlePresignURL),
+	})
 
-	foreignerMethodHandler := &handlers.MethodHandler{
-		"PUT": http.HandlerFunc(fh.HandleForeignerBucketWrite),
+	// All foreign routes share one rate limiter, so they are dispatched by a router of their own.
+	foreignerRouter := mux.NewRouter()
+	foreignerRouter.Handle("/foreign/", &handlers.MethodHandler{
+		"PUT":    http.HandlerFunc(fh.HandleForeignerBucketWrite),
+		"GET":    http.HandlerFunc(fh.HandleForeignerBucketGet),
+		"HEAD":   http.HandlerFunc(fh.HandleForeignerBucketHead),
+		"DELETE": http.HandlerFunc(fh.HandleForeignerBucketDelete),
+	})
+	foreignerRouter.Handle("/foreign/list", &handlers.MethodHandler{
+		"GET": http.HandlerFunc(fh.HandleForeignerBucketList),
+	})
+	foreignerRouter.Handle("/foreign/presign", &handlers.MethodHandler{
+		"GET": http.HandlerFunc(fh.HandleForeignerPresignURL),
+	})
+	foreignerRouter.Handle("/foreign/preflight", &handlers.MethodHandler{
+		"GET":  http.HandlerFunc(fh.HandleForeignerPreflight),
+		"POST": http.HandlerFunc(fh.HandleForeignerPreflight),
+	})
+	foreignerRouter.Handle("/foreign/jobs/{id}", &handlers.MethodHandler{
+		"GET": http.HandlerFunc(fh.HandleForeignerJobStatus),
+	})
+	foreignerRouter.Handle("/foreign/copy", &handlers.MethodHandler{
+		"PUT": http.HandlerFunc(fh.HandleForeignerCopy),
+	})
+	foreignerRouter.Handle("/foreign/archive", &handlers.MethodHandler{
+		"PUT": http.HandlerFunc(fh.HandleForeignerArchive),
+	})
+	foreignerRouter.Handle("/foreign/import", &handlers.MethodHandler{
+		"PUT": http.HandlerFunc(fh.HandleForeignerImport),
+	})
+	foreignerRouter.Handle("/foreign/fanout", &handlers.MethodHandler{
+		"PUT": http.HandlerFunc(fh.HandleForeignerFanout),
+	})
+	foreignerRouter.Handle("/__foreign-destinations", &handlers.MethodHandler{
+		"GET": service.DestinationsHandler(foreign.destinations),
+	})
+	foreignerRouter.PathPrefix("/__foreign-dead-letters").Handler(service.DeadLetterHandler(queue))
+	foreignerRouter.Handle("/foreign/{destination}/{key:.+}", &handlers.MethodHandler{
+		"PUT": http.HandlerFunc(fh.HandleDestinationWrite),
+	})
+
+	route := func(group, resourcePath string, h http.Handler) http.Handler {
+		h = service.WithRequestTimeout(timeouts.request, h)
+		if authorizer != nil {
+			h = authorizer.Handler(group, resourcePath, h)
+		}
+		h = auth.wrap(group, h)
+		h = service.NewRateLimiter(group, limits[group], metrics.DefaultRegistry).Handler(h)
+		return service.WithTLSClientIdentity(h)
 	}
 
-	service.Handlers(servicesRouter, contentMethodHandler, contentResourcePath, "/{uuid}")
-	service.Handlers(servicesRouter, conceptMethodHandler, conceptResourcePath, "/{fileName}")
-	service.Handlers(servicesRouter, genericStoreMethodHandler, genericStoreResourcePath, "/{key}")
-	service.Handlers(servicesRouter, presignerMethodHandler, "presign", "/{key}")
-	service.Handlers(servicesRouter, foreignerMethodHandler, "foreign", "/")
-	service.AddAdminHandlers(servicesRouter, svc, bucketName, appSystemCode)
+	service.Handlers(servicesRouter, route(service.RouteGroupContent, contentResourcePath, contentMethodHandler), contentResourcePath, "/{uuid}")
+	service.Handlers(servicesRouter, route(service.RouteGroupConcept, conceptResourcePath, conceptMethodHandler), conceptResourcePath, "/{fileName}")
+	service.Handlers(servicesRouter, route(service.RouteGroupGeneric, genericStoreResourcePath, genericStoreMethodHandler), genericStoreResourcePath, "/{key:.+}")
+	presignerHandler := route(service.RouteGroupPresign, "presign", presignerRouter)
+	service.Handlers(servicesRouter, presignerHandler, "presign", "")
+	service.Handlers(servicesRouter, presignerHandler, "presign", "/content/{uuid}")
+	service.Handlers(servicesRouter, presignerHandler, "presign", "/concept/{fileName}")
+	service.Handlers(servicesRouter, presignerHandler, "presign", "/{key:.+}")
+	// Synchronous copies, archives and imports may run for as long as S3_COPY_TIMEOUT, past HTTP_WRITE_TIMEOUT.
+	foreignerHandler := route(service.RouteGroupForeign, "foreign", service.WithWriteDeadline(opTimeouts.Copy+timeouts.write, foreignerRouter))
+	service.Handlers(servicesRouter, foreignerHandler, "foreign", "/list")
+	service.Handlers(servicesRouter, foreignerHandler, "foreign", "/presign")
+	service.Handlers(servicesRouter, foreignerHandler, "foreign", "/copy")
+	service.Handlers(servicesRouter, foreignerHandler, "foreign", "/jobs/{id}")
+	service.Handlers(servicesRouter, foreignerHandler, "foreign", "/fanout")
+	service.Handlers(servicesRouter, foreignerHandler, "foreign", "/archive")
+	service.Handlers(servicesRouter, foreignerHandler, "foreign", "/import")
+	service.Handlers(servicesRouter, foreignerHandler, "foreign", "/preflight")
+	service.Handlers(servicesRouter, foreignerHandler, "foreign", "/{destination}/{key:.+}")
+	service.Handlers(servicesRouter, foreignerHandler, "foreign", "/")
+	service.Handlers(servicesRouter, foreignerHandler, "", "/__foreign-destinations")
+	service.Handlers(servicesRouter, foreignerHandler, "", "/__foreign-dead-letters")
+	service.Handlers(servicesRouter, foreignerHandler, "", "/__foreign-dead-letters/{id}")
+	service.Handlers(servicesRouter, foreignerHandler, "", "/__foreign-dead-letters/{id}/retry")
+	readiness := &service.Readiness{}
+	service.AddAdminHandlers(servicesRouter, svc, bucketName, appSystemCode, readiness)
+
+	server := &http.Server{
+		Addr:              ":" + port,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       timeouts.read,
+		WriteTimeout:      timeouts.write,
+		IdleTimeout:       timeouts.idle,
+		TLSConfig:         tlsConfig,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
 
-	log.Infof("listening on %v", port)
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			log.Infof("listening with TLS on %v", port)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			log.Infof("listening on %v", port)
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Unable to start server: %v", err)
+		}
+	}()
+
+	waitForShutdown(server, readiness, cancel, timeouts.delay, timeouts.shutdown)
+}
 
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("Unable to start server: %v", err)
+// waitForShutdown blocks until SIGTERM or SIGINT is received, then takes the service out of rotation and, once
+// load balancers have had delay to notice, drains in-flight requests. Requests still running when the drain
+// deadline passes get their contexts cancelled.
+func waitForShutdown(server *http.Server, readiness *service.Readiness, cancel context.CancelFunc, delay, timeout time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+
+	readiness.Drain()
+	log.Infof("Received %v, failing __gtg for %v before draining in-flight requests for up to %v", sig, delay, timeout)
+	time.Sleep(delay)
+
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), timeout)
+	defer drainCancel()
+
+	if err := server.Shutdown(drainCtx); err != nil {
+		log.WithError(err).Warn("In-flight requests did not drain in time, cancelling outstanding S3 operations")
+		cancel()
+		if err := server.Close(); err != nil {
+			log.WithError(err).Error("Failed to close server")
+		}
+		return
 	}
-
+	log.Info("Server stopped gracefully")
 }
@@ -0,0 +1,324 @@
+package service
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	transactionid "github.com/Financial-Times/transactionid-utils-go"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Archive formats.
+const (
+	ArchiveZip   = "zip"
+	ArchiveTarGz = "tar.gz"
+)
+
+// ArchiveManifestName is the entry written last in every archive, describing the entries before it.
+const ArchiveManifestName = "manifest.json"
+
+const contentDateLayout = "2006-01-02"
+
+var (
+	errNothingToArchive = errors.New("no objects to archive")
+	errSourceNotFound   = errors.New("source not found")
+	errArchiveAborted   = errors.New("archive upload stopped")
+)
+
+// ArchiveSelection picks the objects of our bucket to archive, by exactly one of explicit keys, a key prefix,
+// or a range of content publish dates, both ends included.
+type ArchiveSelection struct {
+	Keys   []string `json:"keys,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+	From   string   `json:"from,omitempty"`
+	To     string   `json:"to,omitempty"`
+}
+
+func (s ArchiveSelection) Validate() error {
+	modes := 0
+	if len(s.Keys) > 0 {
+		modes++
+	}
+	if s.Prefix != "" {
+		modes++
+	}
+	if s.From != "" || s.To != "" {
+		modes++
+		from, err := time.Parse(contentDateLayout, s.From)
+		if err != nil {
+			return fmt.Errorf("invalid from date %q, expected YYYY-MM-DD", s.From)
+		}
+		to, err := time.Parse(contentDateLayout, s.To)
+		if err != nil {
+			return fmt.Errorf("invalid to date %q, expected YYYY-MM-DD", s.To)
+		}
+		if to.Before(from) {
+			return errors.New("the to date is before the from date")
+		}
+	}
+	if modes != 1 {
+		return errors.New("exactly one of 'source', 'sourcePrefix' or 'from' and 'to' is required")
+	}
+	return nil
+}
+
+// ArchiveEntry describes one object of our bucket as it was written to the archive.
+type ArchiveEntry struct {
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"contentType,omitempty"`
+	LastModified time.Time `json:"lastModified"`
+	SHA256       string    `json:"sha256"`
+}
+
+// ArchiveManifest is written into the archive as its last entry and returned to the caller.
+type ArchiveManifest struct {
+	Format        string           `json:"format"`
+	Created       time.Time        `json:"created"`
+	TransactionID string           `json:"transactionId"`
+	Selection     ArchiveSelection `json:"selection"`
+	Entries       []ArchiveEntry   `json:"entries"`
+}
+
+// archiveWriter adds entries to an archive in one of the formats.
+type archiveWriter interface {
+	create(e ArchiveEntry) (io.Writer, error)
+	Close() error
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (a zipArchive) create(e ArchiveEntry) (io.Writer, error) {
+	return a.CreateHeader(&zip.FileHeader{Name: e.Name, Method: zip.Deflate, Modified: e.LastModified})
+}
+
+// tarGzArchive needs the size of every entry up front, which S3 gives with the object.
+type tarGzArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a tarGzArchive) create(e ArchiveEntry) (io.Writer, error) {
+	err := a.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: e.Name, Size: e.Size, Mode: 0644, ModTime: e.LastModified})
+	return a.tw, err
+}
+
+func (a tarGzArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+func newArchiveWriter(format string, w io.Writer) archiveWriter {
+	if format == ArchiveTarGz {
+		gz := gzip.NewWriter(w)
+		return tarGzArchive{gz, tar.NewWriter(gz)}
+	}
+	return zipArchive{zip.NewWriter(w)}
+}
+
+func archiveContentType(format string) string {
+	if format == ArchiveTarGz {
+		return "application/gzip"
+	}
+	return "application/zip"
+}
+
+// selectKeys lists the keys of the selection. Explicit keys are taken as they are, and reported missing while archiving.
+func (c *ForeignCopier) selectKeys(ctx context.Context, sel ArchiveSelection) ([]string, error) {
+	if len(sel.Keys) > 0 {
+		return sel.Keys, nil
+	}
+	if sel.Prefix != "" {
+		var keys []string
+		err := c.source.EachObject(ctx, sel.Prefix, func(key string) (bool, error) {
+			keys = append(keys, key)
+			return true, nil
+		})
+		return keys, err
+	}
+
+	// Content is kept as <prefix>/<uuid>_<date>.json, so the whole prefix is listed and filtered by date. Without
+	// a content prefix that is "/", which keeps the listing to content.
+	var keys []string
+	err := c.source.EachObject(ctx, c.contentPrefix+"/", func(key string) (bool, error) {
+		name := strings.TrimSuffix(path.Base(key), ".json")
+		if i := strings.LastIndex(name, "_"); i >= 0 {
+			if date := name[i+1:]; date >= sel.From && date <= sel.To {
+				keys = append(keys, key)
+			}
+		}
+		return true, nil
+	})
+	return keys, err
+}
+
+// Archive writes the selected objects of our bucket into an archive at key in the target bucket, followed by a manifest.
+// The archive is streamed into a multipart upload as it is built, so at most one part is held in memory.
+// It returns errNothingToArchive when the selection is empty, and errSourceNotFound for a missing explicit key.
+func (c *ForeignCopier) Archive(ctx context.Context, sel ArchiveSelection, format string, t ForeignTarget, key string, tid string) (ArchiveManifest, error) {
+	ctx, cancel := withTimeout(ctx, c.foreigner.timeouts.Copy)
+	defer cancel()
+
+	manifest := ArchiveManifest{Format: format, Created: time.Now().UTC(), TransactionID: tid, Selection: sel, Entries: []ArchiveEntry{}}
+	keys, err := c.selectKeys(ctx, sel)
+	if err != nil {
+		return manifest, err
+	}
+	if len(keys) == 0 {
+		return manifest, errNothingToArchive
+	}
+	dest, err := c.foreigner.client(ctx, t)
+	if err != nil {
+		return manifest, err
+	}
+
+	pr, pw := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		err := c.writeArchive(ctx, pw, format, keys, &manifest)
+		pw.CloseWithError(err)
+		written <- err
+	}()
+	err = dest.WriteStream(ctx, key, pr, c.partSize, archiveContentType(format), tid)
+	// Unblocks the archive writer if the upload stopped before reading everything.
+	pr.CloseWithError(errArchiveAborted)
+	if werr := <-written; werr != nil && !errors.Is(werr, errArchiveAborted) {
+		return manifest, werr
+	}
+	if err != nil {
+		return manifest, err
+	}
+	log.WithFields(log.Fields{"bucketName": t.Bucket, "key": key, "entries": len(manifest.Entries), transactionid.TransactionIDKey: tid}).Info("Shipped archive")
+	return manifest, nil
+}
+
+func (c *ForeignCopier) writeArchive(ctx context.Context, w io.Writer, format string, keys []string, manifest *ArchiveManifest) error {
+	aw := newArchiveWriter(format, w)
+	for _, key := range keys {
+		e, err := c.archiveObject(ctx, aw, key)
+		if err != nil {
+			return err
+		}
+		manifest.Entries = append(manifest.Entries, e)
+	}
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	mw, err := aw.create(ArchiveEntry{Name: ArchiveManifestName, Size: int64(len(b)), LastModified: manifest.Created})
+	if err != nil {
+		return err
+	}
+	if _, err = mw.Write(b); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+func (c *ForeignCopier) archiveObject(ctx context.Context, aw archiveWriter, key string) (ArchiveEntry, error) {
+	resp, err := c.source.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.source.bucketName),
+		Key:    aws.String(key),
+	})
+	if isNotFound(err) {
+		return ArchiveEntry{}, fmt.Errorf("%w: %s", errSourceNotFound, key)
+	}
+	if err != nil {
+		return ArchiveEntry{}, err
+	}
+	defer resp.Body.Close()
+
+	e := ArchiveEntry{
+		Name:         strings.TrimPrefix(key, "/"),
+		Size:         aws.ToInt64(resp.ContentLength),
+		ContentType:  aws.ToString(resp.ContentType),
+		LastModified: aws.ToTime(resp.LastModified),
+	}
+	ew, err := aw.create(e)
+	if err != nil {
+		return e, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(ew, h), resp.Body)
+	if err != nil {
+		return e, fmt.Errorf("archiving %s: %w", key, err)
+	}
+	if n != e.Size {
+		return e, fmt.Errorf("archiving %s: read %d of %d bytes", key, n, e.Size)
+	}
+	e.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return e, nil
+}
+
+// HandleForeignerArchive builds an archive of objects in our bucket and ships it to the foreign destination at 'key'.
+// The objects are given by repeated 'source' keys, a 'sourcePrefix', or a 'from' and 'to' content publish date,
+// and 'format' is "zip", the default, or "tar.gz".
+func (h *ForeignerHandler) HandleForeignerArchive(rw http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	switch format {
+	case "":
+		format = ArchiveZip
+	case ArchiveZip, ArchiveTarGz:
+	default:
+		respondWithBadRequest(rw, fmt.Sprintf("Invalid format %q, expected %q or %q.", format, ArchiveZip, ArchiveTarGz))
+		return
+	}
+	sel := ArchiveSelection{Keys: q["source"], Prefix: q.Get("sourcePrefix"), From: q.Get("from"), To: q.Get("to")}
+	if err := sel.Validate(); err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return
+	}
+	// Sources are authorized as generic store keys, so they are held to the same policy.
+	for _, source := range sel.Keys {
+		if err := h.copier.keys.Check(source); err != nil {
+			respondWithBadRequest(rw, err.Error())
+			return
+		}
+	}
+	if sel.Prefix != "" {
+		if err := h.copier.keys.CheckPrefix(sel.Prefix); err != nil {
+			respondWithBadRequest(rw, err.Error())
+			return
+		}
+	}
+	target, key, ok := h.targetRequest(rw, r, "key")
+	if !ok {
+		return
+	}
+	tid := transactionid.GetTransactionIDFromRequest(r)
+
+	ctx := transactionid.TransactionAwareContext(r.Context(), tid)
+	manifest, err := h.copier.Archive(ctx, sel, format, target, key, tid)
+	switch {
+	case errors.Is(err, errSourceNotFound):
+		respondSourceNotFound(rw)
+	case errors.Is(err, errNothingToArchive):
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("{\"message\":\"No objects to archive\"}"))
+	case err != nil:
+		foreignerServiceUnavailable(target.Bucket, err, rw)
+	default:
+		respondJSON(rw, http.StatusCreated, manifest)
+	}
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testArchiveObjects = map[string]string{
+	"our-bucket/archives/2017/a.json":                                         "FIRST-OBJECT-SPANNING-PARTS",
+	"our-bucket/archives/2017/b.json":                                         "SECOND",
+	"our-bucket/content/123e4567-e89b-12d3-a456-426655440000_2017-10-10.json": "CONTENT-A",
+	"our-bucket/content/223e4567-e89b-12d3-a456-426655440000_2017-10-12.json": "CONTENT-B",
+	"our-bucket/content/323e4567-e89b-12d3-a456-426655440000_2017-11-01.json": "CONTENT-C",
+}
+
+func newTestCopierHandler(srvURL string) ForeignerHandler {
+	f := newFakeS3Foreigner(srvURL)
+	return NewForeignerHandler(f, NewForeignCopier(newOurBucket(f), f, MinPartSize, "content", "concept", "foreign-import-staging", NewKeyPolicy("content", "concept", "foreign-queue", "foreign-import-staging")), nil, NewForeignPolicy(nil, []string{"partner-bucket"}, nil), nil, 60)
+}
+
+func sha256Hex(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func TestHandleForeignerArchiveZip(t *testing.T) {
+	objects := map[string]string{}
+	for k, v := range testArchiveObjects {
+		objects[k] = v
+	}
+	fake, srv := newFakeS3(objects)
+	defer srv.Close()
+	h := newTestCopierHandler(srv.URL)
+	h.copier.partSize = 64
+
+	rec := httptest.NewRecorder()
+	h.HandleForeignerArchive(rec, newRequest("PUT", "/foreign/archive?region=eu-west-1&bucket=partner-bucket&role="+destinationRole+"&key=exports/2017.zip&sourcePrefix=archives/2017/", ""))
+	assert.Equal(t, 201, rec.Code)
+	var manifest ArchiveManifest
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &manifest))
+	assert.Equal(t, ArchiveZip, manifest.Format)
+	assert.Len(t, manifest.Entries, 2)
+	assert.True(t, fake.partUploads > 1, "the archive is streamed in parts")
+
+	archive := fake.objects["partner-bucket/exports/2017.zip"]
+	zr, err := zip.NewReader(bytes.NewReader([]byte(archive)), int64(len(archive)))
+	assert.NoError(t, err)
+	contents := map[string]string{}
+	var names []string
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		assert.NoError(t, err)
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		contents[f.Name] = string(b)
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, ArchiveManifestName, names[len(names)-1], "the manifest is the last entry")
+	for _, e := range manifest.Entries {
+		assert.Equal(t, testArchiveObjects["our-bucket/"+e.Name], contents[e.Name])
+		assert.Equal(t, sha256Hex(contents[e.Name]), e.SHA256)
+		assert.Equal(t, int64(len(contents[e.Name])), e.Size)
+	}
+	var archived ArchiveManifest
+	assert.NoError(t, json.Unmarshal([]byte(contents[ArchiveManifestName]), &archived))
+	assert.Equal(t, manifest.Entries, archived.Entries)
+}
+
+func TestHandleForeignerArchiveTarGz(t *testing.T) {
+	fake, srv := newFakeS3(testArchiveObjects)
+	defer srv.Close()
+	h := newTestCopierHandler(srv.URL)
+
+	rec := httptest.NewRecorder()
+	h.HandleForeignerArchive(rec, newRequest("PUT", "/foreign/archive?region=eu-west-1&bucket=partner-bucket&role="+destinationRole+"&key=content.tar.gz&format=tar.gz&from=2017-10-01&to=2017-10-31", ""))
+	assert.Equal(t, 201, rec.Code)
+	assert.Equal(t, "application/gzip", fake.headers["partner-bucket/content.tar.gz"].Get("Content-Type"))
+
+	gz, err := gzip.NewReader(bytes.NewReader([]byte(fake.objects["partner-bucket/content.tar.gz"])))
+	assert.NoError(t, err)
+	tr := tar.NewReader(gz)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	assert.Equal(t, []string{
+		"content/123e4567-e89b-12d3-a456-426655440000_2017-10-10.json",
+		"content/223e4567-e89b-12d3-a456-426655440000_2017-10-12.json",
+		ArchiveManifestName,
+	}, names)
+}
+
+func TestHandleForeignerArchiveRejects(t *testing.T) {
+	fake, srv := newFakeS3(testArchiveObjects)
+	defer srv.Close()
+	h := newTestCopierHandler(srv.URL)
+	query := "/foreign/archive?region=eu-west-1&bucket=partner-bucket&role=" + destinationRole + "&key=a.zip"
+
+	for params, expected := range map[string]int{
+		"": 400,
+		"&source=archives/2017/a.json&sourcePrefix=archives/": 400,
+		"&from=2017-10-01":                                                     400,
+		"&from=2017-10-31&to=2017-10-01":                                       400,
+		"&source=archives/2017/a.json&format=rar":                              400,
+		"&source=content/123e4567-e89b-12d3-a456-426655440000_2017-10-10.json": 400,
+		"&sourcePrefix=foreign-queue/":                                         400,
+		"&sourcePrefix=cont":                                                   400,
+		"&sourcePrefix=archives/&destination=partner-archive":                  400,
+		"&sourcePrefix=nothing/":                                               404,
+		"&source=archives/2017/a.json&source=archives/2017/missing.json":       404,
+	} {
+		rec := httptest.NewRecorder()
+		h.HandleForeignerArchive(rec, newRequest("PUT", query+params, ""))
+		assert.Equal(t, expected, rec.Code, params)
+	}
+	assert.NotContains(t, fake.objects, "partner-bucket/a.zip", "nothing is left behind by a failed archive")
+
+	rec := httptest.NewRecorder()
+	h.HandleForeignerArchive(rec, newRequest("PUT", "/foreign/archive?region=eu-west-1&bucket=other-bucket&role="+destinationRole+"&key=a.zip&sourcePrefix=archives/", ""))
+	assert.Equal(t, 403, rec.Code)
+}
+
+func TestHandleForeignerArchiveDateRangeWithoutContentPrefix(t *testing.T) {
+	fake, srv := newFakeS3(map[string]string{
+		"our-bucket//123e4567-e89b-12d3-a456-426655440000_2017-10-10.json": "CONTENT-A",
+		"our-bucket/foreign-queue/0123456789abcdef.json":                   "JOB",
+		"our-bucket/archives/2017_2017-10-10.json":                         "NOT-CONTENT",
+	})
+	defer srv.Close()
+	f := newFakeS3Foreigner(srv.URL)
+	h := NewForeignerHandler(f, NewForeignCopier(newOurBucket(f), f, MinPartSize, "", "", "foreign-import-staging", NewKeyPolicy("foreign-queue", "foreign-import-staging")), nil, NewForeignPolicy(nil, []string{"partner-bucket"}, nil), nil, 60)
+
+	rec := httptest.NewRecorder()
+	h.HandleForeignerArchive(rec, newRequest("PUT", "/foreign/archive?region=eu-west-1&bucket=partner-bucket&role="+destinationRole+"&key=content.zip&from=2017-10-01&to=2017-10-31", ""))
+	assert.Equal(t, 201, rec.Code)
+	var manifest ArchiveManifest
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &manifest))
+	if assert.Len(t, manifest.Entries, 1, "only content is archived") {
+		assert.Equal(t, "123e4567-e89b-12d3-a456-426655440000_2017-10-10.json", manifest.Entries[0].Name)
+	}
+	archive := fake.objects["partner-bucket/content.zip"]
+	zr, err := zip.NewReader(bytes.NewReader([]byte(archive)), int64(len(archive)))
+	assert.NoError(t, err)
+	for _, f := range zr.File {
+		assert.NotEqual(t, '/', f.Name[0], f.Name)
+	}
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+
+	transactionid "github.com/Financial-Times/transactionid-utils-go"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSessionName = "upp-exports-rw-s3"
+	maxSessionNameLen  = 64
+)
+
+var invalidSessionNameChars = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// RoleOptions configures how one hop of a role chain is assumed.
+type RoleOptions struct {
+	ExternalID      string            `json:"externalId"`
+	DurationSeconds int32             `json:"durationSeconds"`
+	Tags            map[string]string `json:"tags"`
+	// ScopeToBucket attaches an inline session policy that limits the hop to the destination bucket.
+	// It only applies when the role is the last hop of a chain, the one whose credentials talk to S3.
+	ScopeToBucket bool `json:"scopeToBucket"`
+}
+
+// LoadRoleOptions reads a JSON object mapping role ARNs to the options used to assume them.
+func LoadRoleOptions(path string) (map[string]RoleOptions, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	options := make(map[string]RoleOptions)
+	if err := json.Unmarshal(b, &options); err != nil {
+		return nil, fmt.Errorf("parsing role options %s: %w", path, err)
+	}
+	for role, o := range options {
+		if o.DurationSeconds != 0 && (o.DurationSeconds < 900 || o.DurationSeconds > 43200) {
+			return nil, fmt.Errorf("role %s: durationSeconds must be between 900 and 43200", role)
+		}
+	}
+	return options, nil
+}
+
+// stsAPI is the part of the STS client used to assume roles.
+type stsAPI interface {
+	AssumeRole(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error)
+}
+
+// assumeRoleProvider assumes one hop of a role chain. The session name stays the same whichever request assumes
+// the role, as its credentials are cached for the requests that follow, and the transaction that caused each session
+// is logged next to it instead, so a session in CloudTrail still leads back to our logs.
+type assumeRoleProvider struct {
+	client      stsAPI
+	role        string
+	sessionName string
+	options     RoleOptions
+	policy      string
+}
+
+func (p *assumeRoleProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	tid, _ := transactionid.GetTransactionIDFromContext(ctx)
+	log.WithFields(log.Fields{"role": p.role, "sessionName": p.sessionName, "transaction_id": tid}).Info("Assuming role")
+	input := &sts.AssumeRoleInput{
+		RoleArn:         aws.String(p.role),
+		RoleSessionName: aws.String(p.sessionName),
+	}
+	if p.options.ExternalID != "" {
+		input.ExternalId = aws.String(p.options.ExternalID)
+	}
+	if p.options.DurationSeconds != 0 {
+		input.DurationSeconds = aws.Int32(p.options.DurationSeconds)
+	}
+	for k, v := range p.options.Tags {
+		input.Tags = append(input.Tags, types.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	if p.policy != "" {
+		input.Policy = aws.String(p.policy)
+	}
+
+	resp, err := p.client.AssumeRole(ctx, input)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("assuming role %s: %w", p.role, err)
+	}
+	return aws.Credentials{
+		Source:          "AssumeRole",
+		AccessKeyID:     aws.ToString(resp.Credentials.AccessKeyId),
+		SecretAccessKey: aws.ToString(resp.Credentials.SecretAccessKey),
+		SessionToken:    aws.ToString(resp.Credentials.SessionToken),
+		CanExpire:       true,
+		Expires:         aws.ToTime(resp.Credentials.Expiration),
+	}, nil
+}
+
+// roleSessionName derives a valid role session name from name, or falls back to the default.
+func roleSessionName(name string) string {
+	name = invalidSessionNameChars.ReplaceAllString(name, "-")
+	if len(name) < 2 {
+		return defaultSessionName
+	}
+	if len(name) > maxSessionNameLen {
+		name = name[:maxSessionNameLen]
+	}
+	return name
+}
+
+type policyDocument struct {
+	Version   string            `json:"Version"`
+	Statement []policyStatement `json:"Statement"`
+}
+
+type policyStatement struct {
+	Effect   string   `json:"Effect"`
+	Action   string   `json:"Action"`
+	Resource []string `json:"Resource"`
+}
+
+// bucketSessionPolicy allows nothing but S3 actions on bucket and its objects.
+func bucketSessionPolicy(bucket string) string {
+	b, _ := json.Marshal(policyDocument{
+		Version: "2012-10-17",
+		Statement: []policyStatement{{
+			Effect:   "Allow",
+			Action:   "s3:*",
+			Resource: []string{"arn:aws:s3:::" + bucket, "arn:aws:s3:::" + bucket + "/*"},
+		}},
+	})
+	return string(b)
+}
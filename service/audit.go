@@ -0,0 +1,20 @@
+package service
+
+import (
+	"context"
+
+	transactionid "github.com/Financial-Times/transactionid-utils-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// auditLog starts an audit trail entry for event. Audit entries are logged with audit=true, so they can be
+// searched for and kept apart from the rest of the logs.
+func auditLog(ctx context.Context, event string) *log.Entry {
+	tid, _ := transactionid.GetTransactionIDFromContext(ctx)
+	return log.WithFields(log.Fields{
+		"audit":                        true,
+		"event":                        event,
+		"clientIdentity":               ClientIdentity(ctx),
+		transactionid.TransactionIDKey: tid,
+	})
+}
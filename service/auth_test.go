@@ -0,0 +1,129 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSecret = "s3cr3t"
+
+func signedRequest(method, url, body, client, secret string, at time.Time) *http.Request {
+	req := newRequest(method, url, body)
+	digest := sha256.Sum256([]byte(body))
+	ts := strconv.FormatInt(at.Unix(), 10)
+	req.Header.Set(ClientIDHeader, client)
+	req.Header.Set(TimestampHeader, ts)
+	req.Header.Set(ContentSHA256Header, hex.EncodeToString(digest[:]))
+	req.Header.Set(SignatureHeader, Sign(secret, StringToSign(method, req.URL.RequestURI(), ts, hex.EncodeToString(digest[:]))))
+	return req
+}
+
+func newSignedConceptRouter() (*mux.Router, *mockWriter) {
+	r := mux.NewRouter()
+	mw := &mockWriter{}
+	wh := NewWriterHandler(mw, &mockReader{}, KeyPolicy{})
+	rh := NewReaderHandler(&mockReader{payload: "x"}, KeyPolicy{})
+	auth := NewHMACAuthenticator(map[string]string{"cct": testSecret}, time.Minute)
+	conceptMethodHandler := &handlers.MethodHandler{
+		"PUT": http.HandlerFunc(wh.HandleConceptWrite),
+		"GET": http.HandlerFunc(rh.HandleConceptGet),
+	}
+	Handlers(r, auth.Handler([]string{"GET"}, conceptMethodHandler), ExpectedResourcePath, "/{filename}")
+	return r, mw
+}
+
+func TestHMACAuthentication(t *testing.T) {
+	url := withExpectedResourcePath("/organisations?x=1")
+
+	t.Run("Valid signature", func(t *testing.T) {
+		r, mw := newSignedConceptRouter()
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, signedRequest("PUT", url, "PAYLOAD", "cct", testSecret, time.Now()))
+		assert.Equal(t, 200, rec.Code)
+		assert.Equal(t, "PAYLOAD", mw.payload)
+	})
+
+	t.Run("Exempt method", func(t *testing.T) {
+		r, _ := newSignedConceptRouter()
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, newRequest("GET", url, ""))
+		assert.Equal(t, 200, rec.Code)
+	})
+
+	t.Run("Missing signature", func(t *testing.T) {
+		r, mw := newSignedConceptRouter()
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, newRequest("PUT", url, "PAYLOAD"))
+		assert.Equal(t, 401, rec.Code)
+		assert.False(t, mw.writeCalled)
+	})
+
+	t.Run("Wrong secret", func(t *testing.T) {
+		r, _ := newSignedConceptRouter()
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, signedRequest("PUT", url, "PAYLOAD", "cct", "other", time.Now()))
+		assert.Equal(t, 401, rec.Code)
+	})
+
+	t.Run("Stale timestamp", func(t *testing.T) {
+		r, _ := newSignedConceptRouter()
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, signedRequest("PUT", url, "PAYLOAD", "cct", testSecret, time.Now().Add(-2*time.Minute)))
+		assert.Equal(t, 401, rec.Code)
+	})
+
+	t.Run("Replay", func(t *testing.T) {
+		r, _ := newSignedConceptRouter()
+		now := time.Now()
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, signedRequest("PUT", url, "PAYLOAD", "cct", testSecret, now))
+		assert.Equal(t, 200, rec.Code)
+		rec = httptest.NewRecorder()
+		r.ServeHTTP(rec, signedRequest("PUT", url, "PAYLOAD", "cct", testSecret, now))
+		assert.Equal(t, 401, rec.Code)
+	})
+
+	t.Run("Tampered query", func(t *testing.T) {
+		r, _ := newSignedConceptRouter()
+		req := signedRequest("PUT", url, "PAYLOAD", "cct", testSecret, time.Now())
+		req.URL.RawQuery = "x=2"
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		assert.Equal(t, 401, rec.Code)
+	})
+
+	t.Run("Tampered body", func(t *testing.T) {
+		r, mw := newSignedConceptRouter()
+		req := signedRequest("PUT", url, "PAYLOAD", "cct", testSecret, time.Now())
+		tampered := newRequest("PUT", url, "TAMPERED")
+		req.Body = tampered.Body
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		assert.Equal(t, 401, rec.Code)
+		assert.False(t, mw.writeCalled)
+	})
+}
+
+func TestLoadClientSecrets(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secrets.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"cct":"one","archive-exporter":"two"}`), 0600))
+	secrets, err := LoadClientSecrets(path)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"cct": "one", "archive-exporter": "two"}, secrets)
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"cct":""}`), 0600))
+	_, err = LoadClientSecrets(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,301 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Operations a policy can grant.
+const (
+	OperationRead    = "read"
+	OperationWrite   = "write"
+	OperationDelete  = "delete"
+	OperationPresign = "presign"
+	OperationForeign = "foreign"
+	OperationAdmin   = "admin"
+)
+
+// Route groups the service exposes.
+const (
+	RouteGroupContent = "content"
+	RouteGroupConcept = "concept"
+	RouteGroupGeneric = "generic"
+	RouteGroupPresign = "presign"
+	RouteGroupForeign = "foreign"
+)
+
+var knownRouteGroups = map[string]bool{
+	RouteGroupContent: true,
+	RouteGroupConcept: true,
+	RouteGroupGeneric: true,
+	RouteGroupPresign: true,
+	RouteGroupForeign: true,
+}
+
+// CheckRouteGroup reports an error for a name that is not one of the route groups, so that a typo in the
+// configuration fails at startup rather than silently leaving a group unprotected.
+func CheckRouteGroup(name string) error {
+	if !knownRouteGroups[name] {
+		return fmt.Errorf("unknown route group %q", name)
+	}
+	return nil
+}
+
+const (
+	anonymousClient = "anonymous"
+	anyClient       = "*"
+)
+
+var knownOperations = map[string]bool{
+	OperationRead:    true,
+	OperationWrite:   true,
+	OperationDelete:  true,
+	OperationPresign: true,
+	OperationForeign: true,
+	OperationAdmin:   true,
+}
+
+// foreignAdminPathPrefix starts the paths of the admin endpoints of the foreign route group, which are authorized
+// as the admin operation on foreign/<path>.
+const foreignAdminPathPrefix = "/__foreign-"
+
+// PolicyRule grants operations on keys starting with one of the prefixes.
+// Keys are the route group followed by the resource key, e.g. "concept/organisations.json".
+type PolicyRule struct {
+	Operations []string `json:"operations"`
+	Prefixes   []string `json:"prefixes"`
+}
+
+func (r PolicyRule) allows(operation, key string) bool {
+	opAllowed := false
+	for _, op := range r.Operations {
+		if op == operation {
+			opAllowed = true
+			break
+		}
+	}
+	if !opAllowed {
+		return false
+	}
+	for _, prefix := range r.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy maps client identities to the rules that apply to them. Rules under "*" apply to every client,
+// and unauthenticated callers are known as "anonymous".
+type Policy struct {
+	Clients map[string][]PolicyRule `json:"clients"`
+}
+
+// LoadPolicy reads an authorization policy from a JSON file.
+func LoadPolicy(path string) (*Policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("parsing policy %s: %w", path, err)
+	}
+	for client, rules := range p.Clients {
+		for _, rule := range rules {
+			for _, op := range rule.Operations {
+				if !knownOperations[op] {
+					return nil, fmt.Errorf("client %s: unknown operation %q", client, op)
+				}
+			}
+		}
+	}
+	return &p, nil
+}
+
+// Allows reports whether client may perform operation on key.
+func (p *Policy) Allows(client, operation, key string) bool {
+	for _, id := range []string{client, anyClient} {
+		for _, rule := range p.Clients[id] {
+			if rule.allows(operation, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authorizer enforces a Policy in front of the resource handlers.
+type Authorizer struct {
+	policy *Policy
+}
+
+func NewAuthorizer(policy *Policy) *Authorizer {
+	return &Authorizer{policy: policy}
+}
+
+// Handler checks every request to the route group served under resourcePath and answers 403 on denial.
+func (a *Authorizer) Handler(group, resourcePath string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		client := ClientIdentity(r.Context())
+		if client == "" {
+			client = anonymousClient
+		}
+		operation := operationFor(group, r.Method)
+		if isForeignAdmin(group, r) {
+			operation = OperationAdmin
+		} else if group == RouteGroupForeign {
+			if _, _, err := foreignTargetParams(r.URL.Query()); err != nil {
+				respondWithBadRequest(rw, err.Error())
+				return
+			}
+		}
+		for _, key := range resourceKeys(group, resourcePath, r) {
+			if !a.allows(client, operation, group+"/"+key) {
+				respondForbidden(rw)
+				return
+			}
+		}
+		// Presigned uploads, and their completion, also write to the store the object goes to.
+		if key, ok := presignedUploadKey(resourcePath, r); ok && group == RouteGroupPresign {
+			if !a.allows(client, OperationWrite, key) {
+				respondForbidden(rw)
+				return
+			}
+		}
+		// Foreign copies and archives also read their sources in our bucket.
+		if group == RouteGroupForeign {
+			for _, key := range sourceKeys(r.URL.Query()) {
+				if !a.allows(client, OperationRead, key) {
+					respondForbidden(rw)
+					return
+				}
+			}
+			// An import also writes to our generic or concept store.
+			if spec, err := parseImportSpec(r.URL.Query()); err == nil && r.URL.Path == "/"+resourcePath+"/import" {
+				if !a.allows(client, OperationWrite, spec.authzKey()) {
+					respondForbidden(rw)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+func (a *Authorizer) allows(client, operation, key string) bool {
+	if a.policy.Allows(client, operation, key) {
+		return true
+	}
+	log.WithFields(log.Fields{
+		"client":    client,
+		"operation": operation,
+		"key":       key,
+	}).Warn("Request denied by authorization policy")
+	return false
+}
+
+func respondForbidden(rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusForbidden)
+	rw.Write([]byte("{\"message\":\"Operation not permitted\"}"))
+}
+
+func operationFor(group, method string) string {
+	switch group {
+	case RouteGroupPresign:
+		return OperationPresign
+	case RouteGroupForeign:
+		return OperationForeign
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return OperationRead
+	case http.MethodDelete:
+		return OperationDelete
+	default:
+		return OperationWrite
+	}
+}
+
+func isForeignAdmin(group string, r *http.Request) bool {
+	return group == RouteGroupForeign && strings.HasPrefix(r.URL.Path, foreignAdminPathPrefix)
+}
+
+// sourceKeys are the keys of our bucket a foreign request reads: generic store keys or a prefix of them, or all
+// content for an archive of a date range.
+func sourceKeys(q url.Values) []string {
+	var keys []string
+	for _, source := range q["source"] {
+		keys = append(keys, RouteGroupGeneric+"/"+source)
+	}
+	if prefix := q.Get("sourcePrefix"); prefix != "" {
+		keys = append(keys, RouteGroupGeneric+"/"+prefix)
+	}
+	if q.Get("from") != "" || q.Get("to") != "" {
+		keys = append(keys, RouteGroupContent+"/")
+	}
+	return keys
+}
+
+// presignedUploadKey is the store key a presign request uploads to, if it is for an upload. Uploads are only
+// presigned, and completed, by POSTs.
+func presignedUploadKey(resourcePath string, r *http.Request) (string, bool) {
+	if r.Method != http.MethodPost {
+		return "", false
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/"+resourcePath+"/")
+	method := strings.ToUpper(r.URL.Query().Get("method"))
+	complete := method == "" && strings.HasSuffix(name, "/complete")
+	if method != http.MethodPut && method != http.MethodPost && !complete {
+		return "", false
+	}
+	store := r.URL.Query().Get("store")
+	if store == "" {
+		store = RouteGroupGeneric
+	}
+	return store + "/" + strings.TrimSuffix(name, "/complete"), true
+}
+
+// resourceKeys are the parts of the request that identify the objects being touched.
+// Foreign requests carry their destination in the query string, listings a prefix instead of a key.
+// A destination named in the query is keyed like the /foreign/{destination}/{key} route, once for every
+// destination of a fan-out.
+func resourceKeys(group, resourcePath string, r *http.Request) []string {
+	if isForeignAdmin(group, r) {
+		return []string{strings.TrimPrefix(r.URL.Path, "/")}
+	}
+	if group == RouteGroupForeign {
+		q := r.URL.Query()
+		key := q.Get("key")
+		if key == "" {
+			key = q.Get("prefix")
+		}
+		destinations, bucket, _ := foreignTargetParams(q)
+		if bucket != "" {
+			return []string{bucket + "/" + key}
+		}
+		if len(destinations) > 0 {
+			keys := make([]string, len(destinations))
+			for i, d := range destinations {
+				keys[i] = d + "/" + key
+			}
+			return keys
+		}
+	}
+	// A batch presign names its keys in the query.
+	if group == RouteGroupPresign && r.URL.Path == "/"+resourcePath {
+		return r.URL.Query()["key"]
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if resourcePath != "" {
+		key = strings.TrimPrefix(key, resourcePath+"/")
+	}
+	return []string{key}
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicy = `{
+  "clients": {
+    "content-publisher": [{"operations": ["read", "write", "delete"], "prefixes": ["content/"]}],
+    "archive-exporter": [
+      {"operations": ["foreign"], "prefixes": ["foreign/partner-bucket/exports/", "foreign/partner-archive/"]},
+      {"operations": ["read"], "prefixes": ["generic/archives/"]}
+    ],
+    "archive-importer": [
+      {"operations": ["foreign"], "prefixes": ["foreign/partner-bucket/exports/"]},
+      {"operations": ["write"], "prefixes": ["generic/archives/"]}
+    ],
+    "uploader": [
+      {"operations": ["presign"], "prefixes": ["presign/"]},
+      {"operations": ["write"], "prefixes": ["generic/uploads-"]}
+    ],
+    "downloader": [{"operations": ["presign"], "prefixes": ["presign/reports-", "presign/concept/"]}],
+    "operator": [{"operations": ["admin"], "prefixes": ["foreign/__foreign-"]}],
+    "*": [{"operations": ["read"], "prefixes": ["concept/"]}]
+  }
+}`
+
+func loadTestPolicy(t *testing.T, policy string) (*Policy, error) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	assert.NoError(t, os.WriteFile(path, []byte(policy), 0600))
+	return LoadPolicy(path)
+}
+
+func TestLoadPolicy(t *testing.T) {
+	p, err := loadTestPolicy(t, testPolicy)
+	assert.NoError(t, err)
+	assert.True(t, p.Allows("content-publisher", OperationDelete, "content/abc"))
+	assert.False(t, p.Allows("content-publisher", OperationDelete, "concept/abc"))
+	assert.True(t, p.Allows("content-publisher", OperationRead, "concept/abc"), "rules for * apply to everyone")
+	assert.True(t, p.Allows(anonymousClient, OperationRead, "concept/abc"))
+	assert.False(t, p.Allows(anonymousClient, OperationWrite, "concept/abc"))
+
+	_, err = loadTestPolicy(t, `{"clients": {"x": [{"operations": ["destroy"], "prefixes": [""]}]}}`)
+	assert.Error(t, err)
+}
+
+func TestAuthorizerHandler(t *testing.T) {
+	p, err := loadTestPolicy(t, testPolicy)
+	assert.NoError(t, err)
+	authz := NewAuthorizer(p)
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})
+
+	r := mux.NewRouter()
+	Handlers(r, authz.Handler(RouteGroupConcept, "concept", &handlers.MethodHandler{"GET": ok, "DELETE": ok}), "concept", "/{fileName}")
+	Handlers(r, authz.Handler(RouteGroupForeign, "foreign", &handlers.MethodHandler{"PUT": ok}), "foreign", "/")
+	Handlers(r, authz.Handler(RouteGroupForeign, "foreign", &handlers.MethodHandler{"GET": ok}), "foreign", "/list")
+	Handlers(r, authz.Handler(RouteGroupForeign, "foreign", &handlers.MethodHandler{"PUT": ok}), "foreign", "/copy")
+	Handlers(r, authz.Handler(RouteGroupForeign, "foreign", &handlers.MethodHandler{"PUT": ok}), "foreign", "/fanout")
+	Handlers(r, authz.Handler(RouteGroupForeign, "foreign", &handlers.MethodHandler{"GET": ok}), "foreign", "/preflight")
+	Handlers(r, authz.Handler(RouteGroupForeign, "foreign", &handlers.MethodHandler{"PUT": ok}), "foreign", "/archive")
+	Handlers(r, authz.Handler(RouteGroupForeign, "foreign", &handlers.MethodHandler{"PUT": ok}), "foreign", "/import")
+	Handlers(r, authz.Handler(RouteGroupForeign, "foreign", &handlers.MethodHandler{"GET": ok}), "", "/__foreign-destinations")
+	Handlers(r, authz.Handler(RouteGroupForeign, "foreign", &handlers.MethodHandler{"POST": ok}), "", "/__foreign-dead-letters/{id}/retry")
+	Handlers(r, authz.Handler(RouteGroupPresign, "presign", &handlers.MethodHandler{"GET": ok}), "presign", "")
+	Handlers(r, authz.Handler(RouteGroupPresign, "presign", &handlers.MethodHandler{"GET": ok}), "presign", "/content/{uuid}")
+	Handlers(r, authz.Handler(RouteGroupPresign, "presign", &handlers.MethodHandler{"GET": ok}), "presign", "/concept/{fileName}")
+	Handlers(r, authz.Handler(RouteGroupPresign, "presign", &handlers.MethodHandler{"POST": ok}), "presign", "/{key:.+}/complete")
+	Handlers(r, authz.Handler(RouteGroupPresign, "presign", &handlers.MethodHandler{"GET": ok, "POST": ok}), "presign", "/{key:.+}")
+
+	serve := func(method, url, client string) int {
+		req := newRequest(method, url, "")
+		if client != "" {
+			req = req.WithContext(WithClientIdentity(req.Context(), client))
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, 200, serve("GET", "/concept/organisations", ""))
+	assert.Equal(t, 403, serve("DELETE", "/concept/organisations", "content-publisher"))
+	assert.Equal(t, 200, serve("PUT", "/foreign/?bucket=partner-bucket&key=exports/a.zip", "archive-exporter"))
+	assert.Equal(t, 403, serve("PUT", "/foreign/?bucket=partner-bucket&key=other/a.zip", "archive-exporter"))
+	assert.Equal(t, 403, serve("PUT", "/foreign/?bucket=partner-bucket&key=exports/a.zip", "content-publisher"))
+	assert.Equal(t, 200, serve("GET", "/foreign/list?bucket=partner-bucket&prefix=exports/2017", "archive-exporter"))
+	assert.Equal(t, 403, serve("GET", "/foreign/list?bucket=partner-bucket&prefix=", "archive-exporter"))
+	assert.Equal(t, 200, serve("PUT", "/foreign/copy?bucket=partner-bucket&key=exports/a.zip&source=archives/a.zip", "archive-exporter"))
+	assert.Equal(t, 403, serve("PUT", "/foreign/copy?bucket=partner-bucket&key=exports/a.zip&source=private/a.zip", "archive-exporter"))
+	assert.Equal(t, 200, serve("PUT", "/foreign/fanout?destination=partner-archive&key=a.zip", "archive-exporter"))
+	assert.Equal(t, 403, serve("PUT", "/foreign/fanout?destination=partner-archive&destination=other&key=a.zip", "archive-exporter"), "every destination is checked")
+	assert.Equal(t, 400, serve("PUT", "/foreign/fanout?bucket=partner-bucket&destination=secret&key=exports/a.zip", "archive-exporter"), "a bucket can't stand in for the destination it is sent with")
+	assert.Equal(t, 400, serve("GET", "/foreign/preflight?bucket=partner-bucket&destination=secret&prefix=exports/", "archive-exporter"))
+	assert.Equal(t, 200, serve("PUT", "/foreign/archive?bucket=partner-bucket&key=exports/a.zip&sourcePrefix=archives/2017/", "archive-exporter"))
+	assert.Equal(t, 403, serve("PUT", "/foreign/archive?bucket=partner-bucket&key=exports/a.zip&source=archives/a.json&source=private/b.json", "archive-exporter"))
+	assert.Equal(t, 400, serve("PUT", "/foreign/archive?bucket=partner-bucket&destination=secret&key=exports/a.zip&sourcePrefix=archives/2017/", "archive-exporter"), "an archive names a bucket or a destination")
+	assert.Equal(t, 403, serve("PUT", "/foreign/archive?bucket=partner-bucket&key=exports/a.zip&from=2017-10-01&to=2017-10-31", "archive-exporter"), "archiving content needs read on content/")
+	assert.Equal(t, 403, serve("PUT", "/foreign/import?bucket=partner-bucket&key=exports/a.zip&target=archives/a.zip", "archive-exporter"), "importing needs write on the generic store")
+	assert.Equal(t, 200, serve("PUT", "/foreign/import?bucket=partner-bucket&key=exports/a.zip&target=archives/a.zip", "archive-importer"))
+	assert.Equal(t, 403, serve("PUT", "/foreign/import?bucket=partner-bucket&key=exports/a.zip&into=concept", "archive-importer"))
+	assert.Equal(t, 200, serve("GET", "/__foreign-destinations", "operator"))
+	assert.Equal(t, 403, serve("GET", "/__foreign-destinations", "archive-exporter"), "listing destinations needs admin")
+	assert.Equal(t, 403, serve("GET", "/__foreign-destinations", ""))
+	assert.Equal(t, 200, serve("POST", "/__foreign-dead-letters/abc/retry", "operator"))
+	assert.Equal(t, 403, serve("POST", "/__foreign-dead-letters/abc/retry", "archive-exporter"), "retrying dead letters needs admin")
+	assert.Equal(t, 200, serve("POST", "/presign/uploads-a.zip?method=PUT", "uploader"))
+	assert.Equal(t, 200, serve("GET", "/presign/a.zip", "uploader"))
+	assert.Equal(t, 403, serve("POST", "/presign/a.zip?method=POST", "uploader"), "presigned uploads need write on the store")
+	assert.Equal(t, 200, serve("POST", "/presign/uploads-x/?method=POST", "uploader"), "a POST prefix is authorized as a whole")
+	assert.Equal(t, 403, serve("POST", "/presign/up/?method=POST", "uploader"), "a POST prefix wider than the grant is denied")
+	assert.Equal(t, 403, serve("POST", "/presign/uploads-a.zip?method=PUT&store=concept", "uploader"))
+	assert.Equal(t, 200, serve("POST", "/presign/uploads-a.zip/complete", "uploader"))
+	assert.Equal(t, 403, serve("POST", "/presign/a.zip/complete", "uploader"))
+	assert.Equal(t, 200, serve("GET", "/presign?key=reports-a.csv&key=reports-b.csv", "downloader"))
+	assert.Equal(t, 403, serve("GET", "/presign?key=reports-a.csv&key=private.csv", "downloader"), "every key of a batch is checked")
+	assert.Equal(t, 200, serve("GET", "/presign/concept/people.json", "downloader"))
+	assert.Equal(t, 403, serve("GET", "/presign/content/123e4567-e89b-12d3-a456-426655440000", "downloader"))
+}
+
+func TestCheckRouteGroup(t *testing.T) {
+	for _, g := range []string{RouteGroupContent, RouteGroupConcept, RouteGroupGeneric, RouteGroupPresign, RouteGroupForeign} {
+		assert.NoError(t, CheckRouteGroup(g))
+	}
+	assert.Error(t, CheckRouteGroup("foriegn"))
+	assert.Error(t, CheckRouteGroup(""))
+}
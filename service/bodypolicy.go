@@ -0,0 +1,106 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sniffLen is the number of bytes http.DetectContentType considers.
+const sniffLen = 512
+
+// BodyPolicy restricts the request bodies a resource accepts.
+type BodyPolicy struct {
+	// MaxBytes is the largest body accepted. Zero means no limit.
+	MaxBytes int64
+	// AllowedContentTypes lists the accepted media types, e.g. "application/json" or "image/*".
+	// An empty list accepts any type.
+	AllowedContentTypes []string
+}
+
+func (p BodyPolicy) allows(ct string) bool {
+	if len(p.AllowedContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range p.AllowedContentTypes {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == mediaType {
+			return true
+		}
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithBodyPolicy enforces p before handing the request to next. Oversized bodies are rejected with 413 and
+// disallowed content types with 415. A request without a Content-Type has it detected from the first bytes of the body.
+func WithBodyPolicy(p BodyPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if p.MaxBytes > 0 {
+			if r.ContentLength > p.MaxBytes {
+				respondWithRequestTooLarge(rw, p.MaxBytes)
+				return
+			}
+			r.Body = http.MaxBytesReader(rw, r.Body, p.MaxBytes)
+		}
+
+		if r.Header.Get("Content-Type") == "" && r.Body != nil {
+			head := make([]byte, sniffLen)
+			n, err := io.ReadFull(r.Body, head)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				respondWithBodyReadError(r.URL.Path, err, rw)
+				return
+			}
+			head = head[:n]
+			r.Header.Set("Content-Type", http.DetectContentType(head))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+		}
+
+		if ct := r.Header.Get("Content-Type"); !p.allows(ct) {
+			log.WithField("contentType", ct).WithField("requestURI", r.URL.RequestURI()).Warn("Rejected unsupported content type")
+			respondWithMessage(rw, http.StatusUnsupportedMediaType, fmt.Sprintf("Content type %s is not allowed.", ct))
+			return
+		}
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+func respondWithRequestTooLarge(rw http.ResponseWriter, limit int64) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusRequestEntityTooLarge)
+	rw.Write([]byte(fmt.Sprintf("{\"message\":\"Request body exceeds the limit of %d bytes.\"}", limit)))
+}
+
+// respondWithBodyReadError answers 413 when the body was cut off by a size limit,
+// 401 when it does not match its signed digest, and 500 otherwise.
+func respondWithBodyReadError(name string, err error, rw http.ResponseWriter) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		log.WithError(err).WithField("UUID", name).Warn("Request body too large")
+		respondWithRequestTooLarge(rw, tooLarge.Limit)
+		return
+	}
+	if errors.Is(err, errBodyDigestMismatch) {
+		log.WithError(err).WithField("UUID", name).Warn("Rejected unauthenticated request body")
+		respondUnauthorized(rw)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	writerStatusInternalServerError(name, err, rw)
+}
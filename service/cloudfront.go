@@ -0,0 +1,183 @@
+package service
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+)
+
+const (
+	PresignBackendS3         = "s3"
+	PresignBackendCloudFront = "cloudfront"
+
+	CloudFrontPolicyCanned = "canned"
+	CloudFrontPolicyCustom = "custom"
+)
+
+// errCloudFrontKey is returned for CloudFront signing of a key outside the prefixes the distribution serves,
+// or of a wildcard key that can't be signed the way it was asked for.
+var errCloudFrontKey = errors.New("invalid key for CloudFront")
+
+// CloudFrontPolicy is how a CloudFront signed URL or cookie is restricted. A canned policy only expires, a custom
+// one may also restrict the source IP range, delay when it starts to be valid and, for cookies, cover every key
+// starting with a prefix.
+type CloudFrontPolicy struct {
+	Custom    bool
+	SourceIP  string
+	NotBefore time.Time
+}
+
+func parseCloudFrontPolicy(q url.Values) (CloudFrontPolicy, error) {
+	var p CloudFrontPolicy
+	switch policy := q.Get("policy"); policy {
+	case "", CloudFrontPolicyCanned:
+	case CloudFrontPolicyCustom:
+		p.Custom = true
+	default:
+		return p, fmt.Errorf("invalid policy %q, expected %q or %q", policy, CloudFrontPolicyCanned, CloudFrontPolicyCustom)
+	}
+	p.SourceIP = q.Get("sourceIp")
+	if p.SourceIP != "" {
+		if _, _, err := net.ParseCIDR(p.SourceIP); err != nil {
+			return p, fmt.Errorf("invalid sourceIp %q, expected a CIDR range", p.SourceIP)
+		}
+	}
+	if v := q.Get("notBefore"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return p, fmt.Errorf("invalid notBefore %q, expected an RFC 3339 time", v)
+		}
+		p.NotBefore = t
+	}
+	if !p.Custom && (p.SourceIP != "" || !p.NotBefore.IsZero()) {
+		return p, errors.New("sourceIp and notBefore need policy=custom")
+	}
+	return p, nil
+}
+
+// CloudFrontSigner signs downloads through a CloudFront distribution in front of our bucket, for the keys under
+// the prefixes it serves.
+type CloudFrontSigner struct {
+	domain       string
+	cookieDomain string
+	keyPairID    string
+	urls         *sign.URLSigner
+	cookies      *sign.CookieSigner
+	prefixes     []string
+}
+
+// NewCloudFrontSigner signs for the distribution at domain. Signed cookies are set for cookieDomain, which has to
+// cover both the distribution, usually through an alternate domain name, and the site asking for them. Browsers
+// don't accept cookies for a domain other than the one answering, so without it they are only handed back in
+// the response body.
+func NewCloudFrontSigner(domain, cookieDomain, keyPairID string, privKey *rsa.PrivateKey, prefixes []string) *CloudFrontSigner {
+	return &CloudFrontSigner{
+		domain:       domain,
+		cookieDomain: cookieDomain,
+		keyPairID:    keyPairID,
+		urls:         sign.NewURLSigner(keyPairID, privKey),
+		cookies: sign.NewCookieSigner(keyPairID, privKey, func(o *sign.CookieOptions) {
+			o.Domain = cookieDomain
+			o.Path = "/"
+			o.Secure = true
+		}),
+		prefixes: prefixes,
+	}
+}
+
+// LoadCloudFrontSigner reads the PEM encoded private key of the key pair keyPairID from privKeyFile.
+func LoadCloudFrontSigner(domain, cookieDomain, keyPairID, privKeyFile string, prefixes []string) (*CloudFrontSigner, error) {
+	switch {
+	case domain == "":
+		return nil, errors.New("no CloudFront distribution domain")
+	case keyPairID == "":
+		return nil, errors.New("no CloudFront key pair id")
+	case len(prefixes) == 0:
+		return nil, errors.New("no key prefixes to serve through CloudFront")
+	}
+	privKey, err := sign.LoadPEMPrivKeyFile(privKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading CloudFront private key %s: %w", privKeyFile, err)
+	}
+	return NewCloudFrontSigner(domain, cookieDomain, keyPairID, privKey, prefixes), nil
+}
+
+// Serves reports whether key, or every key starting with a wildcard key, is under one of the prefixes.
+func (s *CloudFrontSigner) Serves(key string) bool {
+	key = strings.TrimSuffix(key, "*")
+	for _, prefix := range s.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// resource is the distribution URL of key. A key ending in '*' stands for every key starting with the rest of it.
+func (s *CloudFrontSigner) resource(key string) string {
+	wildcard := ""
+	if strings.HasSuffix(key, "*") {
+		key, wildcard = strings.TrimSuffix(key, "*"), "*"
+	}
+	u := url.URL{Scheme: "https", Host: s.domain, Path: "/" + key}
+	return u.String() + wildcard
+}
+
+func (s *CloudFrontSigner) policy(resource string, expires time.Time, p CloudFrontPolicy) *sign.Policy {
+	policy := sign.NewCannedPolicy(resource, expires)
+	if p.SourceIP != "" {
+		policy.Statements[0].Condition.IPAddress = &sign.IPAddress{SourceIP: p.SourceIP}
+	}
+	if !p.NotBefore.IsZero() {
+		policy.Statements[0].Condition.DateGreaterThan = sign.NewAWSEpochTime(p.NotBefore)
+	}
+	return policy
+}
+
+// SignURL signs a download of key through the distribution. The response overrides of opts are passed on as
+// query params, which the distribution has to forward to the bucket.
+func (s *CloudFrontSigner) SignURL(key string, opts PresignOptions) (string, error) {
+	if !s.Serves(key) {
+		return "", fmt.Errorf("%w: %s is not under a prefix served by CloudFront", errCloudFrontKey, key)
+	}
+	if strings.HasSuffix(key, "*") {
+		return "", fmt.Errorf("%w: a signed URL can't be for a wildcard key, ask for signed cookies instead", errCloudFrontKey)
+	}
+	u := s.resource(key)
+	q := url.Values{}
+	if opts.ContentDisposition != "" {
+		q.Set("response-content-disposition", opts.ContentDisposition)
+	}
+	if opts.ContentType != "" {
+		q.Set("response-content-type", opts.ContentType)
+	}
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	expires := time.Now().Add(opts.TTL)
+	if !opts.CloudFront.Custom {
+		return s.urls.Sign(u, expires)
+	}
+	return s.urls.SignWithPolicy(u, s.policy(u, expires, opts.CloudFront))
+}
+
+// SignCookies signs cookies that let a browser download key, or with a custom policy every key starting with
+// a wildcard key, from the distribution.
+func (s *CloudFrontSigner) SignCookies(key string, opts PresignOptions) (string, []*http.Cookie, error) {
+	if !s.Serves(key) {
+		return "", nil, fmt.Errorf("%w: %s is not under a prefix served by CloudFront", errCloudFrontKey, key)
+	}
+	if strings.HasSuffix(key, "*") && !opts.CloudFront.Custom {
+		return "", nil, fmt.Errorf("%w: a wildcard key needs policy=custom", errCloudFrontKey)
+	}
+	resource := s.resource(key)
+	cookies, err := s.cookies.SignWithPolicy(s.policy(resource, time.Now().Add(opts.TTL), opts.CloudFront))
+	return resource, cookies, err
+}
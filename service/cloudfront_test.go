@@ -0,0 +1,125 @@
+package service
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCloudFrontHandler(t *testing.T) (PresignerHandler, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	h := newTestPresignerHandler("http://127.0.0.1:9000")
+	h.cdn = NewCloudFrontSigner("cdn.example.com", "", "KPID", key, []string{"reports-", "concept/"})
+	return h, key
+}
+
+// cloudFrontDecode undoes the URL safe base64 of CloudFront, which replaces '+', '=' and '/' with '-', '_' and '~'.
+func cloudFrontDecode(t *testing.T, s string) []byte {
+	b, err := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(s))
+	assert.NoError(t, err)
+	return b
+}
+
+func assertCloudFrontSignature(t *testing.T, key *rsa.PrivateKey, policy, signature []byte) {
+	h := sha1.Sum(policy)
+	assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, h[:], signature))
+}
+
+func TestHandlePresignCloudFrontURL(t *testing.T) {
+	h, key := newTestCloudFrontHandler(t)
+
+	rec := httptest.NewRecorder()
+	h.HandlePresignURL(rec, newRequest("GET", "/presign/reports-2017.csv?ttl=600&response-content-type=text/csv", ""))
+	assert.Equal(t, 200, rec.Code)
+	var purl presignurl
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &purl))
+	u, err := url.Parse(purl.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "cdn.example.com", u.Host)
+	assert.Equal(t, "/reports-2017.csv", u.Path)
+	assert.Equal(t, "text/csv", u.Query().Get("response-content-type"))
+	assert.Equal(t, "KPID", u.Query().Get("Key-Pair-Id"))
+	assert.NotEmpty(t, u.Query().Get("Expires"), "a canned policy only carries its expiry")
+	assert.Empty(t, u.Query().Get("Policy"))
+
+	rec = httptest.NewRecorder()
+	h.HandlePresignURL(rec, newRequest("GET", "/presign/reports-2017.csv?policy=custom&sourceIp=192.0.2.0/24", ""))
+	assert.Equal(t, 200, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &purl))
+	u, _ = url.Parse(purl.URL)
+	policy := cloudFrontDecode(t, u.Query().Get("Policy"))
+	assert.Contains(t, string(policy), `"Resource":"https://cdn.example.com/reports-2017.csv"`)
+	assert.Contains(t, string(policy), `"AWS:SourceIp":"192.0.2.0/24"`)
+	assertCloudFrontSignature(t, key, policy, cloudFrontDecode(t, u.Query().Get("Signature")))
+
+	rec = httptest.NewRecorder()
+	h.HandlePresignURL(rec, newRequest("GET", "/presign/private.zip", ""))
+	assert.Equal(t, 200, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &purl))
+	assert.True(t, strings.HasPrefix(purl.URL, "http://127.0.0.1:9000/our-bucket/private.zip?"), "keys CloudFront doesn't serve are presigned for S3")
+
+	for _, query := range []string{
+		"/presign/private.zip?policy=custom",
+		"/presign/reports-2017.csv?policy=signed",
+		"/presign/reports-2017.csv?sourceIp=192.0.2.0/24",
+		"/presign/reports-2017.csv?policy=custom&sourceIp=192.0.2.1",
+		"/presign/reports-2017.csv?policy=custom&notBefore=tomorrow",
+		"/presign/reports-*?policy=custom",
+	} {
+		rec = httptest.NewRecorder()
+		h.HandlePresignURL(rec, newRequest("GET", query, ""))
+		assert.Equal(t, 400, rec.Code, query)
+	}
+}
+
+func TestHandlePresignCloudFrontCookies(t *testing.T) {
+	h, key := newTestCloudFrontHandler(t)
+
+	rec := httptest.NewRecorder()
+	h.HandlePresignURL(rec, newRequest("GET", "/presign/reports-*?cookies=true&policy=custom", ""))
+	assert.Equal(t, 200, rec.Code)
+	var signed signedCookies
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &signed))
+	assert.Equal(t, "https://cdn.example.com/reports-*", signed.Resource)
+	assert.Empty(t, rec.Result().Cookies(), "without a cookie domain the cookies are only in the body")
+	assert.Equal(t, "KPID", signed.Cookies["CloudFront-Key-Pair-Id"])
+	policy := cloudFrontDecode(t, signed.Cookies["CloudFront-Policy"])
+	assert.Contains(t, string(policy), `"Resource":"https://cdn.example.com/reports-*"`)
+	assertCloudFrontSignature(t, key, policy, cloudFrontDecode(t, signed.Cookies["CloudFront-Signature"]))
+
+	h.cdn = NewCloudFrontSigner("cdn.example.com", "example.com", "KPID", key, []string{"reports-", "concept/"})
+	rec = httptest.NewRecorder()
+	h.HandlePresignURL(rec, newRequest("GET", "/presign/reports-*?cookies=true&policy=custom", ""))
+	assert.Equal(t, 200, rec.Code)
+	cookies := rec.Result().Cookies()
+	assert.Len(t, cookies, 3)
+	for _, c := range cookies {
+		assert.Equal(t, "example.com", c.Domain)
+		assert.True(t, c.Secure && c.HttpOnly)
+	}
+
+	for _, query := range []string{"/presign/reports-*?cookies=true", "/presign/private.zip?cookies=true"} {
+		rec = httptest.NewRecorder()
+		h.HandlePresignURL(rec, newRequest("GET", query, ""))
+		assert.Equal(t, 400, rec.Code, query)
+	}
+}
+
+func TestHandlePresignWithoutCloudFront(t *testing.T) {
+	h := newTestPresignerHandler("http://127.0.0.1:9000")
+	for _, query := range []string{"/presign/a.zip?policy=custom", "/presign/a.zip?cookies=true"} {
+		rec := httptest.NewRecorder()
+		h.HandlePresignURL(rec, newRequest("GET", query, ""))
+		assert.Equal(t, 400, rec.Code, query)
+	}
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Destination is a named foreign bucket, so that clients don't need to know its region, bucket or role chain.
+type Destination struct {
+	Name      string   `json:"name"`
+	Region    string   `json:"region"`
+	Bucket    string   `json:"bucket"`
+	Roles     []string `json:"roles"`
+	KeyPrefix string   `json:"keyPrefix,omitempty"`
+	UploadOptions
+}
+
+func (d Destination) Target() ForeignTarget {
+	return ForeignTarget{Region: d.Region, Bucket: d.Bucket, Roles: d.Roles, Options: d.UploadOptions}
+}
+
+// requestTarget applies the upload options in the query where the profile leaves them unset.
+func (d Destination) requestTarget(q url.Values) (ForeignTarget, error) {
+	requested, err := ParseUploadOptions(q)
+	if err != nil {
+		return ForeignTarget{}, err
+	}
+	t := d.Target()
+	t.Options = d.UploadOptions.Fill(requested)
+	return t, t.Options.Validate()
+}
+
+// reservedDestinationNames are the fixed routes under /foreign, which /foreign/{destination}/{key} can't reach.
+var reservedDestinationNames = map[string]bool{
+	"list":      true,
+	"presign":   true,
+	"preflight": true,
+	"copy":      true,
+	"jobs":      true,
+	"fanout":    true,
+	"archive":   true,
+	"import":    true,
+}
+
+// Destinations holds the destination profiles by name.
+type Destinations map[string]Destination
+
+// LoadDestinations reads a JSON object mapping destination names to their profiles.
+func LoadDestinations(path string) (Destinations, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	destinations := make(Destinations)
+	if err := json.Unmarshal(b, &destinations); err != nil {
+		return nil, fmt.Errorf("parsing destinations %s: %w", path, err)
+	}
+	for name, d := range destinations {
+		if name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid destination name %q", name)
+		}
+		if reservedDestinationNames[name] {
+			return nil, fmt.Errorf("destination name %q is taken by the /foreign/%s route", name, name)
+		}
+		if d.Bucket == "" || len(d.Roles) == 0 {
+			return nil, fmt.Errorf("destination %s: bucket and at least one role are required", name)
+		}
+		if err := d.UploadOptions.Validate(); err != nil {
+			return nil, fmt.Errorf("destination %s: %w", name, err)
+		}
+		d.Name = name
+		destinations[name] = d
+	}
+	return destinations, nil
+}
+
+// Check makes sure every destination is allowed by the policy, so a misconfigured profile fails at startup.
+func (ds Destinations) Check(p *ForeignPolicy) error {
+	for name, d := range ds {
+		if err := p.Check(d.Roles, d.Bucket, d.KeyPrefix); err != nil {
+			return fmt.Errorf("destination %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (ds Destinations) sorted() []Destination {
+	list := make([]Destination, 0, len(ds))
+	for _, d := range ds {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// DestinationsHandler lists the configured destination profiles.
+func DestinationsHandler(ds Destinations) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		json.NewEncoder(rw).Encode(ds.sorted())
+	}
+}
+
+// HandleDestinationWrite writes the body under the key prefix of a named destination.
+func (h *ForeignerHandler) HandleDestinationWrite(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	d, found := h.destinations[vars["destination"]]
+	if !found {
+		respondDestinationNotFound(rw)
+		return
+	}
+	if vars["key"] == "" {
+		respondWithBadRequest(rw, "A key is required.")
+		return
+	}
+
+	target, err := d.requestTarget(r.URL.Query())
+	if err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return
+	}
+	h.upload(rw, r, target, d.KeyPrefix+vars["key"])
+}
+
+// foreignTargetParams are the destination profiles or the bucket a foreign request is for. The authorizer and the
+// handlers both resolve the target here, so that they can't disagree on it, and a request naming both is refused.
+func foreignTargetParams(q url.Values) (destinations []string, bucket string, err error) {
+	destinations, bucket = q["destination"], q.Get("bucket")
+	if len(destinations) > 0 && bucket != "" {
+		return nil, "", errors.New("query params 'destination' and 'bucket' can't be used together")
+	}
+	return destinations, bucket, nil
+}
+
+// targetRequest resolves the destination named by the 'destination' query param, or else by the usual query params
+// of foreignRequest. For a named destination the keyParam query param is put under its key prefix.
+func (h *ForeignerHandler) targetRequest(rw http.ResponseWriter, r *http.Request, keyParam string) (ForeignTarget, string, bool) {
+	q := r.URL.Query()
+	names, _, err := foreignTargetParams(q)
+	if err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return ForeignTarget{}, "", false
+	}
+	if len(names) == 0 {
+		return h.foreignRequest(rw, r, keyParam)
+	}
+	if len(names) > 1 {
+		respondWithBadRequest(rw, "Only one 'destination' query param is allowed.")
+		return ForeignTarget{}, "", false
+	}
+	d, found := h.destinations[names[0]]
+	if !found {
+		respondDestinationNotFound(rw)
+		return ForeignTarget{}, "", false
+	}
+	if q.Get(keyParam) == "" && keyParam == "key" {
+		respondWithBadRequest(rw, "Query param 'key' is required.")
+		return ForeignTarget{}, "", false
+	}
+	target, err := d.requestTarget(q)
+	if err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return target, "", false
+	}
+	return target, d.KeyPrefix + q.Get(keyParam), true
+}
+
+func respondDestinationNotFound(rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusNotFound)
+	rw.Write([]byte("{\"message\":\"Destination not found\"}"))
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+const testDestinations = `{
+  "partner-archive": {
+    "region": "eu-west-1",
+    "bucket": "partner-bucket",
+    "roles": ["` + exporterRole + `", "` + destinationRole + `"],
+    "keyPrefix": "exports/",
+    "acl": "bucket-owner-full-control",
+    "sse": "aws:kms",
+    "kmsKeyId": "partner-key"
+  }
+}`
+
+func loadTestDestinations(t *testing.T, destinations string) (Destinations, error) {
+	path := filepath.Join(t.TempDir(), "destinations.json")
+	assert.NoError(t, os.WriteFile(path, []byte(destinations), 0600))
+	return LoadDestinations(path)
+}
+
+func TestLoadDestinations(t *testing.T) {
+	ds, err := loadTestDestinations(t, testDestinations)
+	assert.NoError(t, err)
+	d := ds["partner-archive"]
+	assert.Equal(t, "partner-archive", d.Name)
+	assert.Equal(t, ForeignTarget{
+		Region:  "eu-west-1",
+		Bucket:  "partner-bucket",
+		Roles:   []string{exporterRole, destinationRole},
+		Options: UploadOptions{ACL: "bucket-owner-full-control", ServerSideEncryption: "aws:kms", SSEKMSKeyID: "partner-key"},
+	}, d.Target())
+
+	assert.NoError(t, ds.Check(NewForeignPolicy(nil, []string{"partner-bucket"}, []string{"exports/"})))
+	assert.Error(t, ds.Check(NewForeignPolicy(nil, nil, []string{"imports/"})))
+
+	for _, invalid := range []string{
+		`{"no-roles": {"bucket": "partner-bucket"}}`,
+		`{"a/b": {"bucket": "partner-bucket", "roles": ["` + destinationRole + `"]}}`,
+		`{"jobs": {"bucket": "partner-bucket", "roles": ["` + destinationRole + `"]}}`,
+		`{"presign": {"bucket": "partner-bucket", "roles": ["` + destinationRole + `"]}}`,
+		`{"bad-acl": {"bucket": "partner-bucket", "roles": ["` + destinationRole + `"], "acl": "everyone"}}`,
+		`{"kms-without-sse": {"bucket": "partner-bucket", "roles": ["` + destinationRole + `"], "kmsKeyId": "k"}}`,
+	} {
+		_, err = loadTestDestinations(t, invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestDestinationsHandler(t *testing.T) {
+	ds, err := loadTestDestinations(t, testDestinations)
+	assert.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	DestinationsHandler(ds)(rec, newRequest("GET", "/__foreign-destinations", ""))
+	assert.Equal(t, 200, rec.Code)
+	var listed []Destination
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &listed))
+	assert.Equal(t, []Destination{ds["partner-archive"]}, listed)
+}
+
+func TestHandleDestinationWrite(t *testing.T) {
+	fake, srv := newFakeS3(map[string]string{})
+	defer srv.Close()
+	ds, err := loadTestDestinations(t, testDestinations)
+	assert.NoError(t, err)
+
+	fh := NewForeignerHandler(newFakeS3Foreigner(srv.URL), nil, nil, NewForeignPolicy(nil, nil, nil), ds, 60)
+	r := mux.NewRouter()
+	Handlers(r, &handlers.MethodHandler{"PUT": http.HandlerFunc(fh.HandleDestinationWrite)}, "foreign", "/{destination}/{key:.+}")
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("PUT", "/foreign/partner-archive/2017/archive.zip", "PAYLOAD"))
+	assert.Equal(t, 201, rec.Code)
+	assert.Equal(t, "PAYLOAD", fake.objects["partner-bucket/exports/2017/archive.zip"])
+	headers := fake.headers["partner-bucket/exports/2017/archive.zip"]
+	assert.Equal(t, "bucket-owner-full-control", headers.Get("X-Amz-Acl"))
+	assert.Equal(t, "aws:kms", headers.Get("X-Amz-Server-Side-Encryption"))
+	assert.Equal(t, "partner-key", headers.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"))
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("PUT", "/foreign/partner-archive/b.zip?acl=public-read&storageClass=STANDARD_IA&tag=year=2017", "PAYLOAD"))
+	assert.Equal(t, 201, rec.Code)
+	headers = fake.headers["partner-bucket/exports/b.zip"]
+	assert.Equal(t, "bucket-owner-full-control", headers.Get("X-Amz-Acl"), "the profile pins the ACL")
+	assert.Equal(t, "STANDARD_IA", headers.Get("X-Amz-Storage-Class"))
+	assert.Equal(t, "year=2017", headers.Get("X-Amz-Tagging"))
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("PUT", "/foreign/partner-archive/c.zip?storageClass=CHEAP", "PAYLOAD"))
+	assert.Equal(t, 400, rec.Code)
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("PUT", "/foreign/unknown/archive.zip", "PAYLOAD"))
+	assert.Equal(t, 404, rec.Code)
+}
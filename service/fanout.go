@@ -0,0 +1,204 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	transactionid "github.com/Financial-Times/transactionid-utils-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Fan-out modes. FanoutAll refuses keys that already exist at any destination, and a failure at any destination
+// removes what was written to the others. With FanoutBestEffort the successful uploads stay.
+const (
+	FanoutAll        = "all"
+	FanoutBestEffort = "best-effort"
+)
+
+// FanoutResult is the outcome of a fan-out upload at one destination.
+type FanoutResult struct {
+	Destination string `json:"destination"`
+	Bucket      string `json:"bucket"`
+	Key         string `json:"key"`
+	OK          bool   `json:"ok"`
+	RolledBack  bool   `json:"rolledBack,omitempty"`
+	// Existed is set when the key was already there, which stops a fan-out of mode "all" before it uploads anything.
+	Existed bool   `json:"existed,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type fanoutReport struct {
+	Mode    string         `json:"mode"`
+	OK      bool           `json:"ok"`
+	Results []FanoutResult `json:"results"`
+}
+
+type fanoutTarget struct {
+	name   string
+	target ForeignTarget
+	key    string
+}
+
+// HandleForeignerFanout writes the body to every destination named by a repeated 'destination' query param,
+// under the destination's key prefix and 'key'. The uploads run concurrently from one buffered copy of the body.
+// The 'mode' query param is either "all", the default, or "best-effort".
+func (h *ForeignerHandler) HandleForeignerFanout(rw http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	key := q.Get("key")
+	if key == "" {
+		respondWithBadRequest(rw, "The key query param is required.")
+		return
+	}
+	mode := q.Get("mode")
+	switch mode {
+	case "":
+		mode = FanoutAll
+	case FanoutAll, FanoutBestEffort:
+	default:
+		respondWithBadRequest(rw, fmt.Sprintf("Invalid mode %q, expected %q or %q.", mode, FanoutAll, FanoutBestEffort))
+		return
+	}
+	names, _, err := foreignTargetParams(q)
+	if err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return
+	}
+	if len(names) == 0 {
+		respondWithBadRequest(rw, "At least one destination query param is required.")
+		return
+	}
+
+	targets := make([]fanoutTarget, 0, len(names))
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if seen[name] {
+			respondWithBadRequest(rw, fmt.Sprintf("Destination %s is given more than once.", name))
+			return
+		}
+		seen[name] = true
+		d, found := h.destinations[name]
+		if !found {
+			respondDestinationNotFound(rw)
+			return
+		}
+		t, err := d.requestTarget(q)
+		if err != nil {
+			respondWithBadRequest(rw, err.Error())
+			return
+		}
+		targets = append(targets, fanoutTarget{name, t, d.KeyPrefix + key})
+	}
+
+	ct := r.Header.Get("Content-Type")
+	bs, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithBodyReadError(key, err, rw)
+		return
+	}
+	tid := transactionid.GetTransactionIDFromRequest(r)
+	ctx := transactionid.TransactionAwareContext(r.Context(), tid)
+
+	report := h.fanout(ctx, targets, &bs, ct, tid, mode)
+	status := http.StatusCreated
+	if !report.OK {
+		status = http.StatusServiceUnavailable
+		for _, res := range report.Results {
+			if res.Existed {
+				status = http.StatusConflict
+				break
+			}
+			if res.OK {
+				// Some uploads were kept, by best-effort or by a rollback that failed.
+				status = http.StatusMultiStatus
+				break
+			}
+		}
+	}
+	respondJSON(rw, status, report)
+}
+
+func (h *ForeignerHandler) fanout(ctx context.Context, targets []fanoutTarget, b *[]byte, ct, tid, mode string) fanoutReport {
+	report := fanoutReport{Mode: mode, OK: true, Results: make([]FanoutResult, len(targets))}
+	for i, ft := range targets {
+		report.Results[i] = FanoutResult{Destination: ft.name, Bucket: ft.target.Bucket, Key: ft.key}
+	}
+	if mode == FanoutAll && !h.checkFanoutKeys(ctx, targets, report.Results) {
+		report.OK = false
+		return report
+	}
+
+	eachFanoutTarget(targets, report.Results, func(res *FanoutResult, ft fanoutTarget) {
+		if err := h.foreigner.UploadToBucket(ctx, ft.target, ft.key, b, ct, tid); err != nil {
+			log.WithError(err).WithFields(log.Fields{"destination": ft.name, "bucketName": ft.target.Bucket}).Error("Fan-out upload failed")
+			res.Error = err.Error()
+			return
+		}
+		res.OK = true
+	})
+	for _, res := range report.Results {
+		report.OK = report.OK && res.OK
+	}
+	if report.OK || mode != FanoutAll {
+		return report
+	}
+	h.rollback(ctx, targets, report.Results)
+	return report
+}
+
+// checkFanoutKeys reports whether none of the keys is there yet, so that a rollback can't lose an object that
+// was. Nothing is uploaded otherwise.
+func (h *ForeignerHandler) checkFanoutKeys(ctx context.Context, targets []fanoutTarget, results []FanoutResult) bool {
+	eachFanoutTarget(targets, results, func(res *FanoutResult, ft fanoutTarget) {
+		existed, err := h.foreigner.ExistsInBucket(ctx, ft.target, ft.key)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{"destination": ft.name, "bucketName": ft.target.Bucket}).Error("Fan-out upload failed to check for an existing object")
+			res.Error = err.Error()
+			return
+		}
+		if existed {
+			res.Existed = true
+			res.Error = "The key already exists."
+		}
+	})
+	for _, res := range results {
+		if res.Error != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// rollback deletes what the failed fan-out wrote. It outlives the request, so a client giving up doesn't leave
+// partial uploads behind.
+func (h *ForeignerHandler) rollback(ctx context.Context, targets []fanoutTarget, results []FanoutResult) {
+	ctx, cancel := withTimeout(context.WithoutCancel(ctx), h.foreigner.timeouts.Delete)
+	defer cancel()
+	eachFanoutTarget(targets, results, func(res *FanoutResult, ft fanoutTarget) {
+		if !res.OK {
+			return
+		}
+		if err := h.foreigner.DeleteFromBucket(ctx, ft.target, ft.key); err != nil {
+			log.WithError(err).WithFields(log.Fields{"destination": ft.name, "bucketName": ft.target.Bucket}).Error("Failed to roll back fan-out upload")
+			res.Error = "rollback failed: " + err.Error()
+			return
+		}
+		res.OK = false
+		res.RolledBack = true
+	})
+}
+
+// eachFanoutTarget runs fn concurrently for every target and its result, and waits for all of them.
+func eachFanoutTarget(targets []fanoutTarget, results []FanoutResult, fn func(res *FanoutResult, ft fanoutTarget)) {
+	var wg sync.WaitGroup
+	for i, ft := range targets {
+		wg.Add(1)
+		go func(res *FanoutResult, ft fanoutTarget) {
+			defer wg.Done()
+			fn(res, ft)
+		}(&results[i], ft)
+	}
+	wg.Wait()
+}
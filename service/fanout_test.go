@@ -0,0 +1,113 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+const partnerBRole = "arn:aws:iam::000000000000:role/partner-b-role"
+
+const testFanoutDestinations = `{
+  "partner-a": {"region": "eu-west-1", "bucket": "partner-a-bucket", "roles": ["` + destinationRole + `"], "keyPrefix": "exports/"},
+  "partner-b": {"region": "eu-west-1", "bucket": "partner-b-bucket", "roles": ["` + partnerBRole + `"]}
+}`
+
+func TestHandleForeignerFanout(t *testing.T) {
+	fake, srv := newFakeS3(map[string]string{})
+	defer srv.Close()
+	ds, err := loadTestDestinations(t, testFanoutDestinations)
+	assert.NoError(t, err)
+	f := newFakeS3Foreigner(srv.URL)
+	sts := &fakeSTS{calls: map[string]int{}, expires: time.Now().Add(time.Hour)}
+	f.newSTSClient = func(cfg aws.Config) stsAPI {
+		return &fakeSTSClient{sts, cfg}
+	}
+	h := NewForeignerHandler(f, nil, nil, NewForeignPolicy(nil, nil, nil), ds, 60)
+
+	fanout := func(query string) (int, fanoutReport) {
+		rec := httptest.NewRecorder()
+		h.HandleForeignerFanout(rec, newRequest("PUT", "/foreign/fanout?destination=partner-a&destination=partner-b"+query, "PAYLOAD"))
+		var report fanoutReport
+		json.Unmarshal(rec.Body.Bytes(), &report)
+		return rec.Code, report
+	}
+
+	code, report := fanout("&key=a.zip")
+	assert.Equal(t, 201, code)
+	assert.True(t, report.OK)
+	assert.Equal(t, FanoutAll, report.Mode)
+	assert.Equal(t, []FanoutResult{
+		{Destination: "partner-a", Bucket: "partner-a-bucket", Key: "exports/a.zip", OK: true},
+		{Destination: "partner-b", Bucket: "partner-b-bucket", Key: "a.zip", OK: true},
+	}, report.Results)
+	assert.Equal(t, "PAYLOAD", fake.objects["partner-a-bucket/exports/a.zip"])
+	assert.Equal(t, "PAYLOAD", fake.objects["partner-b-bucket/a.zip"])
+
+	sts.failRole = partnerBRole
+	f.clients = map[string]*foreignClient{}
+	code, report = fanout("&key=b.zip")
+	assert.Equal(t, 503, code)
+	assert.False(t, report.OK)
+	assert.False(t, report.Results[0].OK)
+	assert.False(t, report.Results[0].RolledBack)
+	assert.Contains(t, report.Results[1].Error, "AccessDenied")
+	assert.NotContains(t, fake.objects, "partner-a-bucket/exports/b.zip", "nothing is uploaded when a key can't be checked")
+
+	sts.failRole = ""
+	f.clients = map[string]*foreignClient{}
+	fake.mu.Lock()
+	fake.denyPut = "partner-b-bucket"
+	fake.mu.Unlock()
+	code, report = fanout("&key=f.zip")
+	assert.Equal(t, 503, code)
+	assert.True(t, report.Results[0].RolledBack)
+	assert.False(t, report.Results[0].OK)
+	assert.Contains(t, report.Results[1].Error, "AccessDenied")
+	assert.NotContains(t, fake.objects, "partner-a-bucket/exports/f.zip", "the successful upload is rolled back")
+
+	fake.mu.Lock()
+	fake.denyPut = ""
+	fake.mu.Unlock()
+	fake.mu.Lock()
+	fake.objects["partner-a-bucket/exports/e.zip"] = "PREVIOUS"
+	fake.mu.Unlock()
+	code, report = fanout("&key=e.zip")
+	assert.Equal(t, 409, code)
+	assert.True(t, report.Results[0].Existed)
+	assert.False(t, report.Results[0].OK)
+	assert.False(t, report.Results[1].Existed)
+	assert.False(t, report.Results[1].OK)
+	assert.Equal(t, "PREVIOUS", fake.objects["partner-a-bucket/exports/e.zip"], "an existing key is not overwritten")
+	assert.NotContains(t, fake.objects, "partner-b-bucket/e.zip", "nothing is uploaded when a key exists")
+
+	code, _ = fanout("&key=e.zip&mode=best-effort")
+	assert.Equal(t, 201, code)
+	assert.Equal(t, "PAYLOAD", fake.objects["partner-a-bucket/exports/e.zip"], "best-effort overwrites")
+
+	fake.mu.Lock()
+	fake.denyPut = "partner-b-bucket"
+	fake.mu.Unlock()
+	code, report = fanout("&key=c.zip&mode=best-effort")
+	assert.Equal(t, 207, code)
+	assert.True(t, report.Results[0].OK)
+	assert.False(t, report.Results[0].RolledBack)
+	assert.False(t, report.Results[1].OK)
+	assert.Equal(t, "PAYLOAD", fake.objects["partner-a-bucket/exports/c.zip"])
+
+	for query, expected := range map[string]int{
+		"":                                   400,
+		"&key=d.zip&mode=some":               400,
+		"&key=d.zip&acl=everyone":            400,
+		"&key=d.zip&destination=partner-a":   400,
+		"&key=d.zip&destination=unknown":     404,
+		"&key=d.zip&bucket=partner-a-bucket": 400,
+	} {
+		code, _ = fanout(query)
+		assert.Equal(t, expected, code, query)
+	}
+}
@@ -2,116 +2,409 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	transactionid "github.com/Financial-Times/transactionid-utils-go"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/rcrowley/go-metrics"
 	log "github.com/sirupsen/logrus"
 )
 
+var errNoRoles = errors.New("at least one role must be provided")
+
+// ForeignTarget is a bucket we reach by assuming a chain of roles, each hop assumed with the credentials of the previous one.
+type ForeignTarget struct {
+	Region  string        `json:"region"`
+	Bucket  string        `json:"bucket"`
+	Roles   []string      `json:"roles"`
+	Options UploadOptions `json:"options"`
+}
+
+// cacheKey identifies the credentials of a target. Credentials scoped down to a bucket are only shared by that bucket.
+func (t ForeignTarget) cacheKey(scoped bool) string {
+	key := t.Region + "|" + strings.Join(t.Roles, roleChainSeparator)
+	if scoped {
+		key += "|" + t.Bucket
+	}
+	return key
+}
+
+type foreignClient struct {
+	client      *s3.Client
+	credentials aws.CredentialsProvider
+}
+
+// Foreigner talks to buckets owned by other accounts. The credentials of every role chain are cached and refreshed
+// ahead of expiry, and the S3 client built for a chain is shared by all requests that use it.
 type Foreigner struct {
-	httpClient *http.Client
-	roles      []string
-	bucketName string
-	awsRegion  string
-	s3c        *S3Client2
+	httpClient   *http.Client
+	timeouts     OperationTimeouts
+	expiryWindow time.Duration
+	roleOptions  map[string]RoleOptions
+	sessionName  string
+
+	loadConfig   func(ctx context.Context, region string) (aws.Config, error)
+	newSTSClient func(cfg aws.Config) stsAPI
+
+	mu      sync.Mutex
+	clients map[string]*foreignClient
+
+	cacheHits   metrics.Counter
+	cacheMisses metrics.Counter
+	stsLatency  metrics.Timer
 }
 
-func NewForeigner(httpClient *http.Client, roles []string, bucketName, awsRegion string) *Foreigner {
-	return &Foreigner{
-		httpClient: httpClient,
-		roles:      roles,
-		bucketName: bucketName,
-		awsRegion:  awsRegion,
+// NewForeigner refreshes cached credentials once they are within expiryWindow of expiring.
+// roleOptions holds the AssumeRole options of the roles that need any, keyed by role ARN. Every role session is
+// named sessionName, usually the system code.
+func NewForeigner(httpClient *http.Client, timeouts OperationTimeouts, expiryWindow time.Duration, roleOptions map[string]RoleOptions, sessionName string, registry metrics.Registry) *Foreigner {
+	f := &Foreigner{
+		httpClient:   httpClient,
+		timeouts:     timeouts,
+		expiryWindow: expiryWindow,
+		roleOptions:  roleOptions,
+		sessionName:  roleSessionName(sessionName),
+		clients:      make(map[string]*foreignClient),
+		cacheHits:    metrics.GetOrRegisterCounter("foreign.credentials.cache.hit", registry),
+		cacheMisses:  metrics.GetOrRegisterCounter("foreign.credentials.cache.miss", registry),
+		stsLatency:   metrics.GetOrRegisterTimer("foreign.sts.assumerole", registry),
+	}
+	f.loadConfig = func(ctx context.Context, region string) (aws.Config, error) {
+		return config.LoadDefaultConfig(ctx, config.WithHTTPClient(f.httpClient), config.WithRegion(region))
 	}
+	f.newSTSClient = func(cfg aws.Config) stsAPI {
+		return sts.NewFromConfig(cfg)
+	}
+	return f
 }
 
-func (f *Foreigner) UploadToBucket(key string, b *[]byte, ct string, tid string) error {
-	if err := f.loadS3Client(); err != nil {
+func (f *Foreigner) UploadToBucket(ctx context.Context, t ForeignTarget, key string, b *[]byte, ct string, tid string) error {
+	s3c, err := f.client(ctx, t)
+	if err != nil {
 		return err
 	}
-	return f.s3c.Write(key, b, ct, tid)
+	return s3c.Write(ctx, key, b, ct, tid)
 }
 
-func (f *Foreigner) loadS3Client() error {
-	cfg, err := f.loadMultipleRolesAwsConfiguration()
+func (f *Foreigner) DeleteFromBucket(ctx context.Context, t ForeignTarget, key string) error {
+	s3c, err := f.client(ctx, t)
 	if err != nil {
 		return err
 	}
-	aws3s := s3.NewFromConfig(*cfg)
-	f.s3c = NewS3Client2(aws3s, f.bucketName)
-	return nil
+	return s3c.Delete(ctx, key)
 }
 
-// Assume every next role
-func (f *Foreigner) loadMultipleRolesAwsConfiguration() (*aws.Config, error) {
-	var cfg *aws.Config
-	for _, role := range f.roles {
-		var err error
-		cfg, err = f.loadAwsConfiguration(cfg, role)
+// ExistsInBucket reports whether key is already in the target bucket.
+func (f *Foreigner) ExistsInBucket(ctx context.Context, t ForeignTarget, key string) (bool, error) {
+	s3c, err := f.client(ctx, t)
+	if err != nil {
+		return false, err
+	}
+	found, _, err := s3c.Head(ctx, key)
+	return found, err
+}
+
+// client returns an S3 client for the target bucket, assuming the role chain only when no valid credentials are cached.
+func (f *Foreigner) client(ctx context.Context, t ForeignTarget) (*S3Client2, error) {
+	if len(t.Roles) == 0 {
+		return nil, errNoRoles
+	}
+	ctx, cancel := withTimeout(ctx, f.timeouts.AssumeRole)
+	defer cancel()
+
+	key := t.cacheKey(f.roleOptions[t.Roles[len(t.Roles)-1]].ScopeToBucket)
+	f.mu.Lock()
+	c, ok := f.clients[key]
+	f.mu.Unlock()
+
+	if ok {
+		f.cacheHits.Inc(1)
+	} else {
+		f.cacheMisses.Inc(1)
+		cfg, err := f.loadConfig(ctx, t.Region)
 		if err != nil {
 			return nil, err
 		}
+		if c, err = f.newClient(cfg, t, f.cacheCredentials); err != nil {
+			return nil, err
+		}
+	}
+
+	// Cheap while the cached credentials are fresh, and refreshes the whole chain once they are about to expire.
+	if _, err := c.credentials.Retrieve(ctx); err != nil {
+		f.mu.Lock()
+		if f.clients[key] == c {
+			delete(f.clients, key)
+		}
+		f.mu.Unlock()
+		return nil, err
 	}
-	return cfg, nil
+
+	if !ok {
+		f.mu.Lock()
+		f.clients[key] = c
+		f.mu.Unlock()
+	}
+	return NewS3Client2(c.client, t.Bucket, f.timeouts).WithUploadOptions(t.Options), nil
 }
 
-// Load AWS Configuration
-// Use provided cfg if needed or create new
-func (f *Foreigner) loadAwsConfiguration(cfg *aws.Config, role string) (*aws.Config, error) {
-	if cfg == nil {
-		_cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithHTTPClient(f.httpClient), config.WithRegion(f.awsRegion))
-		cfg = &_cfg
+// newClient assumes every next role with the credentials of the previous one. hop is given the provider assuming
+// each role in turn and returns the credentials the next hop, or the client, is made with. An error from it stops
+// the chain.
+func (f *Foreigner) newClient(cfg aws.Config, t ForeignTarget, hop func(role string, assume aws.CredentialsProvider) (aws.CredentialsProvider, error)) (*foreignClient, error) {
+	for i, role := range t.Roles {
+		assume := &assumeRoleProvider{client: f.newSTSClient(cfg.Copy()), role: role, sessionName: f.sessionName, options: f.roleOptions[role]}
+		if assume.options.ScopeToBucket && i == len(t.Roles)-1 {
+			assume.policy = bucketSessionPolicy(t.Bucket)
+		}
+		creds, err := hop(role, &timedCredentialsProvider{assume, f.stsLatency})
 		if err != nil {
 			return nil, err
 		}
+		cfg.Credentials = creds
 	}
-	stsSvc := sts.NewFromConfig(*cfg)
-	provider := stscreds.NewAssumeRoleProvider(stsSvc, role)
-	cfg.Credentials = aws.NewCredentialsCache(provider)
-	return cfg, nil
+	return &foreignClient{client: s3.NewFromConfig(cfg), credentials: cfg.Credentials}, nil
+}
+
+// cacheCredentials is the hop of the cached clients, which assume a role again only once its credentials are
+// about to expire.
+func (f *Foreigner) cacheCredentials(role string, assume aws.CredentialsProvider) (aws.CredentialsProvider, error) {
+	return aws.NewCredentialsCache(assume, func(o *aws.CredentialsCacheOptions) {
+		o.ExpiryWindow = f.expiryWindow
+	}), nil
+}
+
+// timedCredentialsProvider records how long each STS call takes.
+type timedCredentialsProvider struct {
+	aws.CredentialsProvider
+	timer metrics.Timer
+}
+
+func (p *timedCredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	defer p.timer.UpdateSince(time.Now())
+	return p.CredentialsProvider.Retrieve(ctx)
 }
 
 type ForeignerHandler struct {
-	httpClient *http.Client
+	foreigner    *Foreigner
+	copier       *ForeignCopier
+	queue        *ForeignQueue
+	policy       *ForeignPolicy
+	destinations Destinations
+	presignTTL   time.Duration
+}
+
+func NewForeignerHandler(foreigner *Foreigner, copier *ForeignCopier, queue *ForeignQueue, policy *ForeignPolicy, destinations Destinations, presignTTL int) ForeignerHandler {
+	return ForeignerHandler{foreigner, copier, queue, policy, destinations, time.Duration(presignTTL) * time.Second}
+}
+
+// foreignContext carries the transaction id, which is logged with the role sessions assumed for the request.
+func foreignContext(r *http.Request) context.Context {
+	return transactionid.TransactionAwareContext(r.Context(), transactionid.GetTransactionIDFromRequest(r))
 }
 
-func NewForeignerHandler(httpClient *http.Client) ForeignerHandler {
-	return ForeignerHandler{httpClient}
+// foreignRequest reads the destination and its upload options from the query string and checks it against the policy before any STS call,
+// so that the service can't be used to assume arbitrary roles. keyParam names the query param holding the key,
+// "key" for single objects and "prefix" for listings. It responds itself and returns false when the request is refused.
+func (h *ForeignerHandler) foreignRequest(rw http.ResponseWriter, r *http.Request, keyParam string) (ForeignTarget, string, bool) {
+	_, bucket, err := foreignTargetParams(r.URL.Query())
+	if err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return ForeignTarget{}, "", false
+	}
+	target := ForeignTarget{
+		Region: r.URL.Query().Get("region"),
+		Roles:  r.URL.Query()["role"],
+		Bucket: bucket,
+	}
+	key := r.URL.Query().Get(keyParam)
+
+	if len(target.Roles) == 0 || target.Bucket == "" || (key == "" && keyParam == "key") {
+		respondWithBadRequest(rw, fmt.Sprintf("Query params 'bucket', '%s' and at least one 'role' are required.", keyParam))
+		return target, key, false
+	}
+	if err := h.policy.Check(target.Roles, target.Bucket, key); err != nil {
+		foreignerForbidden(target.Bucket, err, rw)
+		return target, key, false
+	}
+	options, err := ParseUploadOptions(r.URL.Query())
+	if err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return target, key, false
+	}
+	target.Options = options
+	return target, key, true
 }
 
 func (h *ForeignerHandler) HandleForeignerBucketWrite(rw http.ResponseWriter, r *http.Request) {
 	// params: region, role, region, bucketName, key
-	region := r.URL.Query().Get("region")
-	roles := r.URL.Query()["role"]
-	bucket := r.URL.Query().Get("bucket")
-	key := r.URL.Query().Get("key")
-
-	// New Foreigner
-	foreigner := NewForeigner(h.httpClient, roles, bucket, region)
+	target, key, ok := h.foreignRequest(rw, r, "key")
+	if !ok {
+		return
+	}
+	h.upload(rw, r, target, key)
+}
 
+func (h *ForeignerHandler) upload(rw http.ResponseWriter, r *http.Request, target ForeignTarget, key string) {
 	ct := r.Header.Get("Content-Type")
 	bs, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		foreignerServiceUnavailable(bucket, err, rw)
+		respondWithBodyReadError(target.Bucket, err, rw)
 		return
 	}
 	tid := transactionid.GetTransactionIDFromRequest(r)
 
-	if err = foreigner.UploadToBucket(key, &bs, ct, tid); err != nil {
-		foreignerServiceUnavailable(bucket, err, rw)
+	ctx := transactionid.TransactionAwareContext(r.Context(), tid)
+	if r.URL.Query().Get("async") == "true" {
+		if h.queue == nil {
+			respondWithBadRequest(rw, "Asynchronous uploads are not enabled.")
+			return
+		}
+		h.enqueue(ctx, rw, target, key, &bs, ct, tid)
+		return
+	}
+	if err = h.foreigner.UploadToBucket(ctx, target, key, &bs, ct, tid); err != nil {
+		foreignerServiceUnavailable(target.Bucket, err, rw)
 		return
 	}
 	rw.WriteHeader(http.StatusCreated)
 }
 
+func (h *ForeignerHandler) HandleForeignerBucketGet(rw http.ResponseWriter, r *http.Request) {
+	target, key, ok := h.foreignRequest(rw, r, "key")
+	if !ok {
+		return
+	}
+	s3c, err := h.foreigner.client(foreignContext(r), target)
+	if err != nil {
+		foreignerServiceUnavailable(target.Bucket, err, rw)
+		return
+	}
+	f, i, ct, err := s3c.Get(r.Context(), key)
+	if err != nil {
+		foreignerServiceUnavailable(target.Bucket, err, rw)
+		return
+	}
+	handleGet(f, rw, i, ct)
+}
+
+func (h *ForeignerHandler) HandleForeignerBucketHead(rw http.ResponseWriter, r *http.Request) {
+	target, key, ok := h.foreignRequest(rw, r, "key")
+	if !ok {
+		return
+	}
+	s3c, err := h.foreigner.client(foreignContext(r), target)
+	if err != nil {
+		foreignerServiceUnavailable(target.Bucket, err, rw)
+		return
+	}
+	f, info, err := s3c.Head(r.Context(), key)
+	if err != nil {
+		foreignerServiceUnavailable(target.Bucket, err, rw)
+		return
+	}
+	if !f {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if info.ContentType != "" {
+		rw.Header().Set("Content-Type", info.ContentType)
+	}
+	if info.ETag != "" {
+		rw.Header().Set("ETag", info.ETag)
+	}
+	if !info.LastModified.IsZero() {
+		rw.Header().Set("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+	}
+	rw.Header().Set("Content-Length", strconv.FormatInt(info.ContentLength, 10))
+	rw.WriteHeader(http.StatusOK)
+}
+
+func (h *ForeignerHandler) HandleForeignerBucketDelete(rw http.ResponseWriter, r *http.Request) {
+	target, key, ok := h.foreignRequest(rw, r, "key")
+	if !ok {
+		return
+	}
+	s3c, err := h.foreigner.client(foreignContext(r), target)
+	if err == nil {
+		err = s3c.Delete(r.Context(), key)
+	}
+	if err != nil {
+		foreignerServiceUnavailable(target.Bucket, err, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+type foreignListing struct {
+	Keys []string `json:"keys"`
+}
+
+// HandleForeignerBucketList lists the keys under the optional 'prefix' query param.
+func (h *ForeignerHandler) HandleForeignerBucketList(rw http.ResponseWriter, r *http.Request) {
+	target, prefix, ok := h.foreignRequest(rw, r, "prefix")
+	if !ok {
+		return
+	}
+	s3c, err := h.foreigner.client(foreignContext(r), target)
+	if err != nil {
+		foreignerServiceUnavailable(target.Bucket, err, rw)
+		return
+	}
+	listing := foreignListing{Keys: []string{}}
+	err = s3c.EachObject(r.Context(), prefix, func(key string) (bool, error) {
+		listing.Keys = append(listing.Keys, key)
+		return true, nil
+	})
+	if err != nil {
+		foreignerServiceUnavailable(target.Bucket, err, rw)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(listing)
+}
+
+func (h *ForeignerHandler) HandleForeignerPresignURL(rw http.ResponseWriter, r *http.Request) {
+	target, key, ok := h.foreignRequest(rw, r, "key")
+	if !ok {
+		return
+	}
+	s3c, err := h.foreigner.client(foreignContext(r), target)
+	if err != nil {
+		foreignerServiceUnavailable(target.Bucket, err, rw)
+		return
+	}
+	purl, err := s3c.Presign(r.Context(), key, h.presignTTL)
+	if err != nil {
+		foreignerServiceUnavailable(target.Bucket, err, rw)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(presignurl{URL: purl})
+}
+
+func foreignerForbidden(bucketName string, err error, rw http.ResponseWriter) {
+	log.WithError(err).WithField("bucketName", bucketName).Warn("Rejected foreign destination")
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusForbidden)
+	rw.Write([]byte("{\"message\":\"Foreign destination not allowed\"}"))
+}
+
 func foreignerServiceUnavailable(bucketName string, err error, rw http.ResponseWriter) {
-	log.WithError(err).WithField("bucketName", bucketName).Error("Error writing object")
+	log.WithError(err).WithField("bucketName", bucketName).Error("Error from foreign bucket")
 	rw.Header().Set("Content-Type", "application/json")
 	respondServiceUnavailable(err, rw)
 }
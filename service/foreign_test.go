@@ -0,0 +1,436 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	transactionid "github.com/Financial-Times/transactionid-utils-go"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
+	"github.com/aws/smithy-go"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	exporterRole    = "arn:aws:iam::070529446553:role/cm-foreign-archive-exporter-role"
+	destinationRole = "arn:aws:iam::469211898354:role/destination-foreign-exporter-role"
+)
+
+func TestForeignPolicyCheck(t *testing.T) {
+	p := NewForeignPolicy([]string{exporterRole + " > " + destinationRole}, []string{"partner-bucket"}, []string{"exports/"})
+	assert.Empty(t, p.Unrestricted())
+
+	assert.NoError(t, p.Check([]string{exporterRole, destinationRole}, "partner-bucket", "exports/a.zip"))
+	assert.Error(t, p.Check([]string{destinationRole}, "partner-bucket", "exports/a.zip"))
+	assert.Error(t, p.Check([]string{destinationRole, exporterRole}, "partner-bucket", "exports/a.zip"))
+	assert.Error(t, p.Check([]string{exporterRole, destinationRole}, "other-bucket", "exports/a.zip"))
+	assert.Error(t, p.Check([]string{exporterRole, destinationRole}, "partner-bucket", "a.zip"))
+
+	open := NewForeignPolicy(nil, nil, nil)
+	assert.Equal(t, []string{"role chains", "buckets", "key prefixes"}, open.Unrestricted())
+	assert.NoError(t, open.Check([]string{"arn:any"}, "any", "any"))
+}
+
+func TestForeignerHandlerRejectsBeforeAssumingRoles(t *testing.T) {
+	p := NewForeignPolicy([]string{exporterRole}, []string{"partner-bucket"}, nil)
+	h := NewForeignerHandler(NewForeigner(http.DefaultClient, OperationTimeouts{}, time.Minute, nil, "upp-exports-rw-s3", metrics.NewRegistry()), nil, nil, p, nil, 60)
+
+	rec := httptest.NewRecorder()
+	h.HandleForeignerBucketWrite(rec, newRequest("PUT", "/foreign/?region=eu-west-1&bucket=partner-bucket&key=a.zip&role="+destinationRole, "PAYLOAD"))
+	assert.Equal(t, 403, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.HandleForeignerBucketWrite(rec, newRequest("PUT", "/foreign/?region=eu-west-1&bucket=other&key=a.zip&role="+exporterRole, "PAYLOAD"))
+	assert.Equal(t, 403, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.HandleForeignerBucketWrite(rec, newRequest("PUT", "/foreign/?region=eu-west-1&bucket=partner-bucket&key=a.zip", "PAYLOAD"))
+	assert.Equal(t, 400, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.HandleForeignerBucketWrite(rec, newRequest("PUT", "/foreign/?region=eu-west-1&bucket=partner-bucket&key=a.zip&acl=everyone&role="+exporterRole, "PAYLOAD"))
+	assert.Equal(t, 400, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.HandleForeignerBucketDelete(rec, newRequest("DELETE", "/foreign/?region=eu-west-1&bucket=other&key=a.zip&role="+exporterRole, ""))
+	assert.Equal(t, 403, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.HandleForeignerBucketList(rec, newRequest("GET", "/foreign/list?region=eu-west-1&bucket=other&role="+exporterRole, ""))
+	assert.Equal(t, 403, rec.Code)
+}
+
+// fakeS3 serves just enough of the S3 API, path style, for the foreign operations. Objects are keyed by bucket/key.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string]string
+	parts    map[string][]string
+	denyCopy bool
+	// denyPut is a bucket that plain PUTs of objects are denied in.
+	denyPut     string
+	copies      int
+	partUploads int
+	headers     map[string]http.Header
+	// etags overrides the ETag served for an object, which is otherwise not a checksum.
+	etags map[string]string
+}
+
+func (f *fakeS3) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	q := r.URL.Query()
+	rw.Header().Set("Content-Type", "application/xml")
+
+	switch {
+	case q.Get("list-type") == "2":
+		fmt.Fprintf(rw, `<ListBucketResult><Name>%s</Name><IsTruncated>false</IsTruncated>`, path)
+		// Like S3, list in key order.
+		var keys []string
+		for key := range f.objects {
+			if strings.HasPrefix(key, path+"/"+q.Get("prefix")) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(rw, `<Contents><Key>%s</Key></Contents>`, strings.TrimPrefix(key, path+"/"))
+		}
+		fmt.Fprint(rw, `</ListBucketResult>`)
+	case r.Method == "HEAD" && !strings.Contains(path, "/"):
+		// HeadBucket: every bucket exists.
+	case r.Method == "POST" && q.Has("uploads"):
+		f.parts[path] = nil
+		fmt.Fprint(rw, `<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == "PUT" && q.Has("partNumber"):
+		b, _ := io.ReadAll(r.Body)
+		f.parts[path] = append(f.parts[path], string(b))
+		f.partUploads++
+		rw.Header().Set("ETag", `"part-`+q.Get("partNumber")+`"`)
+	case r.Method == "POST" && q.Has("uploadId"):
+		f.objects[path] = strings.Join(f.parts[path], "")
+		fmt.Fprint(rw, `<CompleteMultipartUploadResult><ETag>"etag"</ETag></CompleteMultipartUploadResult>`)
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		if f.denyCopy {
+			rw.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(rw, `<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+			return
+		}
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		f.objects[path] = f.objects[source]
+		f.headers[path] = r.Header
+		f.copies++
+		fmt.Fprint(rw, `<CopyObjectResult><ETag>"etag"</ETag></CopyObjectResult>`)
+	case r.Method == "PUT" && f.denyPut != "" && strings.HasPrefix(path, f.denyPut+"/"):
+		rw.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(rw, `<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+	case r.Method == "PUT":
+		b, _ := io.ReadAll(r.Body)
+		f.objects[path] = string(b)
+		f.headers[path] = r.Header
+	default:
+		body, found := f.objects[path]
+		switch {
+		case !found:
+			rw.WriteHeader(http.StatusNotFound)
+			if r.Method != "HEAD" {
+				fmt.Fprint(rw, `<Error><Code>NoSuchKey</Code></Error>`)
+			}
+		case r.Method == "DELETE":
+			delete(f.objects, path)
+			rw.WriteHeader(http.StatusNoContent)
+		default:
+			rw.Header().Set("Content-Type", "application/zip")
+			rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			rw.Header().Set("ETag", `"etag"`)
+			if etag, ok := f.etags[path]; ok {
+				rw.Header().Set("ETag", etag)
+			}
+			if r.Method != "HEAD" {
+				fmt.Fprint(rw, body)
+			}
+		}
+	}
+}
+
+func newFakeS3(objects map[string]string) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{objects: objects, parts: map[string][]string{}, headers: map[string]http.Header{}, etags: map[string]string{}}
+	return f, httptest.NewServer(f)
+}
+
+// newFakeS3Foreigner assumes roles with fake credentials and talks to the fake S3 at endpoint.
+func newFakeS3Foreigner(endpoint string) *Foreigner {
+	f := newTestForeigner(&fakeSTS{calls: map[string]int{}, expires: time.Now().Add(time.Hour)}, metrics.NewRegistry())
+	f.loadConfig = func(ctx context.Context, region string) (aws.Config, error) {
+		return aws.Config{Region: region, BaseEndpoint: aws.String(endpoint)}, nil
+	}
+	return f
+}
+
+// newOurBucket is a client of our own bucket, "our-bucket", on the fake S3 the foreigner talks to.
+func newOurBucket(f *Foreigner) *S3Client2 {
+	cfg, _ := f.loadConfig(context.Background(), "eu-west-1")
+	cfg.Credentials = aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		return aws.Credentials{AccessKeyID: "ours", SecretAccessKey: "secret"}, nil
+	})
+	return NewS3Client2(s3.NewFromConfig(cfg), "our-bucket", OperationTimeouts{})
+}
+
+func TestForeignerHandlerReadOperations(t *testing.T) {
+	objects := map[string]string{"partner-bucket/exports/a.zip": "PAYLOAD", "partner-bucket/exports/b.zip": "OTHER", "partner-bucket/private/c.zip": "SECRET"}
+	_, srv := newFakeS3(objects)
+	defer srv.Close()
+
+	h := NewForeignerHandler(newFakeS3Foreigner(srv.URL), nil, nil, NewForeignPolicy(nil, []string{"partner-bucket"}, []string{"exports/"}), nil, 60)
+	query := "?region=eu-west-1&bucket=partner-bucket&role=" + destinationRole
+
+	rec := httptest.NewRecorder()
+	h.HandleForeignerBucketGet(rec, newRequest("GET", "/foreign/"+query+"&key=exports/a.zip", ""))
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "PAYLOAD", rec.Body.String())
+	assert.Equal(t, "application/zip", rec.Header().Get("Content-Type"))
+
+	rec = httptest.NewRecorder()
+	h.HandleForeignerBucketGet(rec, newRequest("GET", "/foreign/"+query+"&key=exports/missing.zip", ""))
+	assert.Equal(t, 404, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.HandleForeignerBucketHead(rec, newRequest("HEAD", "/foreign/"+query+"&key=exports/a.zip", ""))
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "7", rec.Header().Get("Content-Length"))
+	assert.Equal(t, `"etag"`, rec.Header().Get("ETag"))
+
+	rec = httptest.NewRecorder()
+	h.HandleForeignerBucketHead(rec, newRequest("HEAD", "/foreign/"+query+"&key=exports/missing.zip", ""))
+	assert.Equal(t, 404, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.HandleForeignerBucketList(rec, newRequest("GET", "/foreign/list"+query+"&prefix=exports/", ""))
+	assert.Equal(t, 200, rec.Code)
+	var listing foreignListing
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &listing))
+	sort.Strings(listing.Keys)
+	assert.Equal(t, []string{"exports/a.zip", "exports/b.zip"}, listing.Keys)
+
+	rec = httptest.NewRecorder()
+	h.HandleForeignerBucketList(rec, newRequest("GET", "/foreign/list"+query+"&prefix=private/", ""))
+	assert.Equal(t, 403, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.HandleForeignerPresignURL(rec, newRequest("GET", "/foreign/presign"+query+"&key=exports/a.zip", ""))
+	assert.Equal(t, 200, rec.Code)
+	var purl presignurl
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &purl))
+	assert.Contains(t, purl.URL, "/partner-bucket/exports/a.zip")
+	assert.Contains(t, purl.URL, "X-Amz-Expires=60")
+
+	rec = httptest.NewRecorder()
+	h.HandleForeignerBucketDelete(rec, newRequest("DELETE", "/foreign/"+query+"&key=exports/a.zip", ""))
+	assert.Equal(t, 204, rec.Code)
+	assert.NotContains(t, objects, "partner-bucket/exports/a.zip")
+}
+
+// fakeSTS hands out credentials for every role it is asked to assume and records the calls.
+type fakeSTS struct {
+	calls   map[string]int
+	inputs  []*sts.AssumeRoleInput
+	expires time.Time
+	err     error
+	// failRole only fails the calls assuming that role.
+	failRole string
+}
+
+// fakeSTSClient is the STS client of one hop, configured with the credentials of the previous hop.
+type fakeSTSClient struct {
+	fake *fakeSTS
+	cfg  aws.Config
+}
+
+func (c *fakeSTSClient) AssumeRole(ctx context.Context, in *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+	// Like STS, every hop signs its call with the credentials of the previous one.
+	if c.cfg.Credentials != nil {
+		if _, err := c.cfg.Credentials.Retrieve(ctx); err != nil {
+			return nil, err
+		}
+	}
+	role := aws.ToString(in.RoleArn)
+	c.fake.calls[role]++
+	c.fake.inputs = append(c.fake.inputs, in)
+	if c.fake.err != nil {
+		return nil, c.fake.err
+	}
+	if role == c.fake.failRole {
+		return nil, &smithy.GenericAPIError{Code: "AccessDenied", Message: "not authorized to perform sts:AssumeRole"}
+	}
+	return &sts.AssumeRoleOutput{Credentials: &ststypes.Credentials{
+		AccessKeyId:     aws.String(role),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(c.fake.expires),
+	}}, nil
+}
+
+func newTestForeigner(fake *fakeSTS, registry metrics.Registry) *Foreigner {
+	f := NewForeigner(http.DefaultClient, OperationTimeouts{}, time.Minute, nil, "upp-exports-rw-s3", registry)
+	f.loadConfig = func(ctx context.Context, region string) (aws.Config, error) {
+		return aws.Config{Region: region}, nil
+	}
+	f.newSTSClient = func(cfg aws.Config) stsAPI {
+		return &fakeSTSClient{fake, cfg}
+	}
+	return f
+}
+
+func TestForeignerCachesCredentials(t *testing.T) {
+	fake := &fakeSTS{calls: map[string]int{}, expires: time.Now().Add(time.Hour)}
+	registry := metrics.NewRegistry()
+	f := newTestForeigner(fake, registry)
+	target := ForeignTarget{Region: "eu-west-1", Bucket: "partner-bucket", Roles: []string{exporterRole, destinationRole}}
+
+	first, err := f.client(context.Background(), target)
+	assert.NoError(t, err)
+	second, err := f.client(context.Background(), target)
+	assert.NoError(t, err)
+	assert.True(t, first.client == second.client, "the S3 client is shared")
+	assert.Equal(t, map[string]int{exporterRole: 1, destinationRole: 1}, fake.calls)
+
+	_, err = f.client(context.Background(), ForeignTarget{Region: "us-east-1", Bucket: "partner-bucket", Roles: target.Roles})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fake.calls[destinationRole], "chains are cached per region")
+
+	assert.Equal(t, int64(1), registry.Get("foreign.credentials.cache.hit").(metrics.Counter).Count())
+	assert.Equal(t, int64(2), registry.Get("foreign.credentials.cache.miss").(metrics.Counter).Count())
+	assert.Equal(t, int64(4), registry.Get("foreign.sts.assumerole").(metrics.Timer).Count())
+}
+
+func TestForeignerRefreshesCredentialsNearExpiry(t *testing.T) {
+	fake := &fakeSTS{calls: map[string]int{}, expires: time.Now().Add(30 * time.Second)}
+	f := newTestForeigner(fake, metrics.NewRegistry())
+	target := ForeignTarget{Region: "eu-west-1", Bucket: "partner-bucket", Roles: []string{destinationRole}}
+
+	_, err := f.client(context.Background(), target)
+	assert.NoError(t, err)
+	_, err = f.client(context.Background(), target)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fake.calls[destinationRole], "credentials inside the expiry window are refreshed")
+}
+
+func TestForeignerEvictsFailingChain(t *testing.T) {
+	fake := &fakeSTS{calls: map[string]int{}, expires: time.Now().Add(time.Hour), err: errors.New("access denied")}
+	f := newTestForeigner(fake, metrics.NewRegistry())
+	target := ForeignTarget{Region: "eu-west-1", Bucket: "partner-bucket", Roles: []string{destinationRole}}
+
+	_, err := f.client(context.Background(), target)
+	assert.Error(t, err)
+	assert.Empty(t, f.clients)
+
+	fake.err = nil
+	_, err = f.client(context.Background(), target)
+	assert.NoError(t, err)
+	assert.Len(t, f.clients, 1)
+
+	_, err = f.client(context.Background(), ForeignTarget{Bucket: "partner-bucket"})
+	assert.Equal(t, errNoRoles, err)
+}
+
+func TestForeignerHandlerCopy(t *testing.T) {
+	fake, srv := newFakeS3(map[string]string{"our-bucket/exports/a.zip": "PAYLOAD-OF-SEVERAL-PARTS", "our-bucket/foreign-queue/payloads/abc": "SPOOLED"})
+	defer srv.Close()
+
+	f := newFakeS3Foreigner(srv.URL)
+	h := NewForeignerHandler(f, NewForeignCopier(newOurBucket(f), f, 10, "", "", "foreign-import-staging", NewKeyPolicy("foreign-queue", "foreign-import-staging")), nil, NewForeignPolicy(nil, []string{"partner-bucket"}, nil), nil, 60)
+	query := "?region=eu-west-1&bucket=partner-bucket&role=" + destinationRole
+
+	rec := httptest.NewRecorder()
+	h.HandleForeignerCopy(rec, newRequest("PUT", "/foreign/copy"+query+"&key=copied.zip&source=exports/a.zip", ""))
+	assert.Equal(t, 201, rec.Code)
+	assert.Equal(t, 1, fake.copies, "copied server side")
+	assert.Equal(t, "PAYLOAD-OF-SEVERAL-PARTS", fake.objects["partner-bucket/copied.zip"])
+
+	fake.denyCopy = true
+	rec = httptest.NewRecorder()
+	h.HandleForeignerCopy(rec, newRequest("PUT", "/foreign/copy"+query+"&key=streamed.zip&source=exports/a.zip", ""))
+	assert.Equal(t, 201, rec.Code)
+	assert.Equal(t, 3, fake.partUploads, "streamed in parts of 10 bytes")
+	assert.Equal(t, "PAYLOAD-OF-SEVERAL-PARTS", fake.objects["partner-bucket/streamed.zip"])
+
+	rec = httptest.NewRecorder()
+	h.HandleForeignerCopy(rec, newRequest("PUT", "/foreign/copy"+query+"&key=missing.zip&source=exports/missing.zip", ""))
+	assert.Equal(t, 404, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.HandleForeignerCopy(rec, newRequest("PUT", "/foreign/copy"+query+"&key=copied.zip", ""))
+	assert.Equal(t, 400, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.HandleForeignerCopy(rec, newRequest("PUT", "/foreign/copy"+query+"&key=spool.zip&source=foreign-queue/payloads/abc", ""))
+	assert.Equal(t, 400, rec.Code, "sources under reserved prefixes are rejected")
+	assert.NotContains(t, fake.objects, "partner-bucket/spool.zip")
+}
+
+func TestForeignerAssumeRoleOptions(t *testing.T) {
+	fake := &fakeSTS{calls: map[string]int{}, expires: time.Now().Add(time.Hour)}
+	f := newTestForeigner(fake, metrics.NewRegistry())
+	f.roleOptions = map[string]RoleOptions{
+		destinationRole: {ExternalID: "partner-secret", DurationSeconds: 900, Tags: map[string]string{"team": "exports"}, ScopeToBucket: true},
+	}
+	ctx := transactionid.TransactionAwareContext(context.Background(), "tid_export/42")
+	target := ForeignTarget{Region: "eu-west-1", Bucket: "partner-bucket", Roles: []string{exporterRole, destinationRole}}
+
+	_, err := f.client(ctx, target)
+	assert.NoError(t, err)
+	assert.Len(t, fake.inputs, 2)
+
+	exporter, destination := fake.inputs[0], fake.inputs[1]
+	assert.Equal(t, "upp-exports-rw-s3", aws.ToString(exporter.RoleSessionName))
+	assert.Nil(t, exporter.ExternalId)
+	assert.Nil(t, exporter.Policy)
+
+	assert.Equal(t, "upp-exports-rw-s3", aws.ToString(destination.RoleSessionName))
+	assert.Equal(t, "partner-secret", aws.ToString(destination.ExternalId))
+	assert.Equal(t, int32(900), aws.ToInt32(destination.DurationSeconds))
+	assert.Equal(t, []ststypes.Tag{{Key: aws.String("team"), Value: aws.String("exports")}}, destination.Tags)
+	assert.Contains(t, aws.ToString(destination.Policy), `"arn:aws:s3:::partner-bucket/*"`)
+
+	target.Bucket = "other-bucket"
+	_, err = f.client(ctx, target)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fake.calls[destinationRole], "credentials scoped to a bucket are not shared with other buckets")
+	assert.Contains(t, aws.ToString(fake.inputs[len(fake.inputs)-1].Policy), `"arn:aws:s3:::other-bucket"`)
+
+	_, err = f.client(transactionid.TransactionAwareContext(context.Background(), "tid_other"), ForeignTarget{Region: "eu-west-1", Bucket: "third-bucket", Roles: []string{exporterRole, destinationRole}})
+	assert.NoError(t, err)
+	assert.Equal(t, "upp-exports-rw-s3", aws.ToString(fake.inputs[len(fake.inputs)-1].RoleSessionName), "the session name doesn't follow the request")
+
+	assert.Equal(t, "tid_export-42", roleSessionName("tid_export/42"))
+	assert.Equal(t, defaultSessionName, roleSessionName(""))
+}
+
+func TestLoadRoleOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "roles.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"`+destinationRole+`": {"externalId": "partner-secret", "scopeToBucket": true}}`), 0600))
+	options, err := LoadRoleOptions(path)
+	assert.NoError(t, err)
+	assert.Equal(t, RoleOptions{ExternalID: "partner-secret", ScopeToBucket: true}, options[destinationRole])
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"`+destinationRole+`": {"durationSeconds": 60}}`), 0600))
+	_, err = LoadRoleOptions(path)
+	assert.Error(t, err)
+}
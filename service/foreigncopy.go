@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	transactionid "github.com/Financial-Times/transactionid-utils-go"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxCopyObjectSize is the largest object a single CopyObject call accepts.
+	maxCopyObjectSize = 5 << 30
+	// MinPartSize is the smallest part S3 accepts in a multipart upload, except for the last one.
+	MinPartSize = 5 << 20
+)
+
+// ForeignCopier moves objects between our bucket and foreign buckets without the caller handling the bytes.
+type ForeignCopier struct {
+	source        *S3Client2
+	foreigner     *Foreigner
+	partSize      int64
+	contentPrefix string
+	conceptPrefix string
+	stagingPrefix string
+	keys          KeyPolicy
+}
+
+// NewForeignCopier streams objects in parts of partSize bytes when a server-side copy isn't possible.
+// contentPrefix and conceptPrefix are where content and concepts are kept in our bucket, for archives of content
+// published in a date range and for imports into the concept store. Imports are staged under stagingPrefix until
+// they are verified, and imports into the generic store are held to keys.
+func NewForeignCopier(source *S3Client2, foreigner *Foreigner, partSize int64, contentPrefix, conceptPrefix, stagingPrefix string, keys KeyPolicy) *ForeignCopier {
+	return &ForeignCopier{source, foreigner, partSize, contentPrefix, conceptPrefix, strings.Trim(stagingPrefix, "/"), keys}
+}
+
+// Copy copies sourceKey from our bucket to key in the target bucket, and reports false if the source doesn't exist.
+// A server-side CopyObject is tried first. It needs the last role of the chain to be able to read our bucket,
+// and when it can't the object is streamed through this service instead.
+func (c *ForeignCopier) Copy(ctx context.Context, sourceKey string, t ForeignTarget, key string, tid string) (bool, error) {
+	ctx, cancel := withTimeout(ctx, c.foreigner.timeouts.Copy)
+	defer cancel()
+
+	found, info, err := c.source.Head(ctx, sourceKey)
+	if err != nil || !found {
+		return found, err
+	}
+	dest, err := c.foreigner.client(ctx, t)
+	if err != nil {
+		return true, err
+	}
+
+	logger := log.WithFields(log.Fields{"sourceKey": sourceKey, "bucketName": t.Bucket, "key": key, transactionid.TransactionIDKey: tid})
+	if info.ContentLength <= maxCopyObjectSize {
+		err = dest.CopyFrom(ctx, c.source.bucketName, sourceKey, key, info.ContentType, tid)
+		if err == nil {
+			logger.Info("Copied object server side")
+			return true, nil
+		}
+		if !isAccessDenied(err) {
+			return true, err
+		}
+		logger.WithError(err).Info("Server side copy not permitted, streaming the object instead")
+	}
+
+	resp, err := c.source.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.source.bucketName),
+		Key:    aws.String(sourceKey),
+	})
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if err = dest.WriteStream(ctx, key, resp.Body, c.partSize, info.ContentType, tid); err != nil {
+		return true, fmt.Errorf("streaming %s: %w", sourceKey, err)
+	}
+	logger.Info("Streamed object")
+	return true, nil
+}
+
+func isAccessDenied(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "AccessDenied"
+}
+
+// HandleForeignerCopy copies the object at the 'source' key of our bucket to the foreign destination.
+func (h *ForeignerHandler) HandleForeignerCopy(rw http.ResponseWriter, r *http.Request) {
+	sourceKey := r.URL.Query().Get("source")
+	if sourceKey == "" {
+		respondWithBadRequest(rw, "Query param 'source' is required.")
+		return
+	}
+	// The source is authorized as a generic store key, so it is held to the same policy.
+	if err := h.copier.keys.Check(sourceKey); err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return
+	}
+	target, key, ok := h.foreignRequest(rw, r, "key")
+	if !ok {
+		return
+	}
+	tid := transactionid.GetTransactionIDFromRequest(r)
+
+	ctx := transactionid.TransactionAwareContext(r.Context(), tid)
+	found, err := h.copier.Copy(ctx, sourceKey, target, key, tid)
+	if err != nil {
+		foreignerServiceUnavailable(target.Bucket, err, rw)
+		return
+	}
+	if !found {
+		respondSourceNotFound(rw)
+		return
+	}
+	rw.WriteHeader(http.StatusCreated)
+}
+
+func respondSourceNotFound(rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusNotFound)
+	rw.Write([]byte("{\"message\":\"Source not found\"}"))
+}
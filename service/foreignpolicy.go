@@ -0,0 +1,101 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+)
+
+// roleChainSeparator separates the hops of a role chain in configuration, e.g. "arn:a>arn:b".
+const roleChainSeparator = ">"
+
+// ForeignPolicy restricts which foreign buckets and keys may be reached. An empty list leaves that dimension unrestricted.
+type ForeignPolicy struct {
+	RoleChains  [][]string
+	Buckets     []string
+	KeyPrefixes []string
+}
+
+// NewForeignPolicy builds a policy from role chains written as hops joined by ">", bucket names and key prefixes.
+func NewForeignPolicy(roleChains, buckets, keyPrefixes []string) *ForeignPolicy {
+	p := &ForeignPolicy{Buckets: trimAll(buckets), KeyPrefixes: trimAll(keyPrefixes)}
+	for _, chain := range trimAll(roleChains) {
+		p.RoleChains = append(p.RoleChains, trimAll(strings.Split(chain, roleChainSeparator)))
+	}
+	return p
+}
+
+func trimAll(values []string) []string {
+	var trimmed []string
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			trimmed = append(trimmed, v)
+		}
+	}
+	return trimmed
+}
+
+// Unrestricted reports the dimensions left open, so they can be flagged at startup.
+func (p *ForeignPolicy) Unrestricted() []string {
+	var open []string
+	if len(p.RoleChains) == 0 {
+		open = append(open, "role chains")
+	}
+	if len(p.Buckets) == 0 {
+		open = append(open, "buckets")
+	}
+	if len(p.KeyPrefixes) == 0 {
+		open = append(open, "key prefixes")
+	}
+	return open
+}
+
+// Check returns an error describing the first restriction the destination violates. For listings key is the prefix.
+func (p *ForeignPolicy) Check(roles []string, bucket, key string) error {
+	if len(p.RoleChains) > 0 && !p.allowsChain(roles) {
+		return fmt.Errorf("role chain %s is not allowed", strings.Join(roles, roleChainSeparator))
+	}
+	if len(p.Buckets) > 0 && !contains(p.Buckets, bucket) {
+		return fmt.Errorf("bucket %s is not allowed", bucket)
+	}
+	if len(p.KeyPrefixes) > 0 && !hasAnyPrefix(key, p.KeyPrefixes) {
+		return fmt.Errorf("key %s is outside the allowed prefixes", key)
+	}
+	return nil
+}
+
+func (p *ForeignPolicy) allowsChain(roles []string) bool {
+	for _, chain := range p.RoleChains {
+		if len(chain) != len(roles) {
+			continue
+		}
+		matches := true
+		for i := range chain {
+			if chain[i] != roles[i] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, v string) bool {
+	for _, candidate := range values {
+		if candidate == v {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyPrefix(v string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(v, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,491 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	transactionid "github.com/Financial-Times/transactionid-utils-go"
+	"github.com/gorilla/mux"
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// States of a queued foreign upload, which are also the folders of the spool its job is kept in.
+const (
+	JobPending = "pending"
+	JobDead    = "dead"
+	JobDone    = "done"
+)
+
+// doneSweepPeriod is how often delivered jobs older than the retention are removed.
+const doneSweepPeriod = time.Hour
+
+// ForeignJob is a foreign upload accepted for asynchronous delivery.
+type ForeignJob struct {
+	ID             string        `json:"id"`
+	Target         ForeignTarget `json:"target"`
+	Key            string        `json:"key"`
+	ContentType    string        `json:"contentType,omitempty"`
+	TransactionID  string        `json:"transactionId"`
+	ClientIdentity string        `json:"clientIdentity,omitempty"`
+	Attempts       int           `json:"attempts"`
+	LastError      string        `json:"lastError,omitempty"`
+	Created        time.Time     `json:"created"`
+	Updated        time.Time     `json:"updated"`
+}
+
+// ForeignQueue delivers foreign uploads in the background. Payloads and jobs are spooled to our own bucket so that
+// nothing is lost on a restart: pending jobs are picked up again when the queue starts.
+// A job that keeps failing is moved to the dead letters, where it waits to be retried or purged.
+type ForeignQueue struct {
+	spool       *S3Client2
+	prefix      string
+	foreigner   *Foreigner
+	policy      *ForeignPolicy
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	retention   time.Duration
+
+	ctx       context.Context
+	ready     chan string
+	mu        sync.Mutex
+	scheduled map[string]bool
+
+	enqueued     metrics.Counter
+	delivered    metrics.Counter
+	failed       metrics.Counter
+	deadLettered metrics.Counter
+}
+
+// NewForeignQueue spools under prefix in our bucket. Jobs are held to policy again when they are delivered.
+// A failed attempt is retried after backoff, doubling with each attempt up to maxBackoff, until maxAttempts have
+// failed. Delivered jobs are kept for their status for retention, or for good when it is zero.
+func NewForeignQueue(spool *S3Client2, prefix string, foreigner *Foreigner, policy *ForeignPolicy, maxAttempts int, backoff, maxBackoff, retention time.Duration, registry metrics.Registry) *ForeignQueue {
+	return &ForeignQueue{
+		spool:        spool,
+		prefix:       strings.Trim(prefix, "/"),
+		foreigner:    foreigner,
+		policy:       policy,
+		maxAttempts:  maxAttempts,
+		backoff:      backoff,
+		maxBackoff:   maxBackoff,
+		retention:    retention,
+		ctx:          context.Background(),
+		ready:        make(chan string, 1024),
+		scheduled:    make(map[string]bool),
+		enqueued:     metrics.GetOrRegisterCounter("foreign.queue.enqueued", registry),
+		delivered:    metrics.GetOrRegisterCounter("foreign.queue.delivered", registry),
+		failed:       metrics.GetOrRegisterCounter("foreign.queue.failed", registry),
+		deadLettered: metrics.GetOrRegisterCounter("foreign.queue.deadlettered", registry),
+	}
+}
+
+func (q *ForeignQueue) jobKey(state, id string) string {
+	return path.Join(q.prefix, state, id+".json")
+}
+
+func (q *ForeignQueue) payloadKey(id string) string {
+	return path.Join(q.prefix, "payloads", id)
+}
+
+// Start runs workers, and the sweeper of delivered jobs, until ctx is done, after scheduling the jobs a previous run
+// left pending.
+func (q *ForeignQueue) Start(ctx context.Context, workers int) error {
+	q.mu.Lock()
+	q.ctx = ctx
+	q.mu.Unlock()
+	for i := 0; i < workers; i++ {
+		go q.work(ctx)
+	}
+	if q.retention > 0 {
+		go q.sweep(ctx)
+	}
+	return q.spool.EachObject(ctx, path.Join(q.prefix, JobPending)+"/", func(key string) (bool, error) {
+		q.schedule(strings.TrimSuffix(path.Base(key), ".json"), 0)
+		return true, nil
+	})
+}
+
+func (q *ForeignQueue) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-q.ready:
+			q.mu.Lock()
+			delete(q.scheduled, id)
+			q.mu.Unlock()
+			q.process(ctx, id)
+		}
+	}
+}
+
+func (q *ForeignQueue) sweep(ctx context.Context) {
+	ticker := time.NewTicker(doneSweepPeriod)
+	defer ticker.Stop()
+	for {
+		if n, err := q.SweepDone(ctx, time.Now().Add(-q.retention)); err != nil {
+			log.WithError(err).Error("Failed to sweep delivered foreign upload jobs")
+		} else if n > 0 {
+			log.WithField("jobs", n).Info("Swept delivered foreign upload jobs")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SweepDone removes the delivered jobs last updated before cutoff, returning how many it removed.
+func (q *ForeignQueue) SweepDone(ctx context.Context, cutoff time.Time) (int, error) {
+	swept := 0
+	err := q.spool.EachObject(ctx, path.Join(q.prefix, JobDone)+"/", func(key string) (bool, error) {
+		job, found, err := q.loadJob(ctx, JobDone, strings.TrimSuffix(path.Base(key), ".json"))
+		if err != nil || !found || !job.Updated.Before(cutoff) {
+			return true, err
+		}
+		if err := q.spool.Delete(ctx, key); err != nil {
+			return false, err
+		}
+		swept++
+		return true, nil
+	})
+	return swept, err
+}
+
+// schedule hands the job to a worker after delay, unless it is already waiting for one.
+func (q *ForeignQueue) schedule(id string, delay time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.scheduled[id] {
+		return
+	}
+	q.scheduled[id] = true
+	ctx := q.ctx
+	time.AfterFunc(delay, func() {
+		select {
+		case q.ready <- id:
+		case <-ctx.Done():
+		}
+	})
+}
+
+func (q *ForeignQueue) retryDelay(attempts int) time.Duration {
+	d := q.backoff
+	for i := 1; i < attempts && d < q.maxBackoff; i++ {
+		d *= 2
+	}
+	if q.maxBackoff > 0 && d > q.maxBackoff {
+		d = q.maxBackoff
+	}
+	return d
+}
+
+// Enqueue spools the payload and the job, and returns the job id once both are stored.
+func (q *ForeignQueue) Enqueue(ctx context.Context, t ForeignTarget, key string, b *[]byte, ct, tid string) (string, error) {
+	id, err := newJobID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	job := ForeignJob{
+		ID:             id,
+		Target:         t,
+		Key:            key,
+		ContentType:    ct,
+		TransactionID:  tid,
+		ClientIdentity: ClientIdentity(ctx),
+		Created:        now,
+		Updated:        now,
+	}
+	if err := q.spool.Write(ctx, q.payloadKey(id), b, ct, tid); err != nil {
+		return "", err
+	}
+	if err := q.saveJob(ctx, JobPending, job); err != nil {
+		return "", err
+	}
+	q.enqueued.Inc(1)
+	q.schedule(id, 0)
+	return id, nil
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validJobID reports whether id is one newJobID could have made, before it goes into a spool key.
+func validJobID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return err == nil && len(id) == 32 && id == strings.ToLower(id)
+}
+
+func (q *ForeignQueue) saveJob(ctx context.Context, state string, job ForeignJob) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return q.spool.Write(ctx, q.jobKey(state, job.ID), &b, "application/json", job.TransactionID)
+}
+
+func (q *ForeignQueue) loadJob(ctx context.Context, state, id string) (ForeignJob, bool, error) {
+	var job ForeignJob
+	found, body, _, err := q.spool.Get(ctx, q.jobKey(state, id))
+	if err != nil || !found {
+		return job, found, err
+	}
+	defer body.Close()
+	err = json.NewDecoder(body).Decode(&job)
+	return job, err == nil, err
+}
+
+// moveJob saves the job under its new state before removing the old one, so a crash in between leaves a duplicate
+// rather than losing the job.
+func (q *ForeignQueue) moveJob(ctx context.Context, from, to string, job ForeignJob) error {
+	if err := q.saveJob(ctx, to, job); err != nil {
+		return err
+	}
+	return q.spool.Delete(ctx, q.jobKey(from, job.ID))
+}
+
+func (q *ForeignQueue) process(ctx context.Context, id string) {
+	logger := log.WithField("jobId", id)
+	job, found, err := q.loadJob(ctx, JobPending, id)
+	if err != nil {
+		logger.WithError(err).Error("Failed to load foreign upload job")
+		q.schedule(id, q.retryDelay(1))
+		return
+	}
+	if !found {
+		return
+	}
+	logger = logger.WithFields(log.Fields{"bucketName": job.Target.Bucket, "key": job.Key, transactionid.TransactionIDKey: job.TransactionID})
+
+	// The policy may have been tightened since the job was accepted, and retrying won't make it pass.
+	if err := q.policy.Check(job.Target.Roles, job.Target.Bucket, job.Key); err != nil {
+		job.Updated = time.Now().UTC()
+		job.LastError = err.Error()
+		q.deadLettered.Inc(1)
+		logger.WithError(err).Warn("Foreign upload rejected by the foreign policy, moved to dead letters")
+		if err := q.moveJob(ctx, JobPending, JobDead, job); err != nil {
+			logger.WithError(err).Error("Failed to move foreign upload to dead letters")
+		}
+		return
+	}
+
+	err = q.deliver(ctx, job)
+	job.Updated = time.Now().UTC()
+	if err == nil {
+		job.LastError = ""
+		if err = q.moveJob(ctx, JobPending, JobDone, job); err == nil {
+			err = q.spool.Delete(ctx, q.payloadKey(id))
+		}
+		if err != nil {
+			logger.WithError(err).Error("Delivered foreign upload but failed to clean up its spool")
+		}
+		q.delivered.Inc(1)
+		logger.Info("Delivered foreign upload")
+		return
+	}
+
+	q.failed.Inc(1)
+	job.Attempts++
+	job.LastError = err.Error()
+	if job.Attempts >= q.maxAttempts {
+		q.deadLettered.Inc(1)
+		logger.WithError(err).WithField("attempts", job.Attempts).Error("Foreign upload moved to dead letters")
+		if err := q.moveJob(ctx, JobPending, JobDead, job); err != nil {
+			logger.WithError(err).Error("Failed to move foreign upload to dead letters")
+		}
+		return
+	}
+	delay := q.retryDelay(job.Attempts)
+	logger.WithError(err).WithField("attempts", job.Attempts).Warnf("Foreign upload failed, retrying in %s", delay)
+	if err := q.saveJob(ctx, JobPending, job); err != nil {
+		logger.WithError(err).Error("Failed to record foreign upload attempt")
+	}
+	q.schedule(id, delay)
+}
+
+func (q *ForeignQueue) deliver(ctx context.Context, job ForeignJob) error {
+	found, body, _, err := q.spool.Get(ctx, q.payloadKey(job.ID))
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("payload of job %s is missing", job.ID)
+	}
+	defer body.Close()
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	ctx = transactionid.TransactionAwareContext(ctx, job.TransactionID)
+	if job.ClientIdentity != "" {
+		ctx = WithClientIdentity(ctx, job.ClientIdentity)
+	}
+	return q.foreigner.UploadToBucket(ctx, job.Target, job.Key, &b, job.ContentType, job.TransactionID)
+}
+
+// Status finds the job in any state. Done jobs are only found for as long as the spool keeps them.
+func (q *ForeignQueue) Status(ctx context.Context, id string) (ForeignJob, string, error) {
+	for _, state := range []string{JobPending, JobDead, JobDone} {
+		job, found, err := q.loadJob(ctx, state, id)
+		if err != nil || found {
+			return job, state, err
+		}
+	}
+	return ForeignJob{}, "", nil
+}
+
+func (q *ForeignQueue) DeadLetters(ctx context.Context) ([]ForeignJob, error) {
+	jobs := []ForeignJob{}
+	err := q.spool.EachObject(ctx, path.Join(q.prefix, JobDead)+"/", func(key string) (bool, error) {
+		job, found, err := q.loadJob(ctx, JobDead, strings.TrimSuffix(path.Base(key), ".json"))
+		if found {
+			jobs = append(jobs, job)
+		}
+		return true, err
+	})
+	return jobs, err
+}
+
+// Retry gives a dead letter a fresh set of attempts.
+func (q *ForeignQueue) Retry(ctx context.Context, id string) (bool, error) {
+	job, found, err := q.loadJob(ctx, JobDead, id)
+	if err != nil || !found {
+		return found, err
+	}
+	job.Attempts = 0
+	job.Updated = time.Now().UTC()
+	if err := q.moveJob(ctx, JobDead, JobPending, job); err != nil {
+		return true, err
+	}
+	q.schedule(id, 0)
+	return true, nil
+}
+
+// Purge drops a dead letter and its payload.
+func (q *ForeignQueue) Purge(ctx context.Context, id string) (bool, error) {
+	_, found, err := q.loadJob(ctx, JobDead, id)
+	if err != nil || !found {
+		return found, err
+	}
+	if err := q.spool.Delete(ctx, q.payloadKey(id)); err != nil {
+		return true, err
+	}
+	return true, q.spool.Delete(ctx, q.jobKey(JobDead, id))
+}
+
+type jobStatus struct {
+	State string `json:"state"`
+	ForeignJob
+}
+
+func respondJobNotFound(rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusNotFound)
+	rw.Write([]byte("{\"message\":\"Job not found\"}"))
+}
+
+func respondInvalidJobID(rw http.ResponseWriter) {
+	respondWithBadRequest(rw, "Invalid job id.")
+}
+
+func respondJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
+
+type acceptedJob struct {
+	ID string `json:"id"`
+}
+
+// enqueue answers 202 once the upload is spooled, pointing at the job status.
+func (h *ForeignerHandler) enqueue(ctx context.Context, rw http.ResponseWriter, t ForeignTarget, key string, b *[]byte, ct, tid string) {
+	id, err := h.queue.Enqueue(ctx, t, key, b, ct, tid)
+	if err != nil {
+		foreignerServiceUnavailable(t.Bucket, err, rw)
+		return
+	}
+	rw.Header().Set("Location", "/foreign/jobs/"+id)
+	respondJSON(rw, http.StatusAccepted, acceptedJob{id})
+}
+
+// HandleForeignerJobStatus reports the state of an asynchronous foreign upload to the client that submitted it.
+// Other clients are told the job isn't there.
+func (h *ForeignerHandler) HandleForeignerJobStatus(rw http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !validJobID(id) {
+		respondInvalidJobID(rw)
+		return
+	}
+	job, state, err := h.queue.Status(r.Context(), id)
+	if err != nil {
+		readerServiceUnavailable(r.URL.RequestURI(), err, rw)
+		return
+	}
+	if state == "" || job.ClientIdentity != ClientIdentity(r.Context()) {
+		respondJobNotFound(rw)
+		return
+	}
+	respondJSON(rw, http.StatusOK, jobStatus{state, job})
+}
+
+// DeadLetterHandler serves the admin endpoints that list, retry and purge dead letters.
+func DeadLetterHandler(q *ForeignQueue) http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/__foreign-dead-letters", func(rw http.ResponseWriter, r *http.Request) {
+		jobs, err := q.DeadLetters(r.Context())
+		if err != nil {
+			readerServiceUnavailable(r.URL.RequestURI(), err, rw)
+			return
+		}
+		respondJSON(rw, http.StatusOK, jobs)
+	}).Methods("GET")
+	r.HandleFunc("/__foreign-dead-letters/{id}/retry", func(rw http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if !validJobID(id) {
+			respondInvalidJobID(rw)
+			return
+		}
+		found, err := q.Retry(r.Context(), id)
+		respondDeadLetterAction(rw, r, found, err, http.StatusAccepted)
+	}).Methods("POST")
+	r.HandleFunc("/__foreign-dead-letters/{id}", func(rw http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if !validJobID(id) {
+			respondInvalidJobID(rw)
+			return
+		}
+		found, err := q.Purge(r.Context(), id)
+		respondDeadLetterAction(rw, r, found, err, http.StatusNoContent)
+	}).Methods("DELETE")
+	return r
+}
+
+func respondDeadLetterAction(rw http.ResponseWriter, r *http.Request, found bool, err error, status int) {
+	switch {
+	case err != nil:
+		writerServiceUnavailable(r.URL.RequestURI(), err, rw)
+	case !found:
+		respondJobNotFound(rw)
+	default:
+		rw.WriteHeader(status)
+	}
+}
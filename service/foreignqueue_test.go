@@ -0,0 +1,207 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/gorilla/mux"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestQueue(t *testing.T, f *Foreigner, maxAttempts int) *ForeignQueue {
+	q := NewForeignQueue(newOurBucket(f), "foreign-queue/", f, NewForeignPolicy(nil, []string{"partner-bucket"}, nil), maxAttempts, time.Millisecond, 5*time.Millisecond, 0, metrics.NewRegistry())
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	assert.NoError(t, q.Start(ctx, 1))
+	return q
+}
+
+// waitForState polls the job until it reaches state, or fails the test after a few seconds.
+func waitForState(t *testing.T, q *ForeignQueue, id, state string) ForeignJob {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, s, err := q.Status(context.Background(), id)
+		assert.NoError(t, err)
+		if s == state {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is %q, expected %q", id, s, state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestForeignQueueDelivers(t *testing.T) {
+	fake, srv := newFakeS3(map[string]string{})
+	defer srv.Close()
+	f := newFakeS3Foreigner(srv.URL)
+	q := newTestQueue(t, f, 3)
+	h := NewForeignerHandler(f, nil, q, NewForeignPolicy(nil, []string{"partner-bucket"}, nil), nil, 60)
+
+	rec := httptest.NewRecorder()
+	h.HandleForeignerBucketWrite(rec, newRequest("PUT", "/foreign/?region=eu-west-1&bucket=partner-bucket&role="+destinationRole+"&key=a.zip&async=true", "PAYLOAD"))
+	assert.Equal(t, 202, rec.Code)
+	var accepted acceptedJob
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &accepted))
+	assert.Equal(t, "/foreign/jobs/"+accepted.ID, rec.Header().Get("Location"))
+
+	job := waitForState(t, q, accepted.ID, JobDone)
+	assert.Equal(t, "a.zip", job.Key)
+	assert.Equal(t, 0, job.Attempts)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	assert.Equal(t, "PAYLOAD", fake.objects["partner-bucket/a.zip"])
+	assert.NotContains(t, fake.objects, "our-bucket/foreign-queue/payloads/"+accepted.ID, "the payload is dropped once delivered")
+	assert.NotContains(t, fake.objects, "our-bucket/foreign-queue/pending/"+accepted.ID+".json")
+}
+
+func TestForeignQueueDeadLetters(t *testing.T) {
+	fake, srv := newFakeS3(map[string]string{})
+	defer srv.Close()
+	f := newFakeS3Foreigner(srv.URL)
+	q := newTestQueue(t, f, 2)
+	sts := &fakeSTS{calls: map[string]int{}, expires: time.Now().Add(time.Hour), failRole: destinationRole}
+	f.newSTSClient = func(cfg aws.Config) stsAPI {
+		return &fakeSTSClient{sts, cfg}
+	}
+	target := ForeignTarget{Region: "eu-west-1", Bucket: "partner-bucket", Roles: []string{destinationRole}}
+
+	payload := []byte("PAYLOAD")
+	id, err := q.Enqueue(context.Background(), target, "a.zip", &payload, "application/zip", "tid_dead")
+	assert.NoError(t, err)
+	job := waitForState(t, q, id, JobDead)
+	assert.Equal(t, 2, job.Attempts)
+	assert.Contains(t, job.LastError, "AccessDenied")
+
+	dead, err := q.DeadLetters(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, dead, 1)
+	assert.Equal(t, id, dead[0].ID)
+
+	h := DeadLetterHandler(q)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, newRequest("POST", "/__foreign-dead-letters/unknown/retry", ""))
+	assert.Equal(t, 400, rec.Code)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newRequest("POST", "/__foreign-dead-letters/0123456789abcdef0123456789abcdef/retry", ""))
+	assert.Equal(t, 404, rec.Code)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newRequest("DELETE", "/__foreign-dead-letters/..%2Fpending%2F"+id, ""))
+	assert.NotEqual(t, 204, rec.Code)
+
+	sts.failRole = ""
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newRequest("POST", "/__foreign-dead-letters/"+id+"/retry", ""))
+	assert.Equal(t, 202, rec.Code)
+	waitForState(t, q, id, JobDone)
+
+	id, err = q.Enqueue(context.Background(), ForeignTarget{Bucket: "partner-bucket"}, "b.zip", &payload, "application/zip", "tid_purged")
+	assert.NoError(t, err)
+	waitForState(t, q, id, JobDead)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newRequest("DELETE", "/__foreign-dead-letters/"+id, ""))
+	assert.Equal(t, 204, rec.Code)
+	_, state, err := q.Status(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, "", state)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	assert.NotContains(t, fake.objects, "our-bucket/foreign-queue/payloads/"+id)
+}
+
+func TestForeignQueueChecksPolicyOnDelivery(t *testing.T) {
+	fake, srv := newFakeS3(map[string]string{})
+	defer srv.Close()
+	f := newFakeS3Foreigner(srv.URL)
+	q := newTestQueue(t, f, 3)
+
+	payload := []byte("PAYLOAD")
+	id, err := q.Enqueue(context.Background(), ForeignTarget{Region: "eu-west-1", Bucket: "other-bucket", Roles: []string{destinationRole}}, "a.zip", &payload, "application/zip", "tid_denied")
+	assert.NoError(t, err)
+	job := waitForState(t, q, id, JobDead)
+	assert.Equal(t, 0, job.Attempts, "a job the policy rejects is not retried")
+	assert.Equal(t, "bucket other-bucket is not allowed", job.LastError)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	assert.NotContains(t, fake.objects, "other-bucket/a.zip")
+}
+
+func TestHandleForeignerJobStatus(t *testing.T) {
+	_, srv := newFakeS3(map[string]string{})
+	defer srv.Close()
+	f := newFakeS3Foreigner(srv.URL)
+	q := newTestQueue(t, f, 1)
+	h := NewForeignerHandler(f, nil, q, NewForeignPolicy(nil, nil, nil), nil, 60)
+	r := mux.NewRouter()
+	r.HandleFunc("/foreign/jobs/{id}", h.HandleForeignerJobStatus)
+
+	payload := []byte("PAYLOAD")
+	target := ForeignTarget{Region: "eu-west-1", Bucket: "partner-bucket", Roles: []string{destinationRole}}
+	id, err := q.Enqueue(WithClientIdentity(context.Background(), "partner-a"), target, "a.zip", &payload, "application/zip", "tid_status")
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		id, client string
+		expected   int
+	}{
+		{id, "partner-a", 200},
+		{id, "partner-b", 404},
+		{id, "", 404},
+		{"0123456789abcdef0123456789abcdef", "partner-a", 404},
+		{"unknown", "partner-a", 400},
+		{strings.ToUpper(id), "partner-a", 400},
+	} {
+		rec := httptest.NewRecorder()
+		req := newRequest("GET", "/foreign/jobs/"+tc.id, "")
+		r.ServeHTTP(rec, req.WithContext(WithClientIdentity(req.Context(), tc.client)))
+		assert.Equal(t, tc.expected, rec.Code, "%s as %q", tc.id, tc.client)
+		if tc.expected == 404 {
+			assert.Equal(t, "{\"message\":\"Job not found\"}", rec.Body.String())
+		}
+	}
+
+	h = NewForeignerHandler(f, nil, nil, NewForeignPolicy(nil, nil, nil), nil, 60)
+	rec := httptest.NewRecorder()
+	h.HandleForeignerBucketWrite(rec, newRequest("PUT", "/foreign/?region=eu-west-1&bucket=partner-bucket&role="+destinationRole+"&key=a.zip&async=true", "PAYLOAD"))
+	assert.Equal(t, 400, rec.Code)
+}
+
+func TestForeignQueueSweepDone(t *testing.T) {
+	fake, srv := newFakeS3(map[string]string{})
+	defer srv.Close()
+	f := newFakeS3Foreigner(srv.URL)
+	q := newTestQueue(t, f, 3)
+	target := ForeignTarget{Region: "eu-west-1", Bucket: "partner-bucket", Roles: []string{destinationRole}}
+
+	payload := []byte("PAYLOAD")
+	old, err := q.Enqueue(context.Background(), target, "a.zip", &payload, "application/zip", "tid_old")
+	assert.NoError(t, err)
+	job := waitForState(t, q, old, JobDone)
+	cutoff := time.Now()
+	recent, err := q.Enqueue(context.Background(), target, "b.zip", &payload, "application/zip", "tid_recent")
+	assert.NoError(t, err)
+	waitForState(t, q, recent, JobDone)
+	assert.True(t, job.Updated.Before(cutoff))
+
+	n, err := q.SweepDone(context.Background(), cutoff)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, state, _ := q.Status(context.Background(), old)
+	assert.Empty(t, state, "jobs delivered before the cutoff are removed")
+	_, state, _ = q.Status(context.Background(), recent)
+	assert.Equal(t, JobDone, state)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	assert.Equal(t, "PAYLOAD", fake.objects["partner-bucket/a.zip"], "only the job record is removed")
+}
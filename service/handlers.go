@@ -3,6 +3,7 @@ package service
 import (
 	"fmt"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	fthealth "github.com/Financial-Times/go-fthealth/v1_1"
@@ -12,17 +13,14 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/rcrowley/go-metrics"
 	log "github.com/sirupsen/logrus"
 )
 
-func AddAdminHandlers(servicesRouter *mux.Router, svc s3iface.S3API, bucketName, systemCode string) {
-	c := checker{svc, bucketName}
-	var monitoringRouter http.Handler = servicesRouter
-	monitoringRouter = httphandlers.TransactionAwareRequestLoggingHandler(log.StandardLogger(), monitoringRouter)
-	monitoringRouter = httphandlers.HTTPMetricsHandler(metrics.DefaultRegistry, monitoringRouter)
+func AddAdminHandlers(servicesRouter *mux.Router, svc s3iface.S3API, bucketName, systemCode string, readiness *Readiness) {
+	c := checker{svc, bucketName, readiness}
+	monitoringRouter := monitoringHandler(servicesRouter)
 	http.HandleFunc(status.PingPath, status.PingHandler)
 	http.HandleFunc(status.PingPathDW, status.PingHandler)
 	http.HandleFunc(status.BuildInfoPath, status.BuildInfoHandler)
@@ -54,9 +52,31 @@ func AddAdminHandlers(servicesRouter *mux.Router, svc s3iface.S3API, bucketName,
 	http.Handle("/", monitoringRouter)
 }
 
+// monitoringHandler logs and measures every request to the service routes.
+func monitoringHandler(h http.Handler) http.Handler {
+	h = httphandlers.TransactionAwareRequestLoggingHandler(log.StandardLogger(), h)
+	h = httphandlers.HTTPMetricsHandler(metrics.DefaultRegistry, h)
+	return WithResponseController(h)
+}
+
+// Readiness tracks whether the service is still accepting traffic.
+// Once draining, __gtg reports the service as not ready so it is taken out of rotation.
+type Readiness struct {
+	draining int32
+}
+
+func (r *Readiness) Drain() {
+	atomic.StoreInt32(&r.draining, 1)
+}
+
+func (r *Readiness) IsDraining() bool {
+	return atomic.LoadInt32(&r.draining) == 1
+}
+
 type checker struct {
 	s3iface.S3API
 	bucketName string
+	readiness  *Readiness
 }
 
 func (c *checker) healthCheck() (string, error) {
@@ -74,6 +94,9 @@ func (c *checker) healthCheck() (string, error) {
 }
 
 func (c *checker) gtgCheckHandler() gtg.Status {
+	if c.readiness.IsDraining() {
+		return gtg.Status{GoodToGo: false, Message: "Service is shutting down"}
+	}
 	if _, err := c.healthCheck(); err != nil {
 		log.Info("Healthcheck failed, gtg is bad.")
 		return gtg.Status{GoodToGo: false, Message: "Head request to S3 failed"}
@@ -82,7 +105,7 @@ func (c *checker) gtgCheckHandler() gtg.Status {
 	return gtg.Status{GoodToGo: true, Message: "OK"}
 }
 
-func Handlers(servicesRouter *mux.Router, mh *handlers.MethodHandler, resourcePath string, endpointRegex string) {
+func Handlers(servicesRouter *mux.Router, mh http.Handler, resourcePath string, endpointRegex string) {
 	if resourcePath != "" {
 		resourcePath = fmt.Sprintf("/%s", resourcePath)
 	}
@@ -2,6 +2,8 @@ package service
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"io"
 	"io/ioutil"
@@ -10,6 +12,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	status "github.com/Financial-Times/service-status-go/httphandlers"
 	"github.com/gorilla/handlers"
@@ -26,7 +29,8 @@ const (
 func TestAddAdminHandlers(t *testing.T) {
 	s := &mockS3Client{}
 	r := mux.NewRouter()
-	AddAdminHandlers(r, s, "bucketName", "")
+	readiness := &Readiness{}
+	AddAdminHandlers(r, s, "bucketName", "", readiness)
 
 	t.Run(status.PingPath, func(t *testing.T) {
 		assertRequestAndResponse(t, status.PingPath, 200, "pong")
@@ -72,14 +76,21 @@ func TestAddAdminHandlers(t *testing.T) {
 		body := rec.Body.String()
 		assert.Contains(t, body, errMsg)
 	})
+
+	t.Run("/__gtg draining", func(t *testing.T) {
+		s.s3error = nil
+		readiness.Drain()
+		rec := assertRequestAndResponse(t, "/__gtg", 503, "")
+		assert.Contains(t, rec.Body.String(), "Service is shutting down")
+	})
 }
 
 func TestRequestUrlMatchesResourcePathShouldHaveSuccessfulResponse(t *testing.T) {
 	r := mux.NewRouter()
 	mw := &mockWriter{}
 	mr := &mockReader{}
-	wh := NewWriterHandler(mw, mr)
-	rh := NewReaderHandler(mr)
+	wh := NewWriterHandler(mw, mr, KeyPolicy{})
+	rh := NewReaderHandler(mr, KeyPolicy{})
 	conceptMethodHandler := &handlers.MethodHandler{
 		"PUT":    http.HandlerFunc(wh.HandleContentWrite),
 		"GET":    http.HandlerFunc(rh.HandleContentGet),
@@ -95,8 +106,8 @@ func TestRequestUrlDoesNotMatchResourcePathShouldHaveNotFoundResponse(t *testing
 	r := mux.NewRouter()
 	mw := &mockWriter{}
 	mr := &mockReader{}
-	wh := NewWriterHandler(mw, mr)
-	rh := NewReaderHandler(mr)
+	wh := NewWriterHandler(mw, mr, KeyPolicy{})
+	rh := NewReaderHandler(mr, KeyPolicy{})
 	conceptMethodHandler := &handlers.MethodHandler{
 		"PUT":    http.HandlerFunc(wh.HandleContentWrite),
 		"GET":    http.HandlerFunc(rh.HandleContentGet),
@@ -112,7 +123,7 @@ func TestWriteHandlerNewConceptReturnsCreated(t *testing.T) {
 	r := mux.NewRouter()
 	mw := &mockWriter{}
 	mr := &mockReader{}
-	wh := NewWriterHandler(mw, mr)
+	wh := NewWriterHandler(mw, mr, KeyPolicy{})
 	conceptMethodHandler := &handlers.MethodHandler{
 		"PUT": http.HandlerFunc(wh.HandleConceptWrite),
 	}
@@ -128,8 +139,8 @@ func TestWriteHandlerNewContentReturnsCreated(t *testing.T) {
 	r := mux.NewRouter()
 	mw := &mockWriter{}
 	mr := &mockReader{}
-	wh := NewWriterHandler(mw, mr)
-	rh := NewReaderHandler(mr)
+	wh := NewWriterHandler(mw, mr, KeyPolicy{})
+	rh := NewReaderHandler(mr, KeyPolicy{})
 	conceptMethodHandler := &handlers.MethodHandler{
 		"PUT":    http.HandlerFunc(wh.HandleContentWrite),
 		"GET":    http.HandlerFunc(rh.HandleContentGet),
@@ -151,8 +162,8 @@ func TestWriteHandlerUpdateContentReturnsOK(t *testing.T) {
 	r := mux.NewRouter()
 	mw := &mockWriter{}
 	mr := &mockReader{found: true}
-	wh := NewWriterHandler(mw, mr)
-	rh := NewReaderHandler(mr)
+	wh := NewWriterHandler(mw, mr, KeyPolicy{})
+	rh := NewReaderHandler(mr, KeyPolicy{})
 	conceptMethodHandler := &handlers.MethodHandler{
 		"PUT":    http.HandlerFunc(wh.HandleContentWrite),
 		"GET":    http.HandlerFunc(rh.HandleContentGet),
@@ -174,8 +185,8 @@ func TestWriteHandlerUpdateContentReturnsBadRequest(t *testing.T) {
 	r := mux.NewRouter()
 	mw := &mockWriter{}
 	mr := &mockReader{found: true}
-	wh := NewWriterHandler(mw, mr)
-	rh := NewReaderHandler(mr)
+	wh := NewWriterHandler(mw, mr, KeyPolicy{})
+	rh := NewReaderHandler(mr, KeyPolicy{})
 	conceptMethodHandler := &handlers.MethodHandler{
 		"PUT":    http.HandlerFunc(wh.HandleContentWrite),
 		"GET":    http.HandlerFunc(rh.HandleContentGet),
@@ -194,8 +205,8 @@ func TestWriterHandlerFailReadingBody(t *testing.T) {
 	r := mux.NewRouter()
 	mw := &mockWriter{}
 	mr := &mockReader{}
-	wh := NewWriterHandler(mw, mr)
-	rh := NewReaderHandler(mr)
+	wh := NewWriterHandler(mw, mr, KeyPolicy{})
+	rh := NewReaderHandler(mr, KeyPolicy{})
 	conceptMethodHandler := &handlers.MethodHandler{
 		"PUT":    http.HandlerFunc(wh.HandleContentWrite),
 		"GET":    http.HandlerFunc(rh.HandleContentGet),
@@ -213,8 +224,8 @@ func TestWriterHandlerFailWrite(t *testing.T) {
 	r := mux.NewRouter()
 	mw := &mockWriter{returnError: errors.New("error writing")}
 	mr := &mockReader{}
-	wh := NewWriterHandler(mw, mr)
-	rh := NewReaderHandler(mr)
+	wh := NewWriterHandler(mw, mr, KeyPolicy{})
+	rh := NewReaderHandler(mr, KeyPolicy{})
 	conceptMethodHandler := &handlers.MethodHandler{
 		"PUT":    http.HandlerFunc(wh.HandleContentWrite),
 		"GET":    http.HandlerFunc(rh.HandleContentGet),
@@ -232,7 +243,7 @@ func TestWriterConceptHandlerDeleteReturnsOK(t *testing.T) {
 	r := mux.NewRouter()
 	mw := &mockWriter{}
 	mr := &mockReader{}
-	wh := NewWriterHandler(mw, mr)
+	wh := NewWriterHandler(mw, mr, KeyPolicy{})
 	conceptMethodHandler := &handlers.MethodHandler{
 		"DELETE": http.HandlerFunc(wh.HandleConceptDelete),
 	}
@@ -249,8 +260,8 @@ func TestWriterHandlerDeleteReturnsOK(t *testing.T) {
 	r := mux.NewRouter()
 	mw := &mockWriter{}
 	mr := &mockReader{}
-	wh := NewWriterHandler(mw, mr)
-	rh := NewReaderHandler(mr)
+	wh := NewWriterHandler(mw, mr, KeyPolicy{})
+	rh := NewReaderHandler(mr, KeyPolicy{})
 	conceptMethodHandler := &handlers.MethodHandler{
 		"PUT":    http.HandlerFunc(wh.HandleContentWrite),
 		"GET":    http.HandlerFunc(rh.HandleContentGet),
@@ -269,8 +280,8 @@ func TestWriterHandlerDeleteFailsReturns503(t *testing.T) {
 	r := mux.NewRouter()
 	mw := &mockWriter{returnError: errors.New("Some error from writer")}
 	mr := &mockReader{}
-	wh := NewWriterHandler(mw, mr)
-	rh := NewReaderHandler(mr)
+	wh := NewWriterHandler(mw, mr, KeyPolicy{})
+	rh := NewReaderHandler(mr, KeyPolicy{})
 	conceptMethodHandler := &handlers.MethodHandler{
 		"PUT":    http.HandlerFunc(wh.HandleContentWrite),
 		"GET":    http.HandlerFunc(rh.HandleContentGet),
@@ -287,7 +298,7 @@ func TestWriterHandlerDeleteFailsReturns503(t *testing.T) {
 func TestReadHandlerForUUID(t *testing.T) {
 	r := mux.NewRouter()
 	mr := &mockReader{payload: "Some content", returnCT: "return/type"}
-	rh := NewReaderHandler(mr)
+	rh := NewReaderHandler(mr, KeyPolicy{})
 	conceptMethodHandler := &handlers.MethodHandler{
 		"GET": http.HandlerFunc(rh.HandleContentGet),
 	}
@@ -298,7 +309,7 @@ func TestReadHandlerForUUID(t *testing.T) {
 func TestReadHandlerForUUIDAndNoContentType(t *testing.T) {
 	r := mux.NewRouter()
 	mr := &mockReader{payload: "Some content"}
-	rh := NewReaderHandler(mr)
+	rh := NewReaderHandler(mr, KeyPolicy{})
 	conceptMethodHandler := &handlers.MethodHandler{
 		"GET": http.HandlerFunc(rh.HandleContentGet),
 	}
@@ -309,7 +320,7 @@ func TestReadHandlerForUUIDAndNoContentType(t *testing.T) {
 func TestReadHandlerForUUIDNotFound(t *testing.T) {
 	r := mux.NewRouter()
 	mr := &mockReader{}
-	rh := NewReaderHandler(mr)
+	rh := NewReaderHandler(mr, KeyPolicy{})
 	conceptMethodHandler := &handlers.MethodHandler{
 		"GET": http.HandlerFunc(rh.HandleContentGet),
 	}
@@ -320,7 +331,7 @@ func TestReadHandlerForUUIDNotFound(t *testing.T) {
 func TestReadConceptHandlerForErrorFromReader(t *testing.T) {
 	r := mux.NewRouter()
 	mr := &mockReader{payload: "something came back but", returnError: errors.New("Some error from reader though")}
-	rh := NewReaderHandler(mr)
+	rh := NewReaderHandler(mr, KeyPolicy{})
 	conceptMethodHandler := &handlers.MethodHandler{
 		"GET": http.HandlerFunc(rh.HandleConceptGet),
 	}
@@ -331,7 +342,7 @@ func TestReadConceptHandlerForErrorFromReader(t *testing.T) {
 func TestReadHandlerForErrorFromReader(t *testing.T) {
 	r := mux.NewRouter()
 	mr := &mockReader{payload: "something came back but", returnError: errors.New("Some error from reader though")}
-	rh := NewReaderHandler(mr)
+	rh := NewReaderHandler(mr, KeyPolicy{})
 	conceptMethodHandler := &handlers.MethodHandler{
 		"GET": http.HandlerFunc(rh.HandleContentGet),
 	}
@@ -342,7 +353,7 @@ func TestReadHandlerForErrorFromReader(t *testing.T) {
 func TestReadHandlerForErrorReadingBody(t *testing.T) {
 	r := mux.NewRouter()
 	mr := &mockReader{rc: &mockReaderCloser{err: errors.New("Some error")}}
-	rh := NewReaderHandler(mr)
+	rh := NewReaderHandler(mr, KeyPolicy{})
 	conceptMethodHandler := &handlers.MethodHandler{
 		"GET": http.HandlerFunc(rh.HandleContentGet),
 	}
@@ -354,7 +365,7 @@ func TestReadHandlerForErrorReadingBody(t *testing.T) {
 func TestReadHandlerForMissingPublishedDate(t *testing.T) {
 	r := mux.NewRouter()
 	mr := &mockReader{payload: "Some content"}
-	rh := NewReaderHandler(mr)
+	rh := NewReaderHandler(mr, KeyPolicy{})
 	conceptMethodHandler := &handlers.MethodHandler{
 		"GET": http.HandlerFunc(rh.HandleContentGet),
 	}
@@ -437,11 +448,15 @@ type mockReader struct {
 	returnCT    string
 }
 
-func (r *mockReader) GetPublishDateForUUID(uuid string) (string, bool, error) {
+func (r *mockReader) GetPublishDateForUUID(ctx context.Context, uuid string) (string, bool, error) {
 	return "", true, nil
 }
 
-func (r *mockReader) GetContent(uuid, publishedDate string) (bool, io.ReadCloser, *string, error) {
+func (r *mockReader) EachObject(ctx context.Context, prefix string, fn func(key string) (bool, error)) error {
+	return r.returnError
+}
+
+func (r *mockReader) GetContent(ctx context.Context, uuid, publishedDate string) (bool, io.ReadCloser, *string, error) {
 	r.Lock()
 	defer r.Unlock()
 	log.Infof("Got request for uuid: %v", uuid)
@@ -459,7 +474,7 @@ func (r *mockReader) GetContent(uuid, publishedDate string) (bool, io.ReadCloser
 	return r.payload != "" || r.rc != nil, body, &r.returnCT, r.returnError
 }
 
-func (r *mockReader) processPipe() (io.PipeReader, error) {
+func (r *mockReader) processPipe() (*io.PipeReader, error) {
 	pv, pw := io.Pipe()
 	go func(p *io.PipeWriter) {
 		if r.payload != "" {
@@ -467,7 +482,7 @@ func (r *mockReader) processPipe() (io.PipeReader, error) {
 		}
 		p.Close()
 	}(pw)
-	return *pv, r.returnError
+	return pv, r.returnError
 }
 
 type mockWriter struct {
@@ -481,19 +496,33 @@ type mockWriter struct {
 	writeCalled bool
 }
 
-func (mw *mockWriter) DeleteGenericStore(key string) error {
+func (mw *mockWriter) DeleteGenericStore(ctx context.Context, key string) error {
+	mw.Lock()
+	defer mw.Unlock()
+	mw.name = key
 	return nil
 }
 
-func (mw *mockWriter) WriteGenericStore(key string, b *[]byte, ct string, tid string) error {
+func (mw *mockWriter) WriteGenericStore(ctx context.Context, key string, b *[]byte, ct string, tid string) error {
+	mw.Lock()
+	defer mw.Unlock()
+	mw.name = key
+	mw.payload = string(*b)
+	mw.writeCalled = true
 	return nil
 }
 
-func (r *mockReader) GetGenericStore(fileName string) (bool, io.ReadCloser, *string, error) {
+func (r *mockReader) GetGenericStore(ctx context.Context, fileName string) (bool, io.ReadCloser, *string, error) {
+	r.Lock()
+	defer r.Unlock()
+	r.name = fileName
+	if r.payload != "" {
+		return true, ioutil.NopCloser(strings.NewReader(r.payload)), &r.returnCT, nil
+	}
 	return true, nil, nil, nil
 }
 
-func (mw *mockWriter) DeleteConcept(fileName string) error {
+func (mw *mockWriter) DeleteConcept(ctx context.Context, fileName string) error {
 	mw.Lock()
 	defer mw.Unlock()
 	mw.name = fileName
@@ -502,7 +531,7 @@ func (mw *mockWriter) DeleteConcept(fileName string) error {
 	}
 	return mw.deleteError
 }
-func (mw *mockWriter) WriteConcept(fileName string, b *[]byte, ct string, tid string) error {
+func (mw *mockWriter) WriteConcept(ctx context.Context, fileName string, b *[]byte, ct string, tid string) error {
 	mw.Lock()
 	defer mw.Unlock()
 	mw.name = fileName
@@ -513,7 +542,7 @@ func (mw *mockWriter) WriteConcept(fileName string, b *[]byte, ct string, tid st
 	return mw.returnError
 }
 
-func (r *mockReader) GetConcept(fileName string) (bool, io.ReadCloser, *string, error) {
+func (r *mockReader) GetConcept(ctx context.Context, fileName string) (bool, io.ReadCloser, *string, error) {
 	r.Lock()
 	defer r.Unlock()
 	log.Infof("Got request for fileName: %v", fileName)
@@ -531,7 +560,7 @@ func (r *mockReader) GetConcept(fileName string) (bool, io.ReadCloser, *string,
 	return true, body, &r.returnCT, r.returnError
 }
 
-func (mw *mockWriter) DeleteContent(uuid, publishedDate string) error {
+func (mw *mockWriter) DeleteContent(ctx context.Context, uuid, publishedDate string) error {
 	mw.Lock()
 	defer mw.Unlock()
 	mw.name = uuid
@@ -541,7 +570,7 @@ func (mw *mockWriter) DeleteContent(uuid, publishedDate string) error {
 	return mw.deleteError
 }
 
-func (mw *mockWriter) WriteContent(uuid, publishedDate string, b *[]byte, ct string, tid string) error {
+func (mw *mockWriter) WriteContent(ctx context.Context, uuid, publishedDate string, b *[]byte, ct string, tid string) error {
 	mw.Lock()
 	defer mw.Unlock()
 	mw.name = uuid
@@ -555,3 +584,143 @@ func (mw *mockWriter) WriteContent(uuid, publishedDate string, b *[]byte, ct str
 func withExpectedResourcePath(endpoint string) string {
 	return "/" + ExpectedResourcePath + endpoint
 }
+
+func TestRequestTimeoutHeader(t *testing.T) {
+	var deadline time.Time
+	var hasDeadline bool
+	h := WithRequestTimeout(time.Minute, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		deadline, hasDeadline = r.Context().Deadline()
+	}))
+
+	t.Run("No header", func(t *testing.T) {
+		hasDeadline = false
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, newRequest("GET", "/", ""))
+		assert.Equal(t, 200, rec.Code)
+		assert.False(t, hasDeadline)
+	})
+
+	t.Run("Seconds", func(t *testing.T) {
+		req := newRequest("GET", "/", "")
+		req.Header.Set(RequestTimeoutHeader, "5")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		assert.True(t, hasDeadline)
+		assert.WithinDuration(t, time.Now().Add(5*time.Second), deadline, time.Second)
+	})
+
+	t.Run("Capped at maximum", func(t *testing.T) {
+		req := newRequest("GET", "/", "")
+		req.Header.Set(RequestTimeoutHeader, "2h")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		assert.True(t, hasDeadline)
+		assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		req := newRequest("GET", "/", "")
+		req.Header.Set(RequestTimeoutHeader, "soon")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, 400, rec.Code)
+	})
+}
+
+func TestBodyPolicy(t *testing.T) {
+	r := mux.NewRouter()
+	mw := &mockWriter{}
+	mr := &mockReader{}
+	wh := NewWriterHandler(mw, mr, KeyPolicy{})
+	policy := BodyPolicy{MaxBytes: 16, AllowedContentTypes: []string{"application/json", "text/*"}}
+	conceptMethodHandler := &handlers.MethodHandler{
+		"PUT": WithBodyPolicy(policy, http.HandlerFunc(wh.HandleConceptWrite)),
+	}
+	Handlers(r, conceptMethodHandler, ExpectedResourcePath, "/{filename}")
+
+	t.Run("Within limits", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, newRequest("PUT", withExpectedResourcePath("/organisations"), "{}"))
+		assert.Equal(t, 200, rec.Code)
+		assert.Equal(t, "{}", mw.payload)
+	})
+
+	t.Run("Declared length too large", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, newRequest("PUT", withExpectedResourcePath("/organisations"), strings.Repeat("a", 17)))
+		assert.Equal(t, 413, rec.Code)
+		assert.Equal(t, "{\"message\":\"Request body exceeds the limit of 16 bytes.\"}", rec.Body.String())
+	})
+
+	t.Run("Streamed body too large", func(t *testing.T) {
+		req := newRequest("PUT", withExpectedResourcePath("/organisations"), strings.Repeat("a", 17))
+		req.ContentLength = -1
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		assert.Equal(t, 413, rec.Code)
+	})
+
+	t.Run("Content type not allowed", func(t *testing.T) {
+		req := newRequest("PUT", withExpectedResourcePath("/organisations"), "PAYLOAD")
+		req.Header.Set("Content-Type", "application/zip")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		assert.Equal(t, 415, rec.Code)
+	})
+
+	t.Run("Content type with quotes not allowed", func(t *testing.T) {
+		req := newRequest("PUT", withExpectedResourcePath("/organisations"), "PAYLOAD")
+		req.Header.Set("Content-Type", `application/zip; name="a\"b"`)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		assert.Equal(t, 415, rec.Code)
+		var body map[string]string
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		assert.Contains(t, body["message"], `name="a\"b"`)
+	})
+
+	t.Run("Sniffed content type", func(t *testing.T) {
+		req := newRequest("PUT", withExpectedResourcePath("/organisations"), "plain text")
+		req.Header.Del("Content-Type")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		assert.Equal(t, 200, rec.Code)
+		assert.Equal(t, "text/plain; charset=utf-8", mw.ct)
+		assert.Equal(t, "plain text", mw.payload)
+	})
+
+	t.Run("Sniffed content type not allowed", func(t *testing.T) {
+		req := newRequest("PUT", withExpectedResourcePath("/organisations"), "\x89PNG\x0D\x0A\x1A\x0A")
+		req.Header.Del("Content-Type")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		assert.Equal(t, 415, rec.Code)
+	})
+}
+
+func TestWithWriteDeadlineOutlastsWriteTimeout(t *testing.T) {
+	slow := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		rw.Write([]byte("copied"))
+	})
+	for _, tc := range []struct {
+		handler http.Handler
+		ok      bool
+	}{
+		{slow, false},
+		{WithWriteDeadline(time.Second, slow), true},
+		{monitoringHandler(WithWriteDeadline(time.Second, slow)), true},
+	} {
+		srv := httptest.NewUnstartedServer(tc.handler)
+		srv.Config.WriteTimeout = 50 * time.Millisecond
+		srv.Start()
+		resp, err := http.Get(srv.URL)
+		if err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "copied" {
+				err = errors.New("truncated response")
+			}
+		}
+		assert.Equal(t, tc.ok, err == nil, "%v", err)
+		srv.Close()
+	}
+}
@@ -0,0 +1,316 @@
+package service
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	transactionid "github.com/Financial-Times/transactionid-utils-go"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	log "github.com/sirupsen/logrus"
+)
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// ImportResult is the outcome of importing one foreign object into our bucket.
+type ImportResult struct {
+	Key    string `json:"key"`
+	Target string `json:"target"`
+	OK     bool   `json:"ok"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Verified names the checksum the object was verified against, "sha256" or "md5", and is empty when the foreign
+	// bucket offers neither, as for multipart uploads without additional checksums or KMS encrypted objects.
+	Verified string `json:"verified,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// importProgress is one line of the report streamed while importing a prefix.
+type importProgress struct {
+	Result   *ImportResult `json:"result,omitempty"`
+	Done     int           `json:"done"`
+	Failed   int           `json:"failed"`
+	Total    int           `json:"total"`
+	Finished bool          `json:"finished,omitempty"`
+}
+
+// importSpec says where imported objects go in our bucket: into the generic store or the concept store,
+// under 'target' or else under the key or prefix they were read from.
+type importSpec struct {
+	into   string
+	base   string
+	prefix bool
+}
+
+func parseImportSpec(q url.Values) (importSpec, error) {
+	spec := importSpec{into: q.Get("into"), base: q.Get("target")}
+	switch spec.into {
+	case "":
+		spec.into = RouteGroupGeneric
+	case RouteGroupGeneric, RouteGroupConcept:
+	default:
+		return spec, fmt.Errorf("invalid into %q, expected %q or %q", spec.into, RouteGroupGeneric, RouteGroupConcept)
+	}
+	key, prefix := q.Get("key"), q.Get("prefix")
+	if (key == "") == (prefix == "") {
+		return spec, errors.New("exactly one of 'key' or 'prefix' is required")
+	}
+	spec.prefix = prefix != ""
+	if spec.base == "" {
+		spec.base = key + prefix
+	}
+	return spec, nil
+}
+
+// name is the generic store key or concept file name of an imported object, rel being its key relative to the
+// imported prefix.
+func (s importSpec) name(rel string) string {
+	name := s.base + rel
+	if s.into == RouteGroupConcept {
+		return path.Base(name)
+	}
+	return name
+}
+
+// checkName rejects names that can't be used in the store the import goes to, generic store keys being held to keys.
+func (s importSpec) checkName(name string, keys KeyPolicy) error {
+	if s.into == RouteGroupConcept {
+		return CheckFileName(name)
+	}
+	return keys.Check(name)
+}
+
+// authzKey is what the import writes to, for the authorization policy. Concepts imported from a prefix get
+// file names that can't be told in advance, so they need the whole concept store.
+func (s importSpec) authzKey() string {
+	if s.into == RouteGroupConcept && s.prefix {
+		return RouteGroupConcept + "/"
+	}
+	return s.into + "/" + s.name("")
+}
+
+func (c *ForeignCopier) importKey(into, name string) string {
+	if into == RouteGroupConcept {
+		return getConceptKey(c.conceptPrefix, name)
+	}
+	return name
+}
+
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// Import streams foreignKey from the target bucket to key in our bucket, verifying it against the checksum the
+// foreign bucket reports. The object is staged under a key of its own until it is verified, so that an object that
+// doesn't match, for which errChecksumMismatch is returned, never replaces what is already at key.
+func (c *ForeignCopier) Import(ctx context.Context, t ForeignTarget, foreignKey, key, tid string) (ImportResult, error) {
+	ctx, cancel := withTimeout(ctx, c.foreigner.timeouts.Copy)
+	defer cancel()
+	res := ImportResult{Key: foreignKey, Target: key}
+
+	src, err := c.foreigner.client(ctx, t)
+	if err != nil {
+		return res, err
+	}
+	resp, err := src.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:       aws.String(src.bucketName),
+		Key:          aws.String(foreignKey),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if isNotFound(err) {
+		return res, errSourceNotFound
+	}
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+
+	id, err := newJobID()
+	if err != nil {
+		return res, err
+	}
+	staged := path.Join(c.stagingPrefix, id)
+	defer func() {
+		if err := c.source.Delete(context.WithoutCancel(ctx), staged); err != nil {
+			log.WithError(err).WithField("key", staged).Error("Failed to delete staged import")
+		}
+	}()
+
+	md5h, sha256h := md5.New(), sha256.New()
+	var n byteCounter
+	ct := aws.ToString(resp.ContentType)
+	body := io.TeeReader(resp.Body, io.MultiWriter(md5h, sha256h, &n))
+	if err = c.source.WriteStream(ctx, staged, body, c.partSize, ct, tid); err != nil {
+		return res, err
+	}
+	res.Size = int64(n)
+	res.SHA256 = hex.EncodeToString(sha256h.Sum(nil))
+
+	if res.Verified, err = verifyChecksum(resp, int64(n), md5h.Sum(nil), sha256h.Sum(nil)); err != nil {
+		return res, err
+	}
+	if err = c.promote(ctx, staged, key, res.Size, ct, tid); err != nil {
+		return res, err
+	}
+	res.OK = true
+	log.WithFields(log.Fields{"bucketName": t.Bucket, "foreignKey": foreignKey, "key": key, "verified": res.Verified, transactionid.TransactionIDKey: tid}).Info("Imported foreign object")
+	return res, nil
+}
+
+// promote copies a verified staged import to its key, server side unless it is too large for a single CopyObject.
+func (c *ForeignCopier) promote(ctx context.Context, staged, key string, size int64, ct, tid string) error {
+	if size <= maxCopyObjectSize {
+		return c.source.CopyFrom(ctx, c.source.bucketName, staged, key, ct, tid)
+	}
+	found, body, _, err := c.source.Get(ctx, staged)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("staged import %s is missing", staged)
+	}
+	defer body.Close()
+	return c.source.WriteStream(ctx, key, body, c.partSize, ct, tid)
+}
+
+// verifyChecksum compares what was read with the SHA-256 checksum of the object, when it was uploaded with one,
+// or else with its ETag, which is the MD5 of the object only for single part uploads that aren't KMS or SSE-C encrypted.
+func verifyChecksum(resp *s3.GetObjectOutput, n int64, md5sum, sha256sum []byte) (string, error) {
+	if resp.ContentLength != nil && *resp.ContentLength != n {
+		return "", fmt.Errorf("%w: read %d of %d bytes", errChecksumMismatch, n, *resp.ContentLength)
+	}
+	if want := aws.ToString(resp.ChecksumSHA256); want != "" && !strings.Contains(want, "-") {
+		if got := base64.StdEncoding.EncodeToString(sha256sum); got != want {
+			return "", fmt.Errorf("%w: SHA-256 is %s, expected %s", errChecksumMismatch, got, want)
+		}
+		return "sha256", nil
+	}
+	etag := strings.Trim(aws.ToString(resp.ETag), `"`)
+	if len(etag) != md5.Size*2 || resp.ServerSideEncryption == types.ServerSideEncryptionAwsKms || resp.SSECustomerAlgorithm != nil {
+		return "", nil
+	}
+	if got := hex.EncodeToString(md5sum); got != etag {
+		return "", fmt.Errorf("%w: MD5 is %s, expected ETag %s", errChecksumMismatch, got, etag)
+	}
+	return "md5", nil
+}
+
+// HandleForeignerImport reads the object at 'key', or every object under 'prefix', from the foreign bucket and
+// stores it in our generic store or, with 'into=concept', our concept store. A single object is answered with its
+// result, a prefix with a stream of newline delimited JSON reporting the progress after every object.
+func (h *ForeignerHandler) HandleForeignerImport(rw http.ResponseWriter, r *http.Request) {
+	spec, err := parseImportSpec(r.URL.Query())
+	if err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return
+	}
+	keyParam := "key"
+	if spec.prefix {
+		keyParam = "prefix"
+	}
+	target, foreignKey, ok := h.targetRequest(rw, r, keyParam)
+	if !ok {
+		return
+	}
+	tid := transactionid.GetTransactionIDFromRequest(r)
+	ctx := transactionid.TransactionAwareContext(r.Context(), tid)
+
+	if !spec.prefix {
+		name := spec.name("")
+		if err := spec.checkName(name, h.copier.keys); err != nil {
+			respondWithBadRequest(rw, err.Error())
+			return
+		}
+		res, err := h.copier.Import(ctx, target, foreignKey, h.copier.importKey(spec.into, name), tid)
+		switch {
+		case errors.Is(err, errSourceNotFound):
+			respondSourceNotFound(rw)
+		case errors.Is(err, errChecksumMismatch):
+			log.WithError(err).WithField("bucketName", target.Bucket).Error("Imported object doesn't match its checksum")
+			res.Error = err.Error()
+			respondJSON(rw, http.StatusBadGateway, res)
+		case err != nil:
+			foreignerServiceUnavailable(target.Bucket, err, rw)
+		default:
+			respondJSON(rw, http.StatusCreated, res)
+		}
+		return
+	}
+
+	var keys []string
+	s3c, err := h.foreigner.client(ctx, target)
+	if err == nil {
+		err = s3c.EachObject(ctx, foreignKey, func(key string) (bool, error) {
+			keys = append(keys, key)
+			return true, nil
+		})
+	}
+	if err != nil {
+		foreignerServiceUnavailable(target.Bucket, err, rw)
+		return
+	}
+	if len(keys) == 0 {
+		respondSourceNotFound(rw)
+		return
+	}
+	// Every name is checked before anything is imported. Concepts are named after the last segment of their key,
+	// so two keys of the prefix may end up with the same name, and the second would silently replace the first.
+	names := make([]string, len(keys))
+	imported := make(map[string]string, len(keys))
+	for i, key := range keys {
+		names[i] = spec.name(strings.TrimPrefix(key, foreignKey))
+		if err := spec.checkName(names[i], h.copier.keys); err != nil {
+			respondWithBadRequest(rw, fmt.Sprintf("%s can't be imported: %s", key, err))
+			return
+		}
+		if other, found := imported[names[i]]; found {
+			respondWithBadRequest(rw, fmt.Sprintf("%s and %s would both be imported as %s", other, key, names[i]))
+			return
+		}
+		imported[names[i]] = key
+	}
+
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	rw.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(rw)
+	flusher, _ := rw.(http.Flusher)
+	progress := importProgress{Total: len(keys)}
+	for i, key := range keys {
+		res, err := h.copier.Import(ctx, target, key, h.copier.importKey(spec.into, names[i]), tid)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{"bucketName": target.Bucket, "foreignKey": key}).Error("Failed to import foreign object")
+			res.Error = err.Error()
+			progress.Failed++
+		}
+		progress.Done++
+		progress.Result = &res
+		// A client that can't be told about the progress has gone, so the rest of the prefix isn't imported.
+		if err := enc.Encode(progress); err != nil {
+			log.WithError(err).WithFields(log.Fields{"bucketName": target.Bucket, "done": progress.Done, "total": progress.Total}).Error("Stopped import after failing to report its progress")
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	progress.Result = nil
+	progress.Finished = true
+	if err := enc.Encode(progress); err != nil {
+		log.WithError(err).WithField("bucketName", target.Bucket).Error("Failed to report the end of an import")
+	}
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	transactionid "github.com/Financial-Times/transactionid-utils-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func md5ETag(s string) string {
+	sum := md5.Sum([]byte(s))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func TestHandleForeignerImport(t *testing.T) {
+	fake, srv := newFakeS3(map[string]string{
+		"partner-bucket/incoming/a.json":        "PARTNER-A",
+		"partner-bucket/incoming/people/b.json": "PARTNER-B",
+		"partner-bucket/incoming/corrupt.json":  "CORRUPTED",
+	})
+	defer srv.Close()
+	fake.etags["partner-bucket/incoming/a.json"] = md5ETag("PARTNER-A")
+	fake.etags["partner-bucket/incoming/corrupt.json"] = md5ETag("ORIGINAL")
+	h := newTestCopierHandler(srv.URL)
+	query := "/foreign/import?region=eu-west-1&bucket=partner-bucket&role=" + destinationRole
+
+	rec := httptest.NewRecorder()
+	req := newRequest("PUT", query+"&key=incoming/a.json", "")
+	req.Header.Set(transactionid.TransactionIDHeader, "tid_import")
+	h.HandleForeignerImport(rec, req)
+	assert.Equal(t, 201, rec.Code)
+	var res ImportResult
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, ImportResult{Key: "incoming/a.json", Target: "incoming/a.json", OK: true, Size: 9, SHA256: sha256Hex("PARTNER-A"), Verified: "md5"}, res)
+	assert.Equal(t, "PARTNER-A", fake.objects["our-bucket/incoming/a.json"])
+	assert.Equal(t, "tid_import", fake.headers["our-bucket/incoming/a.json"].Get("X-Amz-Meta-Transaction_id"), "the transaction id is kept")
+
+	rec = httptest.NewRecorder()
+	h.HandleForeignerImport(rec, newRequest("PUT", query+"&key=incoming/people/b.json&into=concept&target=people.json", ""))
+	assert.Equal(t, 201, rec.Code)
+	assert.Equal(t, "PARTNER-B", fake.objects["our-bucket/concept/people.json"])
+
+	rec = httptest.NewRecorder()
+	h.HandleForeignerImport(rec, newRequest("PUT", query+"&key=incoming/corrupt.json", ""))
+	assert.Equal(t, 502, rec.Code)
+	assert.NotContains(t, fake.objects, "our-bucket/incoming/corrupt.json", "an object that doesn't match is not kept")
+
+	fake.objects["our-bucket/incoming/corrupt.json"] = "PREVIOUS"
+	rec = httptest.NewRecorder()
+	h.HandleForeignerImport(rec, newRequest("PUT", query+"&key=incoming/corrupt.json", ""))
+	assert.Equal(t, 502, rec.Code)
+	assert.Equal(t, "PREVIOUS", fake.objects["our-bucket/incoming/corrupt.json"], "an object that doesn't match doesn't replace the one there")
+	for key := range fake.objects {
+		assert.NotContains(t, key, "foreign-import-staging/", "staged imports are removed")
+	}
+
+	for params, expected := range map[string]int{
+		"&key=incoming/missing.json":                 404,
+		"":                                           400,
+		"&key=incoming/a.json&prefix=incoming/":      400,
+		"&key=incoming/a.json&into=content":          400,
+		"&prefix=nothing/":                           404,
+		"&key=incoming/a.json&target=a/../b":         400,
+		"&key=incoming/a.json&target=content/a.json": 400,
+		"&key=incoming/a.json&target=foreign-queue/pending/x.json": 400,
+		"&key=incoming/a.json&target=foreign-import-staging/x":     400,
+		"&key=incoming/a.json&destination=partner-archive":         400,
+	} {
+		rec = httptest.NewRecorder()
+		h.HandleForeignerImport(rec, newRequest("PUT", query+params, ""))
+		assert.Equal(t, expected, rec.Code, params)
+	}
+}
+
+func TestHandleForeignerImportPrefix(t *testing.T) {
+	fake, srv := newFakeS3(map[string]string{
+		"partner-bucket/incoming/a.json":       "PARTNER-A",
+		"partner-bucket/incoming/b.json":       "PARTNER-B",
+		"partner-bucket/incoming/corrupt.json": "CORRUPTED",
+	})
+	defer srv.Close()
+	fake.etags["partner-bucket/incoming/corrupt.json"] = md5ETag("ORIGINAL")
+	h := newTestCopierHandler(srv.URL)
+
+	rec := httptest.NewRecorder()
+	h.HandleForeignerImport(rec, newRequest("PUT", "/foreign/import?region=eu-west-1&bucket=partner-bucket&role="+destinationRole+"&prefix=incoming/&target=imports/2017/", ""))
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+
+	var lines []importProgress
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var p importProgress
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &p))
+		lines = append(lines, p)
+	}
+	assert.Len(t, lines, 4, "a line per object and a final one")
+	for i, p := range lines[:3] {
+		assert.Equal(t, i+1, p.Done)
+		assert.Equal(t, 3, p.Total)
+	}
+	last := lines[3]
+	assert.True(t, last.Finished)
+	assert.Nil(t, last.Result)
+	assert.Equal(t, 3, last.Done)
+	assert.Equal(t, 1, last.Failed)
+
+	assert.Equal(t, "PARTNER-A", fake.objects["our-bucket/imports/2017/a.json"])
+	assert.Equal(t, "PARTNER-B", fake.objects["our-bucket/imports/2017/b.json"])
+	assert.NotContains(t, fake.objects, "our-bucket/imports/2017/corrupt.json")
+}
+
+func TestHandleForeignerImportRejectsConceptCollisions(t *testing.T) {
+	fake, srv := newFakeS3(map[string]string{
+		"partner-bucket/incoming/2017/people.json": "PEOPLE-2017",
+		"partner-bucket/incoming/2018/people.json": "PEOPLE-2018",
+	})
+	defer srv.Close()
+	h := newTestCopierHandler(srv.URL)
+
+	rec := httptest.NewRecorder()
+	h.HandleForeignerImport(rec, newRequest("PUT", "/foreign/import?region=eu-west-1&bucket=partner-bucket&role="+destinationRole+"&prefix=incoming/&into=concept", ""))
+	assert.Equal(t, 400, rec.Code)
+	assert.Contains(t, rec.Body.String(), "people.json")
+	assert.NotContains(t, fake.objects, "our-bucket/concept/people.json", "nothing is imported when names collide")
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// MaxKeyLength is the longest key S3 accepts, in bytes.
+const MaxKeyLength = 1024
+
+// CheckKey reports why key can't be used as a generic store key. Keys may have several '/' separated segments,
+// but no empty, '.' or '..' segments, with '\' counted as a separator too, and no control characters.
+func CheckKey(key string) error {
+	switch {
+	case key == "":
+		return errors.New("empty key")
+	case len(key) > MaxKeyLength:
+		return fmt.Errorf("key is %d bytes long, the most is %d", len(key), MaxKeyLength)
+	case !utf8.ValidString(key):
+		return fmt.Errorf("key %q isn't valid UTF-8", key)
+	case strings.IndexFunc(key, unicode.IsControl) >= 0:
+		return fmt.Errorf("key %q has control characters", key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" {
+			return fmt.Errorf("key %q has an empty segment", key)
+		}
+		for _, part := range strings.Split(segment, "\\") {
+			if part == "." || part == ".." {
+				return fmt.Errorf("key %q has a %q segment", key, part)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckFileName is CheckKey for names of a single segment, like concept file names.
+func CheckFileName(name string) error {
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("file name %q has a '/'", name)
+	}
+	return CheckKey(name)
+}
+
+// KeyPolicy holds generic store keys to CheckKey and keeps them out of the prefixes our bucket holds the objects
+// of the service itself under, like content, concepts and the foreign queue spool, which the generic store could
+// otherwise read and overwrite. The zero KeyPolicy reserves nothing.
+type KeyPolicy struct {
+	reserved []string
+}
+
+// NewKeyPolicy reserves the given prefixes of our bucket. Empty prefixes are ignored.
+func NewKeyPolicy(reserved ...string) KeyPolicy {
+	var p KeyPolicy
+	for _, prefix := range reserved {
+		if prefix = strings.Trim(prefix, "/"); prefix != "" {
+			p.reserved = append(p.reserved, prefix)
+		}
+	}
+	return p
+}
+
+// Check reports why key can't be used as a generic store key.
+func (p KeyPolicy) Check(key string) error {
+	if err := CheckKey(key); err != nil {
+		return err
+	}
+	for _, prefix := range p.reserved {
+		if key == prefix || strings.HasPrefix(key, prefix+"/") {
+			return fmt.Errorf("key %q is under %s/, which is reserved", key, prefix)
+		}
+	}
+	return nil
+}
+
+// CheckPrefix reports why prefix can't be listed as a prefix of generic store keys. Besides not being under a
+// reserved prefix, it must not take one in, as "cont" would take in "content/".
+func (p KeyPolicy) CheckPrefix(prefix string) error {
+	if err := CheckKey(strings.TrimSuffix(prefix, "/")); err != nil {
+		return err
+	}
+	for _, reserved := range p.reserved {
+		if strings.HasPrefix(reserved+"/", prefix) || strings.HasPrefix(prefix, reserved+"/") {
+			return fmt.Errorf("prefix %q takes in %s/, which is reserved", prefix, reserved)
+		}
+	}
+	return nil
+}
+
+// CheckPost is Check for the key of a presigned POST, which may also be a prefix ending in '/'.
+func (p KeyPolicy) CheckPost(key string) error {
+	return p.Check(strings.TrimSuffix(key, "/"))
+}
+
+// requestKey is the generic store key of a request: the 'key' variable of its route or, for routes without one,
+// the last segment of the path. Routes are matched against the escaped path, so that '%2F' is not taken for a
+// separator, and the key is unescaped exactly once.
+func (p KeyPolicy) requestKey(r *http.Request) (string, error) {
+	key, err := unescapeRequestKey(r)
+	if err != nil {
+		return "", err
+	}
+	return key, p.Check(key)
+}
+
+// unescapeRequestKey is requestKey without the checks, for keys held to other rules.
+func unescapeRequestKey(r *http.Request) (string, error) {
+	escaped, ok := mux.Vars(r)["key"]
+	if !ok {
+		escaped = getFileName(r.URL.EscapedPath())
+	}
+	key, err := url.PathUnescape(escaped)
+	if err != nil {
+		return "", fmt.Errorf("key %q is not properly escaped", escaped)
+	}
+	return key, nil
+}
+
+// requestFileName is the file name in the last segment of the path of a request.
+func requestFileName(r *http.Request) (string, error) {
+	escaped := getFileName(r.URL.EscapedPath())
+	name, err := url.PathUnescape(escaped)
+	if err != nil {
+		return "", fmt.Errorf("file name %q is not properly escaped", escaped)
+	}
+	return name, CheckFileName(name)
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckKey(t *testing.T) {
+	for _, key := range []string{"a.zip", "folder/sub/file.zip", "reports-*", "with space/ünïcode.json", strings.Repeat("a", MaxKeyLength)} {
+		assert.NoError(t, CheckKey(key), key)
+	}
+	for _, key := range []string{
+		"",
+		"/leading",
+		"trailing/",
+		"double//slash",
+		"../escape",
+		"folder/../escape",
+		"folder/./file",
+		"folder\\..\\escape",
+		"new\nline",
+		"tab\there",
+		"nul\x00",
+		"bad\xffutf8",
+		strings.Repeat("a", MaxKeyLength+1),
+	} {
+		assert.Error(t, CheckKey(key), "%q", key)
+	}
+	assert.NoError(t, CheckFileName("people.json"))
+	assert.Error(t, CheckFileName("folder/people.json"))
+}
+
+func TestKeyPolicyReservesPrefixes(t *testing.T) {
+	keys := NewKeyPolicy("content", "/concept/", "", "foreign-queue")
+	for _, key := range []string{"a.zip", "contents/a.zip", "folder/content/a.zip", "concept-notes.txt"} {
+		assert.NoError(t, keys.Check(key), key)
+	}
+	for _, key := range []string{"content", "content/a.json", "concept/people.json", "foreign-queue/pending/a.json", "../content"} {
+		assert.Error(t, keys.Check(key), key)
+	}
+	assert.NoError(t, keys.CheckPost("uploads/"))
+	assert.Error(t, keys.CheckPost("foreign-queue/"))
+	assert.NoError(t, KeyPolicy{}.Check("content/a.json"), "the zero policy reserves nothing")
+}
+
+// newServerRequest is newRequest as a server would receive it, with the escaped request URI the router matches.
+func newServerRequest(method, uri, body string) *http.Request {
+	req := newRequest(method, uri, body)
+	req.RequestURI = uri
+	return req
+}
+
+func TestGenericStoreHierarchicalKeys(t *testing.T) {
+	mw := &mockWriter{}
+	mr := &mockReader{payload: "ZIP"}
+	wh := NewWriterHandler(mw, mr, KeyPolicy{})
+	rh := NewReaderHandler(mr, KeyPolicy{})
+	r := mux.NewRouter().UseEncodedPath()
+	Handlers(r, &handlers.MethodHandler{
+		"PUT":    http.HandlerFunc(wh.HandleGenericStoreWrite),
+		"GET":    http.HandlerFunc(rh.HandleGenericStoreGet),
+		"DELETE": http.HandlerFunc(wh.HandleGenericStoreDelete),
+	}, "generic", "/{key:.+}")
+	Handlers(r, &handlers.MethodHandler{
+		"PUT": http.HandlerFunc(wh.HandleConceptWrite),
+	}, "concept", "/{fileName}")
+
+	serve := func(method, uri string) int {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, newServerRequest(method, uri, "PAYLOAD"))
+		return rec.Code
+	}
+
+	assert.Equal(t, 200, serve("PUT", "/generic/folder/sub/file.zip"))
+	assert.Equal(t, "folder/sub/file.zip", mw.name)
+	assert.Equal(t, "PAYLOAD", mw.payload)
+	assert.Equal(t, 200, serve("GET", "/generic/folder/sub/file.zip"))
+	assert.Equal(t, "folder/sub/file.zip", mr.name)
+	assert.Equal(t, 204, serve("DELETE", "/generic/folder/sub/file.zip"))
+	assert.Equal(t, "folder/sub/file.zip", mw.name)
+
+	assert.Equal(t, 200, serve("PUT", "/generic/folder/with%20space%2520.zip"))
+	assert.Equal(t, "folder/with space%20.zip", mw.name, "keys are unescaped exactly once")
+	assert.Equal(t, 200, serve("GET", "/generic/a%2Fb.zip"))
+	assert.Equal(t, "a/b.zip", mr.name)
+
+	mw.writeCalled = false
+	for _, uri := range []string{
+		"/generic/folder/%2E%2E/escape",
+		"/generic/folder%2F..%2Fescape",
+		"/generic/new%0Aline",
+		"/generic/" + strings.Repeat("a", MaxKeyLength+1),
+		"/concept/folder%2Fpeople.json",
+	} {
+		assert.Equal(t, 400, serve("PUT", uri), uri)
+	}
+	// A server takes a request URI that doesn't unescape, which http.NewRequest refuses.
+	req := newServerRequest("PUT", "/generic/bad", "PAYLOAD")
+	req.RequestURI = "/generic/bad%zzescape"
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, 400, rec.Code)
+	assert.False(t, mw.writeCalled, "nothing is written for a rejected key")
+	assert.Equal(t, 400, serve("GET", "/generic/folder/%2E%2E/escape"))
+	assert.Equal(t, 400, serve("DELETE", "/generic/folder/%2E%2E/escape"))
+
+	wh.keys = NewKeyPolicy("content", "foreign-queue")
+	rh.keys = wh.keys
+	for _, uri := range []string{"/generic/content/a_2017-10-10.json", "/generic/foreign-queue/payloads/abc", "/generic/content%2Fa.json"} {
+		for _, method := range []string{"PUT", "GET", "DELETE"} {
+			assert.Equal(t, 400, serve(method, uri), method+" "+uri)
+		}
+	}
+	assert.False(t, mw.writeCalled, "nothing is written under a reserved prefix")
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	transactionid "github.com/Financial-Times/transactionid-utils-go"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/smithy-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const preflightProbePrefix = "upp-exports-rw-s3-preflight-"
+
+// PreflightStep is the outcome of one check made against a foreign destination.
+type PreflightStep struct {
+	Step       string `json:"step"`
+	Role       string `json:"role,omitempty"`
+	Key        string `json:"key,omitempty"`
+	OK         bool   `json:"ok"`
+	ErrorCode  string `json:"errorCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// PreflightReport lists the checks in the order they ran. Checks stop at the first failure.
+type PreflightReport struct {
+	Bucket string          `json:"bucket"`
+	Region string          `json:"region,omitempty"`
+	OK     bool            `json:"ok"`
+	Steps  []PreflightStep `json:"steps"`
+}
+
+func (r *PreflightReport) run(step PreflightStep, check func() error) bool {
+	start := time.Now()
+	err := check()
+	step.DurationMs = time.Since(start).Milliseconds()
+	step.OK = err == nil
+	if err != nil {
+		step.Error = err.Error()
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			step.ErrorCode = apiErr.ErrorCode()
+		}
+	}
+	r.Steps = append(r.Steps, step)
+	return step.OK
+}
+
+// Preflight assumes every hop of the role chain afresh, bypassing the credentials cache, then checks the bucket
+// with HeadBucket and, when probe is set, writes and deletes a small probe object under prefix with the target's
+// upload options. It reports where the first failure happened rather than returning it.
+func (f *Foreigner) Preflight(ctx context.Context, t ForeignTarget, prefix string, probe bool) PreflightReport {
+	report := PreflightReport{Bucket: t.Bucket, Region: t.Region}
+	cfg, err := f.loadConfig(ctx, t.Region)
+	if !report.run(PreflightStep{Step: "load-config"}, func() error { return err }) {
+		return report
+	}
+
+	// Every hop is assumed right away, so that the report shows which one fails.
+	fc, err := f.newClient(cfg, t, func(role string, assume aws.CredentialsProvider) (aws.CredentialsProvider, error) {
+		var creds aws.Credentials
+		var err error
+		report.run(PreflightStep{Step: "assume-role", Role: role}, func() error {
+			ctx, cancel := withTimeout(ctx, f.timeouts.AssumeRole)
+			defer cancel()
+			creds, err = assume.Retrieve(ctx)
+			return err
+		})
+		return aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return creds, nil
+		}), err
+	})
+	if err != nil {
+		return report
+	}
+
+	c := NewS3Client2(fc.client, t.Bucket, f.timeouts).WithUploadOptions(t.Options)
+	headed := report.run(PreflightStep{Step: "head-bucket"}, func() error { return c.HeadBucket(ctx) })
+	if !headed || !probe {
+		report.OK = headed
+		return report
+	}
+
+	tid, _ := transactionid.GetTransactionIDFromContext(ctx)
+	probeKey := prefix + preflightProbePrefix + roleSessionName(tid)
+	body := []byte("preflight")
+	if !report.run(PreflightStep{Step: "write-probe", Key: probeKey}, func() error {
+		return c.Write(ctx, probeKey, &body, "text/plain", tid)
+	}) {
+		return report
+	}
+	report.OK = report.run(PreflightStep{Step: "delete-probe", Key: probeKey}, func() error {
+		return c.Delete(ctx, probeKey)
+	})
+	return report
+}
+
+// HandleForeignerPreflight checks a destination, given either by name in the 'destination' query param or by the
+// usual query params. A GET only reads, while a POST also writes a probe object under 'prefix'.
+func (h *ForeignerHandler) HandleForeignerPreflight(rw http.ResponseWriter, r *http.Request) {
+	target, prefix, ok := h.targetRequest(rw, r, "prefix")
+	if !ok {
+		return
+	}
+
+	report := h.foreigner.Preflight(foreignContext(r), target, prefix, r.Method == http.MethodPost)
+	if !report.OK {
+		log.WithField("bucketName", target.Bucket).WithField("failedStep", report.Steps[len(report.Steps)-1].Step).Warn("Foreign destination failed preflight")
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(report)
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	transactionid "github.com/Financial-Times/transactionid-utils-go"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func preflightSteps(report PreflightReport) []string {
+	var steps []string
+	for _, s := range report.Steps {
+		steps = append(steps, s.Step)
+	}
+	return steps
+}
+
+func TestForeignerPreflight(t *testing.T) {
+	fake, srv := newFakeS3(map[string]string{})
+	defer srv.Close()
+	f := newFakeS3Foreigner(srv.URL)
+	ctx := transactionid.TransactionAwareContext(context.Background(), "tid_preflight")
+	target := ForeignTarget{Region: "eu-west-1", Bucket: "partner-bucket", Roles: []string{exporterRole, destinationRole}}
+
+	report := f.Preflight(ctx, target, "exports/", false)
+	assert.True(t, report.OK)
+	assert.Equal(t, []string{"load-config", "assume-role", "assume-role", "head-bucket"}, preflightSteps(report), "nothing is written without a probe")
+
+	report = f.Preflight(ctx, target, "exports/", true)
+	assert.True(t, report.OK)
+	assert.Equal(t, []string{"load-config", "assume-role", "assume-role", "head-bucket", "write-probe", "delete-probe"}, preflightSteps(report))
+	assert.Equal(t, "exports/upp-exports-rw-s3-preflight-tid_preflight", report.Steps[4].Key)
+	assert.Empty(t, fake.objects, "the probe is deleted")
+	assert.Empty(t, f.clients, "preflight bypasses the credentials cache")
+}
+
+func TestForeignerPreflightReportsFailingHop(t *testing.T) {
+	_, srv := newFakeS3(map[string]string{})
+	defer srv.Close()
+	f := newFakeS3Foreigner(srv.URL)
+	f.newSTSClient = func(cfg aws.Config) stsAPI {
+		return &fakeSTSClient{&fakeSTS{calls: map[string]int{}, expires: time.Now().Add(time.Hour), failRole: destinationRole}, cfg}
+	}
+	target := ForeignTarget{Region: "eu-west-1", Bucket: "partner-bucket", Roles: []string{exporterRole, destinationRole}}
+
+	report := f.Preflight(context.Background(), target, "", true)
+	assert.False(t, report.OK)
+	assert.Equal(t, []string{"load-config", "assume-role", "assume-role"}, preflightSteps(report))
+	failed := report.Steps[2]
+	assert.Equal(t, destinationRole, failed.Role)
+	assert.False(t, failed.OK)
+	assert.Equal(t, "AccessDenied", failed.ErrorCode)
+	assert.Contains(t, failed.Error, "sts:AssumeRole")
+}
+
+func TestHandleForeignerPreflight(t *testing.T) {
+	_, srv := newFakeS3(map[string]string{})
+	defer srv.Close()
+	ds, err := loadTestDestinations(t, testDestinations)
+	assert.NoError(t, err)
+	h := NewForeignerHandler(newFakeS3Foreigner(srv.URL), nil, nil, NewForeignPolicy(nil, []string{"partner-bucket"}, nil), ds, 60)
+
+	rec := httptest.NewRecorder()
+	h.HandleForeignerPreflight(rec, newRequest("GET", "/foreign/preflight?destination=partner-archive", ""))
+	assert.Equal(t, 200, rec.Code)
+	var report PreflightReport
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.True(t, report.OK)
+	assert.Len(t, report.Steps, 4, "a GET doesn't write a probe")
+
+	rec = httptest.NewRecorder()
+	h.HandleForeignerPreflight(rec, newRequest("POST", "/foreign/preflight?destination=partner-archive", ""))
+	assert.Equal(t, 200, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.True(t, report.OK)
+	assert.Contains(t, report.Steps[4].Key, "exports/"+preflightProbePrefix)
+
+	rec = httptest.NewRecorder()
+	h.HandleForeignerPreflight(rec, newRequest("GET", "/foreign/preflight?destination=unknown", ""))
+	assert.Equal(t, 404, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.HandleForeignerPreflight(rec, newRequest("GET", "/foreign/preflight?region=eu-west-1&bucket=other&role="+destinationRole, ""))
+	assert.Equal(t, 403, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.HandleForeignerPreflight(rec, newRequest("GET", "/foreign/preflight?destination=partner-archive&region=eu-west-1&bucket=other&role="+destinationRole, ""))
+	assert.Equal(t, 400, rec.Code, "a destination and a bucket can't be named together")
+}
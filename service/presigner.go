@@ -3,34 +3,144 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
+	transactionid "github.com/Financial-Times/transactionid-utils-go"
 	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go/aws"
+	log "github.com/sirupsen/logrus"
 )
 
+// presignurl is a presigned request. Method and Headers are only set for uploads, whose signed headers the client
+// must send along.
 type presignurl struct {
-	URL string `json:"url"`
+	URL     string            `json:"url"`
+	Method  string            `json:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
 }
 
 type Presigner struct {
 	PresignClient *s3.PresignClient
+	client        *s3.Client
+	objects       *S3Client2
 	bucketName    string
+	contentPrefix string
+	conceptPrefix string
 	ttl           int
+	maxTTL        int
+	timeout       time.Duration
 }
 
-func NewPresigner(s3Client *s3.Client, bucketName string, ttl int) *Presigner {
+// NewPresigner presigns requests to our bucket, where content is kept under contentPrefix and concepts under
+// conceptPrefix. Requests are valid
+// for ttl seconds unless the client asks for another lifetime of at most maxTTL seconds.
+func NewPresigner(s3Client *s3.Client, bucketName, contentPrefix, conceptPrefix string, ttl, maxTTL int, timeouts OperationTimeouts) *Presigner {
 	presignClient := s3.NewPresignClient(s3Client)
 	return &Presigner{
 		PresignClient: presignClient,
+		client:        s3Client,
+		objects:       NewS3Client2(s3Client, bucketName, timeouts),
 		bucketName:    bucketName,
-		ttl:           ttl}
+		contentPrefix: contentPrefix,
+		conceptPrefix: conceptPrefix,
+		ttl:           ttl,
+		maxTTL:        maxTTL,
+		timeout:       timeouts.Presign}
+}
+
+// PresignOptions are what a client may choose about a presigned request: its lifetime and, for downloads,
+// the Content-Disposition and Content-Type S3 answers with and the policy of a CloudFront signature.
+type PresignOptions struct {
+	TTL                time.Duration
+	ContentDisposition string
+	ContentType        string
+	CloudFront         CloudFrontPolicy
+}
+
+// options reads the 'ttl', 'response-content-disposition' and 'response-content-type' query params.
+func (p *Presigner) options(q url.Values) (PresignOptions, error) {
+	opts := PresignOptions{
+		TTL:                time.Duration(p.ttl) * time.Second,
+		ContentDisposition: q.Get("response-content-disposition"),
+		ContentType:        q.Get("response-content-type"),
+	}
+	if v := q.Get("ttl"); v != "" {
+		ttl, err := strconv.Atoi(v)
+		if err != nil || ttl < 1 || ttl > p.maxTTL {
+			return opts, fmt.Errorf("invalid ttl %q, expected between 1 and %d seconds", v, p.maxTTL)
+		}
+		opts.TTL = time.Duration(ttl) * time.Second
+	}
+	return opts, nil
 }
 
-func (p *Presigner) GetPresignURL(key string) (string, error) {
-	presignedGetRequest, err := p.getObject(p.bucketName, key, int64(p.ttl))
+// storeKey is the key in our bucket of name in the generic or the concept store.
+func (p *Presigner) storeKey(store, name string) (string, error) {
+	switch store {
+	case "", RouteGroupGeneric:
+		return name, nil
+	case RouteGroupConcept:
+		if err := CheckFileName(name); err != nil {
+			return "", err
+		}
+		return getConceptKey(p.conceptPrefix, name), nil
+	}
+	return "", fmt.Errorf("invalid store %q, expected %q or %q", store, RouteGroupGeneric, RouteGroupConcept)
+}
+
+// PutPresignURL presigns an upload of key. The transaction id, the content type and, unless it is zero, the size are
+// signed, so the client has to send the returned headers.
+func (p *Presigner) PutPresignURL(ctx context.Context, key, ct string, size int64, tid string, ttl time.Duration) (presignurl, error) {
+	ctx, cancel := withTimeout(ctx, p.timeout)
+	defer cancel()
+	input := &s3.PutObjectInput{
+		Bucket:   aws.String(p.bucketName),
+		Key:      aws.String(key),
+		Metadata: objectMetadata(ctx, tid),
+	}
+	if ct != "" {
+		input.ContentType = aws.String(ct)
+	}
+	if size > 0 {
+		input.ContentLength = aws.Int64(size)
+	}
+	request, err := p.PresignClient.PresignPutObject(ctx, input, func(opts *s3.PresignOptions) {
+		opts.Expires = ttl
+	})
+	if err != nil {
+		return presignurl{}, err
+	}
+	headers := make(map[string]string)
+	for name, values := range request.SignedHeader {
+		if !strings.EqualFold(name, "Host") {
+			headers[name] = strings.Join(values, ",")
+		}
+	}
+	if ct != "" {
+		// The SDK only signs the content type along with a content length, but the client must send it either way.
+		headers["Content-Type"] = ct
+	}
+	return presignurl{URL: request.URL, Method: request.Method, Headers: headers}, nil
+}
+
+// PostPolicy presigns a browser-based upload of the key of c, or of any key under it when it ends in "/".
+func (p *Presigner) PostPolicy(ctx context.Context, c PostConditions, tid string, ttl time.Duration) (presignedPost, error) {
+	ctx, cancel := withTimeout(ctx, p.timeout)
+	defer cancel()
+	return p.postPolicy(ctx, c, tid, ttl)
+}
+
+func (p *Presigner) GetPresignURL(ctx context.Context, key string, opts PresignOptions) (string, error) {
+	ctx, cancel := withTimeout(ctx, p.timeout)
+	defer cancel()
+	presignedGetRequest, err := p.getObject(ctx, p.bucketName, key, opts)
 	if err != nil {
 		return "", err
 	}
@@ -38,14 +148,21 @@ func (p *Presigner) GetPresignURL(key string) (string, error) {
 }
 
 // GetObject makes a presigned request that can be used to get an object from a bucket.
-// The presigned request is valid for the specified number of seconds.
-func (presigner Presigner) getObject(
-	bucketName string, objectKey string, lifetimeSecs int64) (*v4.PresignedHTTPRequest, error) {
-	request, err := presigner.PresignClient.PresignGetObject(context.TODO(), &s3.GetObjectInput{
+// The presigned request is valid for opts.TTL and overrides the response headers opts sets.
+func (presigner Presigner) getObject(ctx context.Context,
+	bucketName string, objectKey string, o PresignOptions) (*v4.PresignedHTTPRequest, error) {
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(bucketName),
 		Key:    aws.String(objectKey),
-	}, func(opts *s3.PresignOptions) {
-		opts.Expires = time.Duration(lifetimeSecs * int64(time.Second))
+	}
+	if o.ContentDisposition != "" {
+		input.ResponseContentDisposition = aws.String(o.ContentDisposition)
+	}
+	if o.ContentType != "" {
+		input.ResponseContentType = aws.String(o.ContentType)
+	}
+	request, err := presigner.PresignClient.PresignGetObject(ctx, input, func(opts *s3.PresignOptions) {
+		opts.Expires = o.TTL
 	})
 	if err != nil {
 		return nil, err
@@ -55,22 +172,316 @@ func (presigner Presigner) getObject(
 
 type PresignerHandler struct {
 	presigner *Presigner
+	reader    Reader
+	keys      KeyPolicy
+	cdn       *CloudFrontSigner
+	policies  map[string]BodyPolicy
 }
 
-func NewPresignerHandler(presigner *Presigner) PresignerHandler {
+// NewPresignerHandler presigns downloads of the keys cdn serves through CloudFront, unless it is nil, and
+// everything else with presigner. The publish date of content is looked up with reader, and generic store keys
+// are held to keys. Uploads are held to the body policy of the store they go to, keyed by
+// RouteGroupGeneric or RouteGroupConcept, like uploads through the service.
+func NewPresignerHandler(presigner *Presigner, reader Reader, keys KeyPolicy, cdn *CloudFrontSigner, policies map[string]BodyPolicy) PresignerHandler {
 	return PresignerHandler{
 		presigner: presigner,
+		reader:    reader,
+		keys:      keys,
+		cdn:       cdn,
+		policies:  policies,
+	}
+}
+
+// options reads the query params of a presign request, including the 'policy', 'sourceIp' and 'notBefore'
+// of a CloudFront signature.
+func (h *PresignerHandler) options(q url.Values) (PresignOptions, error) {
+	opts, err := h.presigner.options(q)
+	if err != nil {
+		return opts, err
 	}
+	if h.cdn == nil && (q.Get("policy") != "" || q.Get("cookies") != "") {
+		return opts, errors.New("CloudFront signing is not enabled")
+	}
+	opts.CloudFront, err = parseCloudFrontPolicy(q)
+	return opts, err
+}
+
+// downloadURL signs a download of key through CloudFront when it serves the key, and from the bucket otherwise.
+// A custom policy can't be had from the bucket, so asking for one for a key CloudFront doesn't serve is an error
+// rather than a URL without the restrictions asked for.
+func (h *PresignerHandler) downloadURL(ctx context.Context, key string, opts PresignOptions) (string, error) {
+	if h.cdn != nil && h.cdn.Serves(key) {
+		return h.cdn.SignURL(key, opts)
+	}
+	if opts.CloudFront.Custom {
+		return "", fmt.Errorf("%w: policy=custom needs a key CloudFront serves, and %s is not under its prefixes", errCloudFrontKey, key)
+	}
+	return h.presigner.GetPresignURL(ctx, key, opts)
 }
 
+func respondSignError(rw http.ResponseWriter, err error) {
+	if errors.Is(err, errCloudFrontKey) {
+		respondWithBadRequest(rw, err.Error())
+		return
+	}
+	respondServiceUnavailable(err, rw)
+}
+
+type signedCookies struct {
+	Resource string            `json:"resource"`
+	Expires  time.Time         `json:"expires"`
+	Cookies  map[string]string `json:"cookies"`
+}
+
+// presignCookies answers with the CloudFront signed cookies for key, by name in the body and, when a cookie
+// domain is configured, in Set-Cookie headers.
+func (h *PresignerHandler) presignCookies(rw http.ResponseWriter, key string, opts PresignOptions) {
+	resource, cookies, err := h.cdn.SignCookies(key, opts)
+	if err != nil {
+		respondSignError(rw, err)
+		return
+	}
+	signed := signedCookies{Resource: resource, Expires: time.Now().Add(opts.TTL).UTC(), Cookies: make(map[string]string, len(cookies))}
+	for _, c := range cookies {
+		signed.Cookies[c.Name] = c.Value
+		if h.cdn.cookieDomain != "" {
+			http.SetCookie(rw, c)
+		}
+	}
+	respondJSON(rw, http.StatusOK, signed)
+}
+
+// storeKeys is the key policy of the store an upload, or its completion, goes to. Names in the concept store
+// are held to CheckFileName when they are resolved to a key instead.
+func (h *PresignerHandler) storeKeys(store string) KeyPolicy {
+	if store == "" || store == RouteGroupGeneric {
+		return h.keys
+	}
+	return KeyPolicy{}
+}
+
+// HandlePresignURL presigns a download of the key, or with the 'method' query param set to PUT or POST an upload
+// into the generic store or, with 'store=concept', the concept store. With 'cookies=true' it answers with
+// CloudFront signed cookies instead.
 func (h *PresignerHandler) HandlePresignURL(rw http.ResponseWriter, r *http.Request) {
-	key := getFileName(r.URL.Path)
-	purl, err := h.presigner.GetPresignURL(key)
+	method := strings.ToUpper(r.URL.Query().Get("method"))
+	// Downloads are always of generic store keys, whatever 'store' says.
+	check := h.keys.Check
+	switch method {
+	case http.MethodPut:
+		check = h.storeKeys(r.URL.Query().Get("store")).Check
+	case http.MethodPost:
+		check = h.storeKeys(r.URL.Query().Get("store")).CheckPost
+	}
+	key, err := unescapeRequestKey(r)
+	if err == nil {
+		err = check(key)
+	}
+	if err == nil {
+		err = checkPresignKey(key)
+	}
 	if err != nil {
-		respondServiceUnavailable(err, rw)
+		respondWithBadRequest(rw, err.Error())
+		return
+	}
+	opts, err := h.options(r.URL.Query())
+	if err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return
+	}
+	switch method {
+	case "", http.MethodGet:
+		if r.Method != http.MethodGet {
+			respondWithBadRequest(rw, "Downloads are presigned with a GET.")
+			return
+		}
+	case http.MethodPut, http.MethodPost:
+		// Presigning an upload grants a write, so it has to be asked for with a write.
+		if r.Method != http.MethodPost {
+			respondWithBadRequest(rw, "Uploads are presigned with a POST.")
+			return
+		}
+		h.presignUpload(rw, r, method, key, opts.TTL)
+		return
+	default:
+		respondWithBadRequest(rw, fmt.Sprintf("Invalid method %q, expected GET, PUT or POST.", method))
+		return
+	}
+	if r.URL.Query().Get("cookies") == "true" {
+		h.presignCookies(rw, key, opts)
+		return
+	}
+	purl, err := h.downloadURL(r.Context(), key, opts)
+	if err != nil {
+		respondSignError(rw, err)
 		return
 	}
 	rw.Header().Set("Content-Type", "application/json")
 	rw.WriteHeader(http.StatusOK)
-	json.NewEncoder(rw).Encode(presignurl{purl})
+	json.NewEncoder(rw).Encode(presignurl{URL: purl})
+}
+
+func (h *PresignerHandler) presignUpload(rw http.ResponseWriter, r *http.Request, method, name string, ttl time.Duration) {
+	q := r.URL.Query()
+	store := q.Get("store")
+	key, err := h.presigner.storeKey(store, name)
+	if err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return
+	}
+	if store == "" {
+		store = RouteGroupGeneric
+	}
+	policy := h.policies[store]
+	ct := q.Get("contentType")
+	if len(policy.AllowedContentTypes) > 0 && !policy.allows(ct) {
+		respondWithBadRequest(rw, fmt.Sprintf("Content type %q is not allowed in the %s store.", ct, store))
+		return
+	}
+	tid := transactionid.GetTransactionIDFromRequest(r)
+	ctx := transactionid.TransactionAwareContext(r.Context(), tid)
+
+	if method == http.MethodPut {
+		// S3 can't bound the size of a presigned PUT, but it does hold the upload to a signed Content-Length.
+		var size int64
+		if v := q.Get("size"); v != "" {
+			if size, err = strconv.ParseInt(v, 10, 64); err != nil || size < 0 {
+				respondWithBadRequest(rw, fmt.Sprintf("Invalid size %q.", v))
+				return
+			}
+		}
+		// Without a size no Content-Length is signed, and the URL would take an upload of any size.
+		if size == 0 && policy.MaxBytes > 0 {
+			respondWithBadRequest(rw, fmt.Sprintf("Query param 'size' is required, and must be positive, for uploads to the %s store.", store))
+			return
+		}
+		if policy.MaxBytes > 0 && size > policy.MaxBytes {
+			respondWithBadRequest(rw, fmt.Sprintf("Size %d exceeds the limit of %d bytes.", size, policy.MaxBytes))
+			return
+		}
+		purl, err := h.presigner.PutPresignURL(ctx, key, ct, size, tid, ttl)
+		if err != nil {
+			respondServiceUnavailable(err, rw)
+			return
+		}
+		respondJSON(rw, http.StatusOK, purl)
+		return
+	}
+
+	maxSize := int64(maxPostObjectSize)
+	if policy.MaxBytes > 0 && policy.MaxBytes < maxSize {
+		maxSize = policy.MaxBytes
+	}
+	c := PostConditions{Key: key, ContentType: ct, MaxSize: maxSize}
+	for param, size := range map[string]*int64{"minSize": &c.MinSize, "maxSize": &c.MaxSize} {
+		if v := q.Get(param); v != "" {
+			if *size, err = strconv.ParseInt(v, 10, 64); err != nil {
+				respondWithBadRequest(rw, fmt.Sprintf("Invalid %s %q.", param, v))
+				return
+			}
+		}
+	}
+	if c.MaxSize > maxSize {
+		respondWithBadRequest(rw, fmt.Sprintf("maxSize %d exceeds the limit of %d bytes.", c.MaxSize, maxSize))
+		return
+	}
+	if err = c.Validate(); err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return
+	}
+	post, err := h.presigner.PostPolicy(ctx, c, tid, ttl)
+	if err != nil {
+		respondServiceUnavailable(err, rw)
+		return
+	}
+	respondJSON(rw, http.StatusOK, post)
+}
+
+// maxBatchKeys bounds how many keys one batch presign request may ask for.
+const maxBatchKeys = 100
+
+type batchURL struct {
+	Key string `json:"key"`
+	URL string `json:"url"`
+}
+
+type presignedBatch struct {
+	URLs    []batchURL `json:"urls"`
+	Expires time.Time  `json:"expires"`
+}
+
+// HandleBatchPresign presigns downloads of every 'key' query param in one call. The 'ttl' and response override
+// params apply to all of them.
+func (h *PresignerHandler) HandleBatchPresign(rw http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	keys := q["key"]
+	if len(keys) == 0 || len(keys) > maxBatchKeys {
+		respondWithBadRequest(rw, fmt.Sprintf("Between 1 and %d 'key' params are required.", maxBatchKeys))
+		return
+	}
+	opts, err := h.options(q)
+	if err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return
+	}
+	batch := presignedBatch{URLs: make([]batchURL, 0, len(keys)), Expires: time.Now().Add(opts.TTL).UTC()}
+	for _, key := range keys {
+		err := h.keys.Check(key)
+		if err == nil {
+			err = checkPresignKey(key)
+		}
+		if err != nil {
+			respondWithBadRequest(rw, err.Error())
+			return
+		}
+		purl, err := h.downloadURL(r.Context(), key, opts)
+		if err != nil {
+			respondSignError(rw, err)
+			return
+		}
+		batch.URLs = append(batch.URLs, batchURL{Key: key, URL: purl})
+	}
+	respondJSON(rw, http.StatusOK, batch)
+}
+
+type completedUpload struct {
+	Key string `json:"key"`
+	ObjectInfo
+}
+
+// HandlePresignComplete is called back once a presigned upload is done. It checks the object landed and records
+// the upload in the audit trail.
+func (h *PresignerHandler) HandlePresignComplete(rw http.ResponseWriter, r *http.Request) {
+	name, err := h.storeKeys(r.URL.Query().Get("store")).requestKey(r)
+	if err == nil {
+		err = checkPresignKey(name)
+	}
+	if err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return
+	}
+	key, err := h.presigner.storeKey(r.URL.Query().Get("store"), name)
+	if err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return
+	}
+	ctx := transactionid.TransactionAwareContext(r.Context(), transactionid.GetTransactionIDFromRequest(r))
+	found, info, err := h.presigner.objects.Head(ctx, key)
+	if err != nil {
+		readerServiceUnavailable(r.URL.RequestURI(), err, rw)
+		return
+	}
+	if !found {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("{\"message\":\"Upload not found\"}"))
+		return
+	}
+	auditLog(ctx, "presigned-upload").WithFields(log.Fields{
+		"key":           key,
+		"contentLength": info.ContentLength,
+		"contentType":   info.ContentType,
+		"etag":          info.ETag,
+	}).Info("Presigned upload completed")
+	respondJSON(rw, http.StatusOK, completedUpload{key, info})
 }
@@ -0,0 +1,347 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	transactionid "github.com/Financial-Times/transactionid-utils-go"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	awsv1 "github.com/aws/aws-sdk-go/aws"
+	s3v1 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPresignerHandler(endpoint string) PresignerHandler {
+	client := s3.NewFromConfig(aws.Config{
+		Region:       "eu-west-1",
+		BaseEndpoint: aws.String(endpoint),
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "token"}, nil
+		}),
+	})
+	return NewPresignerHandler(NewPresigner(client, "our-bucket", "content", "concept", 60, 3600, OperationTimeouts{}), nil, NewKeyPolicy("content", "concept", "foreign-queue"), nil, nil)
+}
+
+func TestSigningKey(t *testing.T) {
+	// The example of https://docs.aws.amazon.com/general/latest/gr/sigv4-calculate-signature.html
+	key := signingKey("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam")
+	assert.Equal(t, "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d", hex.EncodeToString(key))
+}
+
+func TestHandlePresignPut(t *testing.T) {
+	h := newTestPresignerHandler("http://127.0.0.1:9000")
+
+	rec := httptest.NewRecorder()
+	req := newRequest("POST", "/presign/archive.zip?method=PUT&contentType=application/zip", "")
+	req.Header.Set(transactionid.TransactionIDHeader, "tid_presigned")
+	h.HandlePresignURL(rec, req)
+	assert.Equal(t, 200, rec.Code)
+	var purl presignurl
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &purl))
+	assert.Equal(t, "PUT", purl.Method)
+	assert.True(t, strings.HasPrefix(purl.URL, "http://127.0.0.1:9000/our-bucket/archive.zip?"), purl.URL)
+	assert.Contains(t, purl.URL, "X-Amz-Expires=60")
+	assert.Equal(t, "application/zip", purl.Headers["Content-Type"])
+	assert.Equal(t, "tid_presigned", purl.Headers["X-Amz-Meta-Transaction_id"])
+	assert.NotContains(t, purl.Headers, "Host")
+
+	rec = httptest.NewRecorder()
+	h.HandlePresignURL(rec, newRequest("POST", "/presign/people.json?method=PUT&store=concept", ""))
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &purl))
+	assert.True(t, strings.HasPrefix(purl.URL, "http://127.0.0.1:9000/our-bucket/concept/people.json?"), purl.URL)
+
+	for query, method := range map[string]string{
+		"?method=PATCH":             "GET",
+		"?method=PUT&store=content": "POST",
+		"?method=PUT":               "GET",
+		"":                          "POST",
+	} {
+		rec = httptest.NewRecorder()
+		h.HandlePresignURL(rec, newRequest(method, "/presign/archive.zip"+query, ""))
+		assert.Equal(t, 400, rec.Code, method+" "+query)
+	}
+}
+
+func TestHandlePresignPost(t *testing.T) {
+	presigner := newTestPresignerHandler("http://127.0.0.1:9000")
+	h := mux.NewRouter().UseEncodedPath()
+	h.HandleFunc("/presign/{key:.+}", presigner.HandlePresignURL)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, newRequest("POST", "/presign/uploads/?method=POST&contentType=image/*&maxSize=1048576", ""))
+	assert.Equal(t, 200, rec.Code)
+	var post presignedPost
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &post))
+	assert.Equal(t, "http://127.0.0.1:9000/our-bucket", post.URL)
+	assert.Equal(t, "uploads/", post.Fields["key"])
+	assert.Equal(t, "token", post.Fields["x-amz-security-token"])
+	assert.True(t, strings.HasPrefix(post.Fields["x-amz-credential"], "AKID/"))
+	assert.True(t, strings.HasSuffix(post.Fields["x-amz-credential"], "/eu-west-1/s3/aws4_request"))
+
+	policy, err := base64.StdEncoding.DecodeString(post.Fields["policy"])
+	assert.NoError(t, err)
+	var doc struct {
+		Expiration time.Time         `json:"expiration"`
+		Conditions []json.RawMessage `json:"conditions"`
+	}
+	assert.NoError(t, json.Unmarshal(policy, &doc))
+	assert.WithinDuration(t, time.Now().Add(time.Minute), doc.Expiration, 5*time.Second)
+	var conditions []string
+	for _, c := range doc.Conditions {
+		conditions = append(conditions, string(c))
+	}
+	assert.Contains(t, conditions, `{"bucket":"our-bucket"}`)
+	assert.Contains(t, conditions, `["starts-with","$key","uploads/"]`)
+	assert.Contains(t, conditions, `["content-length-range",0,1048576]`)
+	assert.Contains(t, conditions, `["starts-with","$Content-Type","image/"]`)
+
+	day := strings.Split(post.Fields["x-amz-credential"], "/")[1]
+	expected := hex.EncodeToString(hmacSHA256(signingKey("secret", day, "eu-west-1", "s3"), post.Fields["policy"]))
+	assert.Equal(t, expected, post.Fields["x-amz-signature"])
+
+	for _, query := range []string{"&maxSize=-1", "&minSize=10&maxSize=5", "&maxSize=6000000000", "&maxSize=big"} {
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, newRequest("POST", "/presign/uploads/?method=POST"+query, ""))
+		assert.Equal(t, 400, rec.Code, query)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newRequest("POST", "/presign/uploads/a.png?method=POST", ""))
+	assert.Equal(t, 200, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &post))
+	policy, _ = base64.StdEncoding.DecodeString(post.Fields["policy"])
+	assert.Contains(t, string(policy), `["eq","$key","uploads/a.png"]`, "a key without a trailing slash is signed exactly")
+	assert.NotContains(t, string(policy), "starts-with\",\"$key")
+}
+
+func TestHandlePresignUploadBodyPolicy(t *testing.T) {
+	h := newTestPresignerHandler("http://127.0.0.1:9000")
+	h.policies = map[string]BodyPolicy{RouteGroupGeneric: {MaxBytes: 1024, AllowedContentTypes: []string{"image/*"}}}
+
+	rec := httptest.NewRecorder()
+	h.HandlePresignURL(rec, newRequest("POST", "/presign/a.png?method=PUT&contentType=image/png&size=100", ""))
+	assert.Equal(t, 200, rec.Code)
+	var purl presignurl
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &purl))
+	assert.Equal(t, "100", purl.Headers["Content-Length"])
+	assert.Contains(t, purl.URL, "content-length", "the size is signed")
+
+	rec = httptest.NewRecorder()
+	h.HandlePresignURL(rec, newRequest("POST", "/presign/a.png?method=POST&contentType=image/png", ""))
+	assert.Equal(t, 200, rec.Code)
+	var post presignedPost
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &post))
+	policy, _ := base64.StdEncoding.DecodeString(post.Fields["policy"])
+	assert.Contains(t, string(policy), `["content-length-range",0,1024]`, "maxSize defaults to the store limit")
+
+	for query, reason := range map[string]string{
+		"?method=PUT&contentType=image/png":                 "a PUT needs a size",
+		"?method=PUT&contentType=image/png&size=0":          "a PUT of no size would sign no Content-Length",
+		"?method=PUT&contentType=image/png&size=2048":       "a PUT over the limit",
+		"?method=PUT&contentType=text/csv&size=100":         "a PUT of a disallowed type",
+		"?method=POST&contentType=image/png&maxSize=2048":   "a POST over the limit",
+		"?method=POST&contentType=application/octet-stream": "a POST of a disallowed type",
+	} {
+		rec = httptest.NewRecorder()
+		h.HandlePresignURL(rec, newRequest("POST", "/presign/a.png"+query, ""))
+		assert.Equal(t, 400, rec.Code, reason)
+	}
+}
+
+func TestHandlePresignComplete(t *testing.T) {
+	_, srv := newFakeS3(map[string]string{"our-bucket/concept/people.json": "PEOPLE"})
+	defer srv.Close()
+	h := newTestPresignerHandler(srv.URL)
+	r := mux.NewRouter().UseEncodedPath()
+	r.HandleFunc("/presign/{key:.+}/complete", h.HandlePresignComplete).Methods("POST")
+
+	hook := test.NewGlobal()
+	defer func() { logrus.StandardLogger().Hooks = make(logrus.LevelHooks) }()
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("POST", "/presign/people.json/complete?store=concept", ""))
+	assert.Equal(t, 200, rec.Code)
+	var done completedUpload
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &done))
+	assert.Equal(t, "concept/people.json", done.Key)
+	assert.Equal(t, int64(6), done.ContentLength)
+
+	var audited *logrus.Entry
+	for _, e := range hook.AllEntries() {
+		if e.Data["audit"] == true {
+			audited = e
+		}
+	}
+	if assert.NotNil(t, audited, "the upload is recorded in the audit trail") {
+		assert.Equal(t, "presigned-upload", audited.Data["event"])
+		assert.Equal(t, "concept/people.json", audited.Data["key"])
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("POST", "/presign/missing.json/complete", ""))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestHandlePresignTTLAndOverrides(t *testing.T) {
+	h := newTestPresignerHandler("http://127.0.0.1:9000")
+
+	rec := httptest.NewRecorder()
+	h.HandlePresignURL(rec, newRequest("GET", "/presign/a.zip?ttl=900&response-content-disposition="+url.QueryEscape(`attachment; filename="report.zip"`)+"&response-content-type=application/zip", ""))
+	assert.Equal(t, 200, rec.Code)
+	var purl presignurl
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &purl))
+	u, err := url.Parse(purl.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "900", u.Query().Get("X-Amz-Expires"))
+	assert.Equal(t, `attachment; filename="report.zip"`, u.Query().Get("response-content-disposition"))
+	assert.Equal(t, "application/zip", u.Query().Get("response-content-type"))
+
+	rec = httptest.NewRecorder()
+	h.HandlePresignURL(rec, newRequest("POST", "/presign/a.zip?method=PUT&ttl=120", ""))
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &purl))
+	assert.Contains(t, purl.URL, "X-Amz-Expires=120")
+
+	for _, ttl := range []string{"0", "-5", "3601", "soon"} {
+		rec = httptest.NewRecorder()
+		h.HandlePresignURL(rec, newRequest("GET", "/presign/a.zip?ttl="+ttl, ""))
+		assert.Equal(t, 400, rec.Code, ttl)
+	}
+}
+
+func TestHandleBatchPresign(t *testing.T) {
+	h := newTestPresignerHandler("http://127.0.0.1:9000")
+
+	rec := httptest.NewRecorder()
+	h.HandleBatchPresign(rec, newRequest("GET", "/presign?key=a.zip&key=b.zip&ttl=300", ""))
+	assert.Equal(t, 200, rec.Code)
+	var batch presignedBatch
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &batch))
+	if assert.Len(t, batch.URLs, 2) {
+		for i, key := range []string{"a.zip", "b.zip"} {
+			assert.Equal(t, key, batch.URLs[i].Key)
+			assert.True(t, strings.HasPrefix(batch.URLs[i].URL, "http://127.0.0.1:9000/our-bucket/"+key+"?"), batch.URLs[i].URL)
+			assert.Contains(t, batch.URLs[i].URL, "X-Amz-Expires=300")
+		}
+	}
+	assert.WithinDuration(t, time.Now().Add(5*time.Minute), batch.Expires, 5*time.Second)
+
+	tooMany := "/presign?key=a" + strings.Repeat("&key=a", maxBatchKeys)
+	for _, query := range []string{"/presign", "/presign?key=", "/presign?key=a&ttl=0", tooMany} {
+		rec = httptest.NewRecorder()
+		h.HandleBatchPresign(rec, newRequest("GET", query, ""))
+		assert.Equal(t, 400, rec.Code, query)
+	}
+}
+
+func TestHandlePresignContentAndConcept(t *testing.T) {
+	_, srv := newFakeS3(map[string]string{
+		"our-bucket/content/123e4567-e89b-12d3-a456-426655440000_2017-10-10.json": "CONTENT",
+		"our-bucket/concept/people.json":                                          "PEOPLE",
+	})
+	defer srv.Close()
+	h := newTestPresignerHandler(srv.URL)
+	listing := &mockS3Client{listObjectsV2Outputs: []*s3v1.ListObjectsV2Output{
+		{Contents: []*s3v1.Object{{Key: awsv1.String("content/123e4567-e89b-12d3-a456-426655440000_2017-10-10.json")}}},
+	}}
+	h.reader = NewS3Reader(listing, "our-bucket", "content", "concept", 1, OperationTimeouts{})
+	r := mux.NewRouter()
+	r.HandleFunc("/presign/content/{uuid}", h.HandlePresignContent).Methods("GET")
+	r.HandleFunc("/presign/concept/{fileName}", h.HandlePresignConcept).Methods("GET")
+
+	for path, key := range map[string]string{
+		"/presign/content/123e4567-e89b-12d3-a456-426655440000":                 "content/123e4567-e89b-12d3-a456-426655440000_2017-10-10.json",
+		"/presign/content/123e4567-e89b-12d3-a456-426655440000?date=2017-10-10": "content/123e4567-e89b-12d3-a456-426655440000_2017-10-10.json",
+		"/presign/concept/people.json?ttl=30":                                   "concept/people.json",
+	} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, newRequest("GET", path, ""))
+		assert.Equal(t, 200, rec.Code, path)
+		var purl presignurl
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &purl))
+		assert.True(t, strings.HasPrefix(purl.URL, srv.URL+"/our-bucket/"+key+"?"), purl.URL)
+	}
+
+	for path, expected := range map[string]int{
+		"/presign/content/not-a-uuid":                                           400,
+		"/presign/content/123e4567-e89b-12d3-a456-426655440000?date=2017-10-11": 404,
+		"/presign/content/223e4567-e89b-12d3-a456-426655440000":                 404,
+		"/presign/concept/organisations.json":                                   404,
+		"/presign/concept/people.json?ttl=0":                                    400,
+	} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, newRequest("GET", path, ""))
+		assert.Equal(t, expected, rec.Code, path)
+	}
+}
+
+func TestHandlePresignHierarchicalKeys(t *testing.T) {
+	h := newTestPresignerHandler("http://127.0.0.1:9000")
+	r := mux.NewRouter().UseEncodedPath()
+	r.HandleFunc("/presign/{key:.+}/complete", h.HandlePresignComplete).Methods("POST").MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+		return r.URL.Query().Get("method") == ""
+	})
+	r.HandleFunc("/presign/{key:.+}", h.HandlePresignURL).Methods("GET", "POST")
+	// Uploads are presigned, and completed, with a POST.
+	methodOf := func(uri string) string {
+		if strings.Contains(uri, "method=") {
+			return "POST"
+		}
+		return "GET"
+	}
+
+	for uri, key := range map[string]string{
+		"/presign/folder/sub/a.zip":                     "folder/sub/a.zip",
+		"/presign/folder/complete":                      "folder/complete",
+		"/presign/folder/complete?method=PUT":           "folder/complete",
+		"/presign/uploads/a.zip?method=PUT":             "uploads/a.zip",
+		"/presign/folder/with%20space.zip":              "folder/with%20space.zip",
+		"/presign/people.json?method=PUT&store=concept": "concept/people.json",
+	} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, newServerRequest(methodOf(uri), uri, ""))
+		assert.Equal(t, 200, rec.Code, uri)
+		var purl presignurl
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &purl))
+		assert.True(t, strings.HasPrefix(purl.URL, "http://127.0.0.1:9000/our-bucket/"+key+"?"), purl.URL)
+	}
+
+	for _, uri := range []string{
+		"/presign/folder/%2E%2E/escape",
+		"/presign/folder/people.json?method=PUT&store=concept",
+		"/presign/folder%2F..%2Fescape/complete",
+		"/presign/content/123e4567-e89b-12d3-a456-426655440000/a.json",
+		"/presign/concept/people/a.json?method=PUT",
+		"/presign/concept%2Fpeople.json",
+		"/presign/content/a.zip/complete",
+		"/presign/foreign-queue/payloads/abc",
+		"/presign/foreign-queue/?method=POST",
+		"/presign/foreign-queue/payloads/abc?store=concept",
+	} {
+		method := methodOf(uri)
+		if strings.HasSuffix(uri, "/complete") {
+			method = "POST"
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, newServerRequest(method, uri, ""))
+		assert.Equal(t, 400, rec.Code, uri)
+	}
+
+	rec := httptest.NewRecorder()
+	h.HandleBatchPresign(rec, newRequest("GET", "/presign?key=folder/a.zip&key=folder/../b.zip", ""))
+	assert.Equal(t, 400, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.HandleBatchPresign(rec, newRequest("GET", "/presign?key=folder/a.zip&key=concept/people.json", ""))
+	assert.Equal(t, 400, rec.Code, "keys under the concept route are reserved")
+}
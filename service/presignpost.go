@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// maxPostObjectSize is the largest object S3 accepts in a POST upload.
+const maxPostObjectSize = 5 << 30
+
+const (
+	amzDateLayout    = "20060102T150405Z"
+	amzDayLayout     = "20060102"
+	postAlgorithm    = "AWS4-HMAC-SHA256"
+	expirationLayout = "2006-01-02T15:04:05.000Z"
+)
+
+// PostConditions restrict what a presigned POST policy accepts. Key ending in "/" accepts any key starting with it,
+// and ContentType ending in "*" any content type starting with what comes before it.
+type PostConditions struct {
+	Key         string
+	ContentType string
+	MinSize     int64
+	MaxSize     int64
+}
+
+func (c PostConditions) Validate() error {
+	if c.MinSize < 0 || c.MaxSize < c.MinSize || c.MaxSize > maxPostObjectSize {
+		return fmt.Errorf("the size range must be within 0 and %d bytes", int64(maxPostObjectSize))
+	}
+	return nil
+}
+
+type presignedPost struct {
+	URL     string            `json:"url"`
+	Fields  map[string]string `json:"fields"`
+	Expires time.Time         `json:"expires"`
+}
+
+// postPolicy builds and signs a browser-based upload policy, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-HTTPPOSTConstructPolicy.html.
+// The SDK has no presigner for it, so it is signed here with the client's credentials.
+func (p *Presigner) postPolicy(ctx context.Context, c PostConditions, tid string, ttl time.Duration) (presignedPost, error) {
+	options := p.client.Options()
+	creds, err := options.Credentials.Retrieve(ctx)
+	if err != nil {
+		return presignedPost{}, err
+	}
+	now := time.Now().UTC()
+	credential := strings.Join([]string{creds.AccessKeyID, now.Format(amzDayLayout), options.Region, "s3", "aws4_request"}, "/")
+
+	fields := map[string]string{
+		"key":                       c.Key,
+		"x-amz-algorithm":           postAlgorithm,
+		"x-amz-credential":          credential,
+		"x-amz-date":                now.Format(amzDateLayout),
+		"x-amz-meta-transaction_id": tid,
+		"success_action_status":     "201",
+	}
+	conditions := []interface{}{
+		map[string]string{"bucket": p.bucketName},
+		keyCondition(c.Key),
+		map[string]string{"x-amz-algorithm": postAlgorithm},
+		map[string]string{"x-amz-credential": credential},
+		map[string]string{"x-amz-date": fields["x-amz-date"]},
+		map[string]string{"x-amz-meta-transaction_id": tid},
+		map[string]string{"success_action_status": "201"},
+		[]interface{}{"content-length-range", c.MinSize, c.MaxSize},
+	}
+	if creds.SessionToken != "" {
+		fields["x-amz-security-token"] = creds.SessionToken
+		conditions = append(conditions, map[string]string{"x-amz-security-token": creds.SessionToken})
+	}
+	if ct := strings.TrimSuffix(c.ContentType, "*"); ct != c.ContentType {
+		conditions = append(conditions, []interface{}{"starts-with", "$Content-Type", ct})
+	} else if ct != "" {
+		fields["Content-Type"] = ct
+		conditions = append(conditions, map[string]string{"Content-Type": ct})
+	}
+
+	expires := now.Add(ttl)
+	policy, err := json.Marshal(map[string]interface{}{
+		"expiration": expires.Format(expirationLayout),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return presignedPost{}, err
+	}
+	fields["policy"] = base64.StdEncoding.EncodeToString(policy)
+	fields["x-amz-signature"] = hex.EncodeToString(hmacSHA256(signingKey(creds.SecretAccessKey, now.Format(amzDayLayout), options.Region, "s3"), fields["policy"]))
+
+	return presignedPost{URL: p.postURL(options.BaseEndpoint, options.Region), Fields: fields, Expires: expires}, nil
+}
+
+// keyCondition signs the exact key, unless it ends in "/" and stands for every key under it.
+func keyCondition(key string) []interface{} {
+	if strings.HasSuffix(key, "/") {
+		return []interface{}{"starts-with", "$key", key}
+	}
+	return []interface{}{"eq", "$key", key}
+}
+
+func (p *Presigner) postURL(endpoint *string, region string) string {
+	if endpoint != nil {
+		return strings.TrimSuffix(aws.ToString(endpoint), "/") + "/" + p.bucketName
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", p.bucketName, region)
+}
+
+// signingKey derives the Signature Version 4 key of secret for one day, region and service.
+func signingKey(secret, day, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
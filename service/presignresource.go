@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// presignRoutes are the first path segments of the content and concept presign routes. Generic keys under them
+// would be hidden by those routes and share their authorization keys, so they can't be presigned.
+var presignRoutes = []string{"content", "concept"}
+
+func checkPresignKey(key string) error {
+	for _, route := range presignRoutes {
+		if key == route || strings.HasPrefix(key, route+"/") {
+			return fmt.Errorf("key %q is under /presign/%s/, which is reserved for the %s route", key, route, route)
+		}
+	}
+	return nil
+}
+
+// ContentKey is the key in our bucket of content published on date. It reports false when there is no such content.
+func (p *Presigner) ContentKey(ctx context.Context, uuid, date string) (string, bool, error) {
+	key := getContentKey(p.contentPrefix, date, uuid)
+	found, _, err := p.objects.Head(ctx, key)
+	return key, found, err
+}
+
+// ConceptKey resolves a concept file name to its key in our bucket. It reports false when there is no such concept.
+func (p *Presigner) ConceptKey(ctx context.Context, fileName string) (string, bool, error) {
+	key := getConceptKey(p.conceptPrefix, fileName)
+	found, _, err := p.objects.Head(ctx, key)
+	return key, found, err
+}
+
+// HandlePresignContent presigns a download of the content with the uuid in the path, published on 'date' or,
+// without it, on the date it is stored under. Writing content under a new date deletes it under the old one,
+// so that is the date it was last published.
+func (h *PresignerHandler) HandlePresignContent(rw http.ResponseWriter, r *http.Request) {
+	uuid := mux.Vars(r)["uuid"]
+	if !uuidRegex.MatchString(uuid) {
+		respondWithBadRequest(rw, "Provided UUID is invalid.")
+		return
+	}
+	h.presignResource(rw, r, func(ctx context.Context) (string, bool, error) {
+		date := r.URL.Query().Get("date")
+		if date == "" {
+			date, found, err := h.reader.GetPublishDateForUUID(ctx, uuid)
+			return getContentKey(h.presigner.contentPrefix, date, uuid), found, err
+		}
+		return h.presigner.ContentKey(ctx, uuid, date)
+	})
+}
+
+// HandlePresignConcept presigns a download of the concept file named in the path.
+func (h *PresignerHandler) HandlePresignConcept(rw http.ResponseWriter, r *http.Request) {
+	fileName, err := requestFileName(r)
+	if err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return
+	}
+	h.presignResource(rw, r, func(ctx context.Context) (string, bool, error) {
+		return h.presigner.ConceptKey(ctx, fileName)
+	})
+}
+
+// presignResource presigns a download of the key resolve finds, answering 404 rather than handing out a URL
+// that would fail when the object doesn't exist.
+func (h *PresignerHandler) presignResource(rw http.ResponseWriter, r *http.Request, resolve func(ctx context.Context) (string, bool, error)) {
+	opts, err := h.options(r.URL.Query())
+	if err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return
+	}
+	key, found, err := resolve(r.Context())
+	if err != nil {
+		readerServiceUnavailable(r.URL.RequestURI(), err, rw)
+		return
+	}
+	if !found {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("{\"message\":\"Item not found\"}"))
+		return
+	}
+	purl, err := h.downloadURL(r.Context(), key, opts)
+	if err != nil {
+		respondSignError(rw, err)
+		return
+	}
+	respondJSON(rw, http.StatusOK, presignurl{URL: purl})
+}
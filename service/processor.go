@@ -2,6 +2,8 @@ package service
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -27,19 +29,21 @@ type KafkaMsg struct {
 }
 
 type Reader interface {
-	GetContent(uuid, publishedDate string) (bool, io.ReadCloser, *string, error)
-	GetConcept(fileName string) (bool, io.ReadCloser, *string, error)
-	GetGenericStore(key string) (bool, io.ReadCloser, *string, error)
-	GetPublishDateForUUID(uuid string) (string, bool, error)
+	GetContent(ctx context.Context, uuid, publishedDate string) (bool, io.ReadCloser, *string, error)
+	GetConcept(ctx context.Context, fileName string) (bool, io.ReadCloser, *string, error)
+	GetGenericStore(ctx context.Context, key string) (bool, io.ReadCloser, *string, error)
+	GetPublishDateForUUID(ctx context.Context, uuid string) (string, bool, error)
+	ObjectLister
 }
 
-func NewS3Reader(svc s3iface.S3API, bucketName string, bucketContentPrefix string, bucketConceptPrefix string, workers int16) Reader {
+func NewS3Reader(svc s3iface.S3API, bucketName string, bucketContentPrefix string, bucketConceptPrefix string, workers int16, timeouts OperationTimeouts) Reader {
 	return &S3Reader{
 		svc:                 svc,
 		bucketName:          bucketName,
 		bucketContentPrefix: bucketContentPrefix,
 		bucketConceptPrefix: bucketConceptPrefix,
 		workers:             workers,
+		timeouts:            timeouts,
 	}
 }
 
@@ -49,29 +53,32 @@ type S3Reader struct {
 	bucketContentPrefix string
 	bucketConceptPrefix string
 	workers             int16
+	timeouts            OperationTimeouts
 }
 
-func (r *S3Reader) GetConcept(fileName string) (bool, io.ReadCloser, *string, error) {
+func (r *S3Reader) GetConcept(ctx context.Context, fileName string) (bool, io.ReadCloser, *string, error) {
 	s3ObjectKey := getConceptKey(r.bucketConceptPrefix, fileName)
-	return r.Get(s3ObjectKey)
+	return r.Get(ctx, s3ObjectKey)
 }
-func (r *S3Reader) GetContent(uuid, publishedDate string) (bool, io.ReadCloser, *string, error) {
+func (r *S3Reader) GetContent(ctx context.Context, uuid, publishedDate string) (bool, io.ReadCloser, *string, error) {
 	s3ObjectKey := getContentKey(r.bucketContentPrefix, publishedDate, uuid)
-	return r.Get(s3ObjectKey)
+	return r.Get(ctx, s3ObjectKey)
 }
-func (r *S3Reader) GetGenericStore(key string) (bool, io.ReadCloser, *string, error) {
-	return r.Get(key)
+func (r *S3Reader) GetGenericStore(ctx context.Context, key string) (bool, io.ReadCloser, *string, error) {
+	return r.Get(ctx, key)
 }
 
-func (r *S3Reader) Get(s3ObjectKey string) (bool, io.ReadCloser, *string, error) {
+func (r *S3Reader) Get(ctx context.Context, s3ObjectKey string) (bool, io.ReadCloser, *string, error) {
 	s3Param := &s3.GetObjectInput{
 		Bucket: aws.String(r.bucketName), // Required
 		Key:    aws.String(s3ObjectKey),  // Required
 	}
 
-	resp, err := r.svc.GetObject(s3Param)
+	ctx, cancel := withTimeout(ctx, r.timeouts.Read)
+	resp, err := r.svc.GetObjectWithContext(ctx, s3Param)
 
 	if err != nil {
+		cancel()
 		e, ok := err.(awserr.Error)
 		if ok && e.Code() == "NoSuchKey" {
 			return false, nil, nil, nil
@@ -79,72 +86,87 @@ func (r *S3Reader) Get(s3ObjectKey string) (bool, io.ReadCloser, *string, error)
 		return false, nil, nil, err
 	}
 
-	return true, resp.Body, resp.ContentType, err
+	// The read deadline also covers streaming the body, so it is only released once the body is closed.
+	return true, &cancelOnClose{resp.Body, cancel}, resp.ContentType, err
 }
 
-func (r *S3Reader) getListObjectsV2Input(uuid string) *s3.ListObjectsV2Input {
-	if r.bucketContentPrefix == "" {
-		return &s3.ListObjectsV2Input{
-			Bucket: aws.String(r.bucketName),
-		}
-	}
+// ObjectLister enumerates the keys stored in our bucket.
+type ObjectLister interface {
+	EachObject(ctx context.Context, prefix string, fn func(key string) (bool, error)) error
+}
 
-	return &s3.ListObjectsV2Input{
+// EachObject walks every object key under prefix, page by page, skipping folder markers.
+// Iteration stops when fn returns false or an error, when listing fails, or when ctx is done,
+// and the first error encountered is returned. No goroutines are left behind either way.
+func (r *S3Reader) EachObject(ctx context.Context, prefix string, fn func(key string) (bool, error)) error {
+	input := &s3.ListObjectsV2Input{
 		Bucket: aws.String(r.bucketName),
-		Prefix: aws.String(r.bucketContentPrefix + "/" + uuid),
 	}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+
+	ctx, cancel := withTimeout(ctx, r.timeouts.List)
+	defer cancel()
+
+	var fnErr error
+	err := r.svc.ListObjectsV2PagesWithContext(ctx, input,
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, o := range page.Contents {
+				if strings.HasSuffix(*o.Key, "/") {
+					continue
+				}
+				more, err := fn(*o.Key)
+				if err != nil {
+					fnErr = err
+					return false
+				}
+				if !more {
+					return false
+				}
+			}
+			return true
+		})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
 }
 
-func (r *S3Reader) GetPublishDateForUUID(uuid string) (string, bool, error) {
-	keys := make(chan *string, 3000)
-	go r.listObjects(keys, uuid)
+func (r *S3Reader) GetPublishDateForUUID(ctx context.Context, uuid string) (string, bool, error) {
+	// Content keys start with "/" when there is no content prefix, which keeps the listing away from the rest of
+	// the bucket, such as the foreign queue spool.
+	prefix := r.bucketContentPrefix + "/"
 
-	for key := range keys {
-		splitKey := strings.Split(*key, "_")
+	var publishDate string
+	var found bool
+	err := r.EachObject(ctx, prefix+uuid, func(key string) (bool, error) {
+		key = strings.TrimPrefix(key, prefix)
+		splitKey := strings.Split(strings.TrimSuffix(key, ".json"), "_")
 		if len(splitKey) < 2 {
-			return "", false, fmt.Errorf("Cannot parse date from s3 object key %s", *key)
+			return false, fmt.Errorf("Cannot parse date from s3 object key %s", key)
 		}
 
 		if splitKey[0] == uuid {
-			return splitKey[1], true, nil
+			publishDate, found = splitKey[1], true
+			return false, nil
 		}
+		return true, nil
+	})
+	if err != nil {
+		return "", false, err
 	}
 
-	return "", false, nil
-}
-
-func (r *S3Reader) listObjects(keys chan<- *string, uuid string) error {
-	return r.svc.ListObjectsV2Pages(r.getListObjectsV2Input(uuid),
-		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
-			for _, o := range page.Contents {
-				if !strings.HasSuffix(*o.Key, "/") {
-					var key string
-					if r.bucketContentPrefix == "" {
-						key = *o.Key
-					} else {
-						k := strings.SplitAfter(*o.Key, r.bucketContentPrefix+"/")
-						key = k[1]
-					}
-					uuid := strings.TrimSuffix(key, ".json")
-					keys <- &uuid
-				}
-			}
-
-			if lastPage {
-				close(keys)
-			}
-
-			return !lastPage
-		})
+	return publishDate, found, nil
 }
 
 type Writer interface {
-	WriteConcept(fileName string, b *[]byte, ct string, tid string) error
-	WriteContent(uuid, date string, b *[]byte, contentType string, transactionId string) error
-	WriteGenericStore(key string, b *[]byte, contentType string, transactionId string) error
-	DeleteContent(uuid, date string) error
-	DeleteConcept(fileName string) error
-	DeleteGenericStore(key string) error
+	WriteConcept(ctx context.Context, fileName string, b *[]byte, ct string, tid string) error
+	WriteContent(ctx context.Context, uuid, date string, b *[]byte, contentType string, transactionId string) error
+	WriteGenericStore(ctx context.Context, key string, b *[]byte, contentType string, transactionId string) error
+	DeleteContent(ctx context.Context, uuid, date string) error
+	DeleteConcept(ctx context.Context, fileName string) error
+	DeleteGenericStore(ctx context.Context, key string) error
 }
 
 type S3Writer struct {
@@ -152,14 +174,16 @@ type S3Writer struct {
 	bucketName          string
 	bucketContentPrefix string
 	bucketConceptPrefix string
+	timeouts            OperationTimeouts
 }
 
-func NewS3Writer(svc s3iface.S3API, bucketName string, bucketContentPrefix string, bucketConceptPrefix string) Writer {
+func NewS3Writer(svc s3iface.S3API, bucketName string, bucketContentPrefix string, bucketConceptPrefix string, timeouts OperationTimeouts) Writer {
 	return &S3Writer{
 		svc:                 svc,
 		bucketName:          bucketName,
 		bucketContentPrefix: bucketContentPrefix,
 		bucketConceptPrefix: bucketConceptPrefix,
+		timeouts:            timeouts,
 	}
 }
 
@@ -171,48 +195,50 @@ func getContentKey(bucketPrefix, date, uuid string) string {
 	return bucketPrefix + "/" + uuid + "_" + date + ".json"
 }
 
-func (w *S3Writer) Delete(s3ObjectKey string) error {
+func (w *S3Writer) Delete(ctx context.Context, s3ObjectKey string) error {
 	params := &s3.DeleteObjectInput{
 		Bucket: aws.String(w.bucketName), // Required
 		Key:    aws.String(s3ObjectKey),  // Required
 	}
 
-	if resp, err := w.svc.DeleteObject(params); err != nil {
+	ctx, cancel := withTimeout(ctx, w.timeouts.Delete)
+	defer cancel()
+	if resp, err := w.svc.DeleteObjectWithContext(ctx, params); err != nil {
 		log.Errorf("Error found, Resp was : %v", resp)
 		return err
 	}
 	return nil
 }
 
-func (w *S3Writer) DeleteConcept(fileName string) error {
+func (w *S3Writer) DeleteConcept(ctx context.Context, fileName string) error {
 	s3ObjectKey := getConceptKey(w.bucketConceptPrefix, fileName)
-	return w.Delete(s3ObjectKey)
+	return w.Delete(ctx, s3ObjectKey)
 }
 
-func (w *S3Writer) DeleteContent(uuid, date string) error {
+func (w *S3Writer) DeleteContent(ctx context.Context, uuid, date string) error {
 	s3ObjectKey := getContentKey(w.bucketContentPrefix, date, uuid)
-	return w.Delete(s3ObjectKey)
+	return w.Delete(ctx, s3ObjectKey)
 }
 
-func (w *S3Writer) DeleteGenericStore(key string) error {
-	return w.Delete(key)
+func (w *S3Writer) DeleteGenericStore(ctx context.Context, key string) error {
+	return w.Delete(ctx, key)
 }
 
-func (w *S3Writer) WriteConcept(fileName string, b *[]byte, ct string, tid string) error {
+func (w *S3Writer) WriteConcept(ctx context.Context, fileName string, b *[]byte, ct string, tid string) error {
 	s3Objectkey := getConceptKey(w.bucketConceptPrefix, fileName)
-	return w.Write(s3Objectkey, b, ct, tid)
+	return w.Write(ctx, s3Objectkey, b, ct, tid)
 }
 
-func (w *S3Writer) WriteContent(uuid, date string, b *[]byte, ct string, tid string) error {
+func (w *S3Writer) WriteContent(ctx context.Context, uuid, date string, b *[]byte, ct string, tid string) error {
 	s3Objectkey := getContentKey(w.bucketContentPrefix, date, uuid)
-	return w.Write(s3Objectkey, b, ct, tid)
+	return w.Write(ctx, s3Objectkey, b, ct, tid)
 }
 
-func (w *S3Writer) WriteGenericStore(key string, b *[]byte, ct string, tid string) error {
-	return w.Write(key, b, ct, tid)
+func (w *S3Writer) WriteGenericStore(ctx context.Context, key string, b *[]byte, ct string, tid string) error {
+	return w.Write(ctx, key, b, ct, tid)
 }
 
-func (w *S3Writer) Write(s3ObjectKey string, b *[]byte, ct string, tid string) error {
+func (w *S3Writer) Write(ctx context.Context, s3ObjectKey string, b *[]byte, ct string, tid string) error {
 	s3Param := &s3.PutObjectInput{
 		Bucket: aws.String(w.bucketName),
 		Key:    aws.String(s3ObjectKey),
@@ -226,8 +252,13 @@ func (w *S3Writer) Write(s3ObjectKey string, b *[]byte, ct string, tid string) e
 		s3Param.Metadata = make(map[string]*string)
 	}
 	s3Param.Metadata[transactionid.TransactionIDKey] = &tid
+	if id := ClientIdentity(ctx); id != "" {
+		s3Param.Metadata[ClientIdentityMetadataKey] = &id
+	}
 
-	resp, err := w.svc.PutObject(s3Param)
+	ctx, cancel := withTimeout(ctx, w.timeouts.Write)
+	defer cancel()
+	resp, err := w.svc.PutObjectWithContext(ctx, s3Param)
 	if err != nil {
 		log.Errorf("Error found, Resp was : %v", resp)
 		return err
@@ -239,23 +270,29 @@ func (w *S3Writer) Write(s3ObjectKey string, b *[]byte, ct string, tid string) e
 type WriterHandler struct {
 	writer Writer
 	reader Reader
+	keys   KeyPolicy
 }
 
-func NewWriterHandler(writer Writer, reader Reader) WriterHandler {
+// NewWriterHandler holds the keys of the generic store to keys.
+func NewWriterHandler(writer Writer, reader Reader, keys KeyPolicy) WriterHandler {
 	return WriterHandler{
 		writer: writer,
 		reader: reader,
+		keys:   keys,
 	}
 }
 
 func (w *WriterHandler) HandleConceptWrite(rw http.ResponseWriter, r *http.Request) {
-	fileName := getFileName(r.URL.Path)
+	fileName, err := requestFileName(r)
+	if err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return
+	}
 
 	rw.Header().Set("Content-Type", "application/json")
-	var err error
 	bs, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		writerStatusInternalServerError(fileName, err, rw)
+		respondWithBodyReadError(fileName, err, rw)
 		return
 	}
 
@@ -267,7 +304,7 @@ func (w *WriterHandler) HandleConceptWrite(rw http.ResponseWriter, r *http.Reque
 	ct := r.Header.Get("Content-Type")
 	tid := transactionid.GetTransactionIDFromRequest(r)
 
-	err = w.writer.WriteConcept(fileName, &bs, ct, tid)
+	err = w.writer.WriteConcept(r.Context(), fileName, &bs, ct, tid)
 	if err != nil {
 		writerServiceUnavailable(fileName, err, rw)
 		return
@@ -277,13 +314,18 @@ func (w *WriterHandler) HandleConceptWrite(rw http.ResponseWriter, r *http.Reque
 }
 
 func (w *WriterHandler) HandleConceptDelete(rw http.ResponseWriter, r *http.Request) {
-	fileName := getFileName(r.URL.Path)
-	found, _, _, err := w.reader.GetConcept(fileName)
+	fileName, err := requestFileName(r)
+	if err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return
+	}
+	found, i, _, err := w.reader.GetConcept(r.Context(), fileName)
 	if err != nil {
 		rw.Header().Set("Content-Type", "application/json")
 		writerServiceUnavailable(fileName, err, rw)
 		return
 	}
+	closeBody(i)
 
 	if !found {
 		rw.Header().Set("Content-Type", "application/json")
@@ -292,7 +334,7 @@ func (w *WriterHandler) HandleConceptDelete(rw http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	if err := w.writer.DeleteConcept(fileName); err != nil {
+	if err := w.writer.DeleteConcept(r.Context(), fileName); err != nil {
 		rw.Header().Set("Content-Type", "application/json")
 		writerServiceUnavailable(fileName, err, rw)
 		return
@@ -303,14 +345,26 @@ func (w *WriterHandler) HandleConceptDelete(rw http.ResponseWriter, r *http.Requ
 }
 
 func respondWithBadRequest(rw http.ResponseWriter, message string) {
+	respondWithMessage(rw, http.StatusBadRequest, message)
+}
+
+func respondWithMessage(rw http.ResponseWriter, status int, message string) {
 	rw.Header().Set("Content-Type", "application/json")
-	rw.WriteHeader(http.StatusBadRequest)
-	rw.Write([]byte(fmt.Sprintf("{\"message\":\"%s\"}", message)))
+	rw.WriteHeader(status)
+	// Messages may quote client input, so they are encoded rather than formatted into the body.
+	b, _ := json.Marshal(struct {
+		Message string `json:"message"`
+	}{message})
+	rw.Write(b)
 }
 
 func (rh *ReaderHandler) HandleGenericStoreGet(rw http.ResponseWriter, r *http.Request) {
-	key := getFileName(r.URL.Path)
-	f, i, ct, err := rh.reader.GetGenericStore(key)
+	key, err := rh.keys.requestKey(r)
+	if err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return
+	}
+	f, i, ct, err := rh.reader.GetGenericStore(r.Context(), key)
 	if err != nil {
 		readerServiceUnavailable(r.URL.RequestURI(), err, rw)
 		return
@@ -331,7 +385,7 @@ func (rh *ReaderHandler) HandleContentGet(rw http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	f, i, ct, err := rh.reader.GetContent(uuid, publishedDate)
+	f, i, ct, err := rh.reader.GetContent(r.Context(), uuid, publishedDate)
 	if err != nil {
 		readerServiceUnavailable(r.URL.RequestURI(), err, rw)
 		return
@@ -341,9 +395,13 @@ func (rh *ReaderHandler) HandleContentGet(rw http.ResponseWriter, r *http.Reques
 }
 
 func (rh *ReaderHandler) HandleConceptGet(rw http.ResponseWriter, r *http.Request) {
-	fileName := getFileName(r.URL.Path)
+	fileName, err := requestFileName(r)
+	if err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return
+	}
 
-	f, i, ct, err := rh.reader.GetConcept(fileName)
+	f, i, ct, err := rh.reader.GetConcept(r.Context(), fileName)
 	if err != nil {
 		readerServiceUnavailable(r.URL.RequestURI(), err, rw)
 		return
@@ -359,6 +417,7 @@ func handleGet(f bool, rw http.ResponseWriter, i io.ReadCloser, ct *string) {
 		rw.Write([]byte("{\"message\":\"Item not found\"}"))
 		return
 	}
+	defer closeBody(i)
 
 	b, err := ioutil.ReadAll(i)
 	if err != nil {
@@ -378,19 +437,22 @@ func handleGet(f bool, rw http.ResponseWriter, i io.ReadCloser, ct *string) {
 }
 
 func (w *WriterHandler) HandleGenericStoreWrite(rw http.ResponseWriter, r *http.Request) {
-	key := getFileName(r.URL.Path)
+	key, err := w.keys.requestKey(r)
+	if err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return
+	}
 	ct := r.Header.Get("Content-Type")
 	rw.Header().Set("Content-Type", ct)
 
-	var err error
 	bs, err := io.ReadAll(r.Body)
 	if err != nil {
-		writerStatusInternalServerError(key, err, rw)
+		respondWithBodyReadError(key, err, rw)
 		return
 	}
 
 	tid := transactionid.GetTransactionIDFromRequest(r)
-	err = w.writer.WriteGenericStore(key, &bs, ct, tid)
+	err = w.writer.WriteGenericStore(r.Context(), key, &bs, ct, tid)
 	if err != nil {
 		writerServiceUnavailable("", err, rw)
 		return
@@ -414,11 +476,11 @@ func (w *WriterHandler) HandleContentWrite(rw http.ResponseWriter, r *http.Reque
 	var err error
 	bs, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		writerStatusInternalServerError(uuid, err, rw)
+		respondWithBodyReadError(uuid, err, rw)
 		return
 	}
 
-	oldPublishDate, found, err := w.reader.GetPublishDateForUUID(uuid)
+	oldPublishDate, found, err := w.reader.GetPublishDateForUUID(r.Context(), uuid)
 	if err != nil {
 		writerServiceUnavailable(uuid, err, rw)
 		return
@@ -426,17 +488,17 @@ func (w *WriterHandler) HandleContentWrite(rw http.ResponseWriter, r *http.Reque
 	ct := r.Header.Get("Content-Type")
 	tid := transactionid.GetTransactionIDFromRequest(r)
 
-	err = w.writer.WriteContent(uuid, newPublishDate, &bs, ct, tid)
+	err = w.writer.WriteContent(r.Context(), uuid, newPublishDate, &bs, ct, tid)
 	if err != nil {
 		writerServiceUnavailable(uuid, err, rw)
 		return
 	}
 
 	if found && newPublishDate != oldPublishDate {
-		err = w.writer.DeleteContent(uuid, oldPublishDate)
+		err = w.writer.DeleteContent(r.Context(), uuid, oldPublishDate)
 		if err != nil {
 			//try to revert the update
-			w.writer.DeleteContent(uuid, newPublishDate)
+			w.writer.DeleteContent(r.Context(), uuid, newPublishDate)
 			writerServiceUnavailable(uuid, err, rw)
 			return
 		}
@@ -458,14 +520,19 @@ func writerStatusInternalServerError(uuid string, err error, rw http.ResponseWri
 }
 
 func (w *WriterHandler) HandleGenericStoreDelete(rw http.ResponseWriter, r *http.Request) {
-	key := getFileName(r.URL.Path)
+	key, err := w.keys.requestKey(r)
+	if err != nil {
+		respondWithBadRequest(rw, err.Error())
+		return
+	}
 
-	found, _, _, err := w.reader.GetGenericStore(key)
+	found, i, _, err := w.reader.GetGenericStore(r.Context(), key)
 	if err != nil {
 		rw.Header().Set("Content-Type", "application/json")
 		writerServiceUnavailable(key, err, rw)
 		return
 	}
+	closeBody(i)
 
 	if !found {
 		rw.Header().Set("Content-Type", "application/json")
@@ -474,7 +541,7 @@ func (w *WriterHandler) HandleGenericStoreDelete(rw http.ResponseWriter, r *http
 		return
 	}
 
-	if err := w.writer.DeleteGenericStore(key); err != nil {
+	if err := w.writer.DeleteGenericStore(r.Context(), key); err != nil {
 		rw.Header().Set("Content-Type", "application/json")
 		writerServiceUnavailable(key, err, rw)
 		return
@@ -491,7 +558,7 @@ func (w *WriterHandler) HandleContentDelete(rw http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	publishedDate, found, err := w.reader.GetPublishDateForUUID(uuid)
+	publishedDate, found, err := w.reader.GetPublishDateForUUID(r.Context(), uuid)
 	if err != nil {
 		rw.Header().Set("Content-Type", "application/json")
 		writerServiceUnavailable(uuid, err, rw)
@@ -505,7 +572,7 @@ func (w *WriterHandler) HandleContentDelete(rw http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	if err := w.writer.DeleteContent(uuid, publishedDate); err != nil {
+	if err := w.writer.DeleteContent(r.Context(), uuid, publishedDate); err != nil {
 		rw.Header().Set("Content-Type", "application/json")
 		writerServiceUnavailable(uuid, err, rw)
 		return
@@ -515,12 +582,20 @@ func (w *WriterHandler) HandleContentDelete(rw http.ResponseWriter, r *http.Requ
 	rw.WriteHeader(http.StatusNoContent)
 }
 
-func NewReaderHandler(reader Reader) ReaderHandler {
-	return ReaderHandler{reader: reader}
+// NewReaderHandler holds the keys of the generic store to keys.
+func NewReaderHandler(reader Reader, keys KeyPolicy) ReaderHandler {
+	return ReaderHandler{reader: reader, keys: keys}
 }
 
 type ReaderHandler struct {
 	reader Reader
+	keys   KeyPolicy
+}
+
+func closeBody(i io.ReadCloser) {
+	if i != nil {
+		i.Close()
+	}
 }
 
 func getFileName(path string) string {
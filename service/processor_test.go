@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -13,6 +14,7 @@ import (
 	transactionid "github.com/Financial-Times/transactionid-utils-go"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	log "github.com/sirupsen/logrus"
@@ -39,12 +41,13 @@ type mockS3Client struct {
 	listObjectsV2Outputs []*s3.ListObjectsV2Output
 	listObjectsV2Input   []*s3.ListObjectsV2Input
 	count                int
+	listObjectsV2Pages   int
 	getObjectCount       int
 	payload              string
 	ct                   string
 }
 
-func (m *mockS3Client) PutObject(poi *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+func (m *mockS3Client) PutObjectWithContext(ctx aws.Context, poi *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
 	m.Lock()
 	defer m.Unlock()
 	log.Infof("Put params: %v", poi)
@@ -59,7 +62,7 @@ func (m *mockS3Client) HeadBucket(hbi *s3.HeadBucketInput) (*s3.HeadBucketOutput
 	m.headBucketInput = hbi
 	return nil, m.s3error
 }
-func (m *mockS3Client) HeadObject(hoi *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+func (m *mockS3Client) HeadObjectWithContext(ctx aws.Context, hoi *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
 	m.Lock()
 	defer m.Unlock()
 	log.Infof("Head params: %v", hoi)
@@ -67,7 +70,7 @@ func (m *mockS3Client) HeadObject(hoi *s3.HeadObjectInput) (*s3.HeadObjectOutput
 	return nil, m.s3error
 
 }
-func (m *mockS3Client) DeleteObject(doi *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+func (m *mockS3Client) DeleteObjectWithContext(ctx aws.Context, doi *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error) {
 	m.Lock()
 	defer m.Unlock()
 	log.Infof("Delete params: %v", doi)
@@ -75,7 +78,7 @@ func (m *mockS3Client) DeleteObject(doi *s3.DeleteObjectInput) (*s3.DeleteObject
 	return m.deleteObjectOutput, m.s3error
 }
 
-func (m *mockS3Client) GetObject(goi *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+func (m *mockS3Client) GetObjectWithContext(ctx aws.Context, goi *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
 	m.Lock()
 	defer m.Unlock()
 	log.Infof("Get params: %v", goi)
@@ -88,7 +91,7 @@ func (m *mockS3Client) GetObject(goi *s3.GetObjectInput) (*s3.GetObjectOutput, e
 	}, m.s3error
 }
 
-func (m *mockS3Client) ListObjectsV2(loi *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+func (m *mockS3Client) ListObjectsV2WithContext(ctx aws.Context, loi *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error) {
 	m.Lock()
 	defer m.Unlock()
 	log.Infof("Get ListObjectsV2: %v", loi)
@@ -100,18 +103,28 @@ func (m *mockS3Client) ListObjectsV2(loi *s3.ListObjectsV2Input) (*s3.ListObject
 	m.count++
 	return loo, m.s3error
 }
-func (m *mockS3Client) ListObjectsV2Pages(loi *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool)) error {
+func (m *mockS3Client) ListObjectsV2PagesWithContext(ctx aws.Context, loi *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool), opts ...request.Option) error {
 	m.Lock()
 	defer m.Unlock()
 	log.Debugf("Get ListObjectsV2Pages: %v", loi)
 	m.listObjectsV2Input = append(m.listObjectsV2Input, loi)
 
+	if m.s3error != nil {
+		return m.s3error
+	}
+
 	for i := m.count; i < len(m.listObjectsV2Outputs); i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		lastPage := i == (len(m.listObjectsV2Outputs) - 1)
-		fn(m.listObjectsV2Outputs[i], lastPage)
+		m.listObjectsV2Pages++
+		if !fn(m.listObjectsV2Outputs[i], lastPage) {
+			break
+		}
 	}
 
-	return m.s3error
+	return nil
 }
 
 func TestWritingToS3(t *testing.T) {
@@ -119,7 +132,7 @@ func TestWritingToS3(t *testing.T) {
 	p := []byte("PAYLOAD")
 	ct := expectedContentType
 	var err error
-	err = w.WriteContent(expectedUUID, "2017-10-10", &p, ct, expectedTransactionId)
+	err = w.WriteContent(context.Background(), expectedUUID, "2017-10-10", &p, ct, expectedTransactionId)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, s.putObjectInput)
 	assert.Equal(t, "test/prefix/123e4567-e89b-12d3-a456-426655440000_2017-10-10.json", *s.putObjectInput.Key)
@@ -140,7 +153,7 @@ func TestWritingToS3WithTransactionID(t *testing.T) {
 	mw := &mockWriter{}
 	mr := &mockReader{}
 	resWriter := httptest.NewRecorder()
-	handler := NewWriterHandler(mw, mr)
+	handler := NewWriterHandler(mw, mr, KeyPolicy{})
 
 	handler.HandleContentWrite(resWriter, r)
 
@@ -148,7 +161,7 @@ func TestWritingToS3WithTransactionID(t *testing.T) {
 
 	w, s := getWriter()
 
-	err := w.WriteContent(expectedUUID, "", &[]byte{}, "", mw.tid)
+	err := w.WriteContent(context.Background(), expectedUUID, "", &[]byte{}, "", mw.tid)
 
 	assert.NoError(t, err)
 	assert.Equal(t, expectedTransactionId, *s.putObjectInput.Metadata[transactionid.TransactionIDKey])
@@ -159,7 +172,7 @@ func TestWritingToS3WithNewTransactionID(t *testing.T) {
 	mw := &mockWriter{}
 	mr := &mockReader{}
 	resWriter := httptest.NewRecorder()
-	handler := NewWriterHandler(mw, mr)
+	handler := NewWriterHandler(mw, mr, KeyPolicy{})
 
 	handler.HandleContentWrite(resWriter, r)
 
@@ -167,7 +180,7 @@ func TestWritingToS3WithNewTransactionID(t *testing.T) {
 
 	w, s := getWriter()
 
-	err := w.WriteContent(expectedUUID, "", &[]byte{}, "", mw.tid)
+	err := w.WriteContent(context.Background(), expectedUUID, "", &[]byte{}, "", mw.tid)
 
 	assert.NoError(t, err)
 	assert.Equal(t, mw.tid, *s.putObjectInput.Metadata[transactionid.TransactionIDKey])
@@ -177,7 +190,7 @@ func TestWritingToS3WithNoContentType(t *testing.T) {
 	w, s := getWriter()
 	p := []byte("PAYLOAD")
 	var err error
-	err = w.WriteContent(expectedUUID, "2017-10-10", &p, "", expectedTransactionId)
+	err = w.WriteContent(context.Background(), expectedUUID, "2017-10-10", &p, "", expectedTransactionId)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, s.putObjectInput)
 	assert.Equal(t, "test/prefix/123e4567-e89b-12d3-a456-426655440000_2017-10-10.json", *s.putObjectInput.Key)
@@ -197,7 +210,7 @@ func TestFailingToWriteToS3(t *testing.T) {
 	p := []byte("PAYLOAD")
 	ct := expectedContentType
 	s.s3error = errors.New("S3 error")
-	err := w.WriteContent(expectedUUID, "", &p, ct, expectedTransactionId)
+	err := w.WriteContent(context.Background(), expectedUUID, "", &p, ct, expectedTransactionId)
 	assert.Error(t, err)
 }
 
@@ -205,7 +218,7 @@ func TestGetFromS3(t *testing.T) {
 	r, s := getReader()
 	s.payload = "PAYLOAD"
 	s.ct = expectedContentType
-	b, i, ct, err := r.GetContent(expectedUUID, "2016-10-10")
+	b, i, ct, err := r.GetContent(context.Background(), expectedUUID, "2016-10-10")
 	assert.NoError(t, err)
 	assert.NotEmpty(t, s.getObjectInput)
 	assert.Equal(t, "test/prefix/123e4567-e89b-12d3-a456-426655440000_2016-10-10.json", *s.getObjectInput.Key)
@@ -219,7 +232,7 @@ func TestGetFromS3NoPrefix(t *testing.T) {
 	r, s := getReaderNoPrefix()
 	s.payload = "PAYLOAD"
 	s.ct = expectedContentType
-	b, i, ct, err := r.GetContent(expectedUUID, "2016-10-10")
+	b, i, ct, err := r.GetContent(context.Background(), expectedUUID, "2016-10-10")
 	assert.NoError(t, err)
 	assert.NotEmpty(t, s.getObjectInput)
 	assert.Equal(t, "/123e4567-e89b-12d3-a456-426655440000_2016-10-10.json", *s.getObjectInput.Key)
@@ -234,7 +247,7 @@ func TestGetFromS3WhenNoSuchKey(t *testing.T) {
 	r, s := getReader()
 	s.s3error = awserr.New("NoSuchKey", "message", errors.New("Some error"))
 	s.payload = "PAYLOAD"
-	b, i, ct, err := r.GetContent(expectedUUID, "")
+	b, i, ct, err := r.GetContent(context.Background(), expectedUUID, "")
 	assert.NoError(t, err)
 	assert.False(t, b)
 	assert.Nil(t, i)
@@ -245,7 +258,7 @@ func TestGetFromS3WithUnknownError(t *testing.T) {
 	r, s := getReader()
 	s.s3error = awserr.New("I don't know", "message", errors.New("Some error"))
 	s.payload = "ERROR PAYLOAD"
-	b, i, ct, err := r.GetContent(expectedUUID, "")
+	b, i, ct, err := r.GetContent(context.Background(), expectedUUID, "")
 	assert.Error(t, err)
 	assert.Equal(t, s.s3error, err)
 	assert.False(t, b)
@@ -257,7 +270,7 @@ func TestGetFromS3WithNoneAWSError(t *testing.T) {
 	r, s := getReader()
 	s.s3error = errors.New("Some error")
 	s.payload = "ERROR PAYLOAD"
-	b, i, ct, err := r.GetContent(expectedUUID, "")
+	b, i, ct, err := r.GetContent(context.Background(), expectedUUID, "")
 	assert.Error(t, err)
 	assert.Equal(t, s.s3error, err)
 	assert.False(t, b)
@@ -271,7 +284,7 @@ func TestDelete(t *testing.T) {
 
 	t.Run("With prefix", func(t *testing.T) {
 		w, s = getWriter()
-		err := w.DeleteContent(expectedUUID, "2017-01-06")
+		err := w.DeleteContent(context.Background(), expectedUUID, "2017-01-06")
 		assert.NoError(t, err)
 		assert.Equal(t, "test/prefix/123e4567-e89b-12d3-a456-426655440000_2017-01-06.json", *s.deleteObjectInput.Key)
 		assert.Equal(t, "testBucket", *s.deleteObjectInput.Bucket)
@@ -279,7 +292,7 @@ func TestDelete(t *testing.T) {
 
 	t.Run("Without prefix", func(t *testing.T) {
 		w, s = getWriterNoPrefix()
-		err := w.DeleteContent(expectedUUID, "2017-01-06")
+		err := w.DeleteContent(context.Background(), expectedUUID, "2017-01-06")
 		assert.NoError(t, err)
 		assert.Equal(t, "/123e4567-e89b-12d3-a456-426655440000_2017-01-06.json", *s.deleteObjectInput.Key)
 		assert.Equal(t, "testBucket", *s.deleteObjectInput.Bucket)
@@ -288,28 +301,102 @@ func TestDelete(t *testing.T) {
 	t.Run("Fails", func(t *testing.T) {
 		w, s = getWriter()
 		s.s3error = errors.New("Some S3 error")
-		err := w.DeleteContent(expectedUUID, "")
+		err := w.DeleteContent(context.Background(), expectedUUID, "")
 		assert.Error(t, err)
 		assert.Equal(t, s.s3error, err)
 	})
 }
 
+func TestGetPublishDateForUUID(t *testing.T) {
+	pages := []*s3.ListObjectsV2Output{
+		{Contents: []*s3.Object{
+			{Key: aws.String("test/prefix/")},
+			{Key: aws.String("test/prefix/" + expectedUUID + "_2017-01-06.json")},
+		}},
+		{Contents: []*s3.Object{
+			{Key: aws.String("test/prefix/" + validUuid + "_2018-02-07.json")},
+		}},
+	}
+
+	t.Run("Found on first page stops listing", func(t *testing.T) {
+		r, s := getReader()
+		s.listObjectsV2Outputs = pages
+		date, found, err := r.GetPublishDateForUUID(context.Background(), expectedUUID)
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, "2017-01-06", date)
+		assert.Equal(t, 1, s.listObjectsV2Pages)
+		assert.Equal(t, "test/prefix/"+expectedUUID, *s.listObjectsV2Input[0].Prefix)
+	})
+
+	t.Run("Not found", func(t *testing.T) {
+		r, s := getReader()
+		s.listObjectsV2Outputs = pages
+		_, found, err := r.GetPublishDateForUUID(context.Background(), "00000000-0000-0000-0000-000000000000")
+		assert.NoError(t, err)
+		assert.False(t, found)
+		assert.Equal(t, 2, s.listObjectsV2Pages)
+	})
+
+	t.Run("No prefix lists only content", func(t *testing.T) {
+		r, s := getReaderNoPrefix()
+		s.listObjectsV2Outputs = []*s3.ListObjectsV2Output{
+			{Contents: []*s3.Object{{Key: aws.String("/" + expectedUUID + "_2017-01-06.json")}}},
+		}
+		date, found, err := r.GetPublishDateForUUID(context.Background(), expectedUUID)
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, "2017-01-06", date)
+		assert.Equal(t, "/"+expectedUUID, *s.listObjectsV2Input[0].Prefix)
+	})
+
+	t.Run("Unparsable key", func(t *testing.T) {
+		r, s := getReaderNoPrefix()
+		s.listObjectsV2Outputs = []*s3.ListObjectsV2Output{
+			{Contents: []*s3.Object{{Key: aws.String("not-a-content-key")}}},
+			{Contents: []*s3.Object{{Key: aws.String(expectedUUID + "_2017-01-06.json")}}},
+		}
+		_, found, err := r.GetPublishDateForUUID(context.Background(), expectedUUID)
+		assert.Error(t, err)
+		assert.False(t, found)
+		assert.Equal(t, 1, s.listObjectsV2Pages)
+	})
+
+	t.Run("Listing fails", func(t *testing.T) {
+		r, s := getReader()
+		s.s3error = errors.New("Some S3 error")
+		_, found, err := r.GetPublishDateForUUID(context.Background(), expectedUUID)
+		assert.Equal(t, s.s3error, err)
+		assert.False(t, found)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		r, s := getReader()
+		s.listObjectsV2Outputs = pages
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, found, err := r.GetPublishDateForUUID(ctx, expectedUUID)
+		assert.Equal(t, context.Canceled, err)
+		assert.False(t, found)
+	})
+}
+
 func getReader() (Reader, *mockS3Client) {
 	s := &mockS3Client{}
-	return NewS3Reader(s, "testBucket", "test/prefix", "", 1), s
+	return NewS3Reader(s, "testBucket", "test/prefix", "", 1, OperationTimeouts{}), s
 }
 
 func getReaderNoPrefix() (Reader, *mockS3Client) {
 	s := &mockS3Client{}
-	return NewS3Reader(s, "testBucket", "", "", 1), s
+	return NewS3Reader(s, "testBucket", "", "", 1, OperationTimeouts{}), s
 }
 
 func getWriter() (Writer, *mockS3Client) {
 	s := &mockS3Client{}
-	return NewS3Writer(s, "testBucket", "test/prefix", ""), s
+	return NewS3Writer(s, "testBucket", "test/prefix", "", OperationTimeouts{}), s
 }
 
 func getWriterNoPrefix() (Writer, *mockS3Client) {
 	s := &mockS3Client{}
-	return NewS3Writer(s, "testBucket", "", ""), s
+	return NewS3Writer(s, "testBucket", "", "", OperationTimeouts{}), s
 }
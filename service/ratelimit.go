@@ -0,0 +1,283 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// OriginSystemHeader identifies the upstream system making the request.
+const OriginSystemHeader = "X-Origin-System-Id"
+
+const (
+	idleClientEviction = 10 * time.Minute
+	clientSweepPeriod  = time.Minute
+)
+
+// RateLimit describes a token bucket refilled at Rate tokens per second up to Burst tokens,
+// plus a cap on the number of requests in flight. A zero Rate or MaxInFlight disables that check.
+type RateLimit struct {
+	Rate        float64
+	Burst       int
+	MaxInFlight int
+}
+
+// RouteRateLimits holds every limit that applies to one route.
+type RouteRateLimits struct {
+	// Route is shared by all clients of the route.
+	Route *RateLimit
+	// PerClient is applied to each client separately.
+	PerClient *RateLimit
+	// Clients overrides PerClient for the named clients.
+	Clients map[string]RateLimit
+}
+
+func (l RouteRateLimits) isEmpty() bool {
+	return l.Route == nil && l.PerClient == nil && len(l.Clients) == 0
+}
+
+// ParseRateLimits reads limits in the form "route=rate:burst:maxInFlight". The route may be followed by
+// "/client" to limit a single client, or "/*" to limit every client separately, e.g. "content/*=50:100:10".
+func ParseRateLimits(specs []string) (map[string]RouteRateLimits, error) {
+	limits := make(map[string]RouteRateLimits)
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		target, values, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("rate limit %q is not in the form route=rate:burst:maxInFlight", spec)
+		}
+		limit, err := parseRateLimit(values)
+		if err != nil {
+			return nil, fmt.Errorf("rate limit %q: %w", spec, err)
+		}
+
+		route, client, perClient := strings.Cut(target, "/")
+		if err := CheckRouteGroup(route); err != nil {
+			return nil, fmt.Errorf("rate limit %q: %w", spec, err)
+		}
+		l := limits[route]
+		switch {
+		case !perClient:
+			l.Route = &limit
+		case client == "*":
+			l.PerClient = &limit
+		default:
+			if l.Clients == nil {
+				l.Clients = make(map[string]RateLimit)
+			}
+			l.Clients[client] = limit
+		}
+		limits[route] = l
+	}
+	return limits, nil
+}
+
+func parseRateLimit(v string) (RateLimit, error) {
+	parts := strings.Split(v, ":")
+	if len(parts) != 3 {
+		return RateLimit{}, fmt.Errorf("expected rate:burst:maxInFlight")
+	}
+	rate, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || rate < 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate %q", parts[0])
+	}
+	burst, err := strconv.Atoi(parts[1])
+	if err != nil || burst < 0 {
+		return RateLimit{}, fmt.Errorf("invalid burst %q", parts[1])
+	}
+	maxInFlight, err := strconv.Atoi(parts[2])
+	if err != nil || maxInFlight < 0 {
+		return RateLimit{}, fmt.Errorf("invalid maxInFlight %q", parts[2])
+	}
+	if rate > 0 && burst < 1 {
+		burst = 1
+	}
+	return RateLimit{Rate: rate, Burst: burst, MaxInFlight: maxInFlight}, nil
+}
+
+type limiterState struct {
+	tokens   float64
+	last     time.Time
+	inFlight int
+}
+
+func newLimiterState(limit RateLimit, now time.Time) *limiterState {
+	return &limiterState{tokens: float64(limit.Burst), last: now}
+}
+
+func (s *limiterState) refill(limit RateLimit, now time.Time) {
+	s.tokens = math.Min(float64(limit.Burst), s.tokens+now.Sub(s.last).Seconds()*limit.Rate)
+	s.last = now
+}
+
+// check reports how long the caller should wait before retrying, or zero if the request may proceed.
+func (s *limiterState) check(limit RateLimit) (time.Duration, string) {
+	if limit.MaxInFlight > 0 && s.inFlight >= limit.MaxInFlight {
+		return time.Second, "concurrency"
+	}
+	if limit.Rate > 0 && s.tokens < 1 {
+		return time.Duration((1 - s.tokens) / limit.Rate * float64(time.Second)), "rate"
+	}
+	return 0, ""
+}
+
+// RateLimiter applies the limits of a single route.
+type RateLimiter struct {
+	route     string
+	limits    RouteRateLimits
+	now       func() time.Time
+	mu        sync.Mutex
+	shared    *limiterState
+	clients   map[string]*limiterState
+	lastSweep time.Time
+
+	inFlight           metrics.Counter
+	trackedClients     metrics.Gauge
+	rejectedRate       metrics.Counter
+	rejectedConcurrent metrics.Counter
+}
+
+func NewRateLimiter(route string, limits RouteRateLimits, registry metrics.Registry) *RateLimiter {
+	l := &RateLimiter{
+		route:              route,
+		limits:             limits,
+		now:                time.Now,
+		clients:            make(map[string]*limiterState),
+		inFlight:           metrics.GetOrRegisterCounter("ratelimit."+route+".inflight", registry),
+		trackedClients:     metrics.GetOrRegisterGauge("ratelimit."+route+".clients", registry),
+		rejectedRate:       metrics.GetOrRegisterCounter("ratelimit."+route+".rejected.rate", registry),
+		rejectedConcurrent: metrics.GetOrRegisterCounter("ratelimit."+route+".rejected.concurrency", registry),
+	}
+	if limits.Route != nil {
+		l.shared = newLimiterState(*limits.Route, l.now())
+	}
+	return l
+}
+
+func (l *RateLimiter) clientLimit(client string) (RateLimit, bool) {
+	if limit, ok := l.limits.Clients[client]; ok {
+		return limit, true
+	}
+	if l.limits.PerClient != nil {
+		return *l.limits.PerClient, true
+	}
+	return RateLimit{}, false
+}
+
+// acquire takes a token and an in-flight slot from every limit that applies to client.
+// It returns a release func on success, or how long to wait before retrying.
+func (l *RateLimiter) acquire(client string) (func(), time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	var states []*limiterState
+	var limits []RateLimit
+	if l.shared != nil {
+		states = append(states, l.shared)
+		limits = append(limits, *l.limits.Route)
+	}
+	if limit, ok := l.clientLimit(client); ok {
+		s, ok := l.clients[client]
+		if !ok {
+			s = newLimiterState(limit, now)
+			l.clients[client] = s
+			l.trackedClients.Update(int64(len(l.clients)))
+		}
+		states = append(states, s)
+		limits = append(limits, limit)
+	}
+
+	for i, s := range states {
+		s.refill(limits[i], now)
+		if wait, reason := s.check(limits[i]); wait > 0 {
+			if reason == "rate" {
+				l.rejectedRate.Inc(1)
+			} else {
+				l.rejectedConcurrent.Inc(1)
+			}
+			return nil, wait
+		}
+	}
+
+	for i, s := range states {
+		if limits[i].Rate > 0 {
+			s.tokens--
+		}
+		s.inFlight++
+	}
+	l.inFlight.Inc(1)
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, s := range states {
+			s.inFlight--
+		}
+		l.inFlight.Dec(1)
+	}, 0
+}
+
+// sweep forgets idle clients so that the state kept per source IP stays bounded.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < clientSweepPeriod {
+		return
+	}
+	l.lastSweep = now
+	for client, s := range l.clients {
+		if s.inFlight == 0 && now.Sub(s.last) > idleClientEviction {
+			delete(l.clients, client)
+		}
+	}
+	l.trackedClients.Update(int64(len(l.clients)))
+}
+
+// Handler wraps next with the route limits. Limited requests are answered with 429 and a Retry-After header.
+func (l *RateLimiter) Handler(next http.Handler) http.Handler {
+	if l.limits.isEmpty() {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		client := clientKey(r)
+		release, wait := l.acquire(client)
+		if release == nil {
+			log.WithField("route", l.route).WithField("client", client).Warn("Request rate limited")
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusTooManyRequests)
+			rw.Write([]byte("{\"message\":\"Too many requests\"}"))
+			return
+		}
+		defer release()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// clientKey identifies the caller by its authenticated identity or origin system header,
+// falling back to the source IP.
+func clientKey(r *http.Request) string {
+	if id := ClientIdentity(r.Context()); id != "" {
+		return id
+	}
+	if origin := r.Header.Get(OriginSystemHeader); origin != "" {
+		return origin
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
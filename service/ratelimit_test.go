@@ -0,0 +1,91 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits([]string{"content=100:200:50", "content/*=10:20:5", "content/backfill=1:1:1", "foreign=0.5:1:0"})
+	assert.NoError(t, err)
+	assert.Equal(t, &RateLimit{Rate: 100, Burst: 200, MaxInFlight: 50}, limits["content"].Route)
+	assert.Equal(t, &RateLimit{Rate: 10, Burst: 20, MaxInFlight: 5}, limits["content"].PerClient)
+	assert.Equal(t, RateLimit{Rate: 1, Burst: 1, MaxInFlight: 1}, limits["content"].Clients["backfill"])
+	assert.Equal(t, &RateLimit{Rate: 0.5, Burst: 1}, limits["foreign"].Route)
+
+	_, err = ParseRateLimits([]string{"content"})
+	assert.Error(t, err)
+	_, err = ParseRateLimits([]string{"content=1:2"})
+	assert.Error(t, err)
+	_, err = ParseRateLimits([]string{"content=fast:2:1"})
+	assert.Error(t, err)
+	_, err = ParseRateLimits([]string{"contnet=1:2:1"})
+	assert.Error(t, err, "unknown routes must not be silently ignored")
+	_, err = ParseRateLimits([]string{"contnet/*=1:2:1"})
+	assert.Error(t, err)
+}
+
+func TestRateLimiterRejectsOverRate(t *testing.T) {
+	limits, _ := ParseRateLimits([]string{"content/*=1:2:0"})
+	registry := metrics.NewRegistry()
+	l := NewRateLimiter("content", limits["content"], registry)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	h := l.Handler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(origin string) *httptest.ResponseRecorder {
+		req := newRequest("GET", "/content/x", "")
+		req.Header.Set(OriginSystemHeader, origin)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, 200, serve("backfill").Code)
+	assert.Equal(t, 200, serve("backfill").Code)
+	rec := serve("backfill")
+	assert.Equal(t, 429, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	assert.Equal(t, int64(1), registry.Get("ratelimit.content.rejected.rate").(metrics.Counter).Count())
+
+	assert.Equal(t, 200, serve("publisher").Code, "other clients have their own bucket")
+
+	now = now.Add(time.Second)
+	assert.Equal(t, 200, serve("backfill").Code)
+}
+
+func TestRateLimiterCapsInFlight(t *testing.T) {
+	limits, _ := ParseRateLimits([]string{"foreign=0:0:1"})
+	registry := metrics.NewRegistry()
+	l := NewRateLimiter("foreign", limits["foreign"], registry)
+
+	inside := make(chan struct{})
+	done := make(chan struct{})
+	h := l.Handler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(inside)
+		<-done
+	}))
+
+	go h.ServeHTTP(httptest.NewRecorder(), newRequest("PUT", "/foreign/", ""))
+	<-inside
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, newRequest("PUT", "/foreign/", ""))
+	assert.Equal(t, 429, rec.Code)
+	assert.Equal(t, int64(1), registry.Get("ratelimit.foreign.inflight").(metrics.Counter).Count())
+	assert.Equal(t, int64(1), registry.Get("ratelimit.foreign.rejected.concurrency").(metrics.Counter).Count())
+	close(done)
+}
+
+func TestClientKey(t *testing.T) {
+	req := newRequest("GET", "/", "")
+	req.RemoteAddr = "10.0.0.1:4321"
+	assert.Equal(t, "10.0.0.1", clientKey(req))
+	req.Header.Set(OriginSystemHeader, "cct")
+	assert.Equal(t, "cct", clientKey(req))
+}
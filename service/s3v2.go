@@ -3,23 +3,38 @@ package service
 import (
 	"bytes"
 	"context"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+	"time"
 
 	transactionid "github.com/Financial-Times/transactionid-utils-go"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	log "github.com/sirupsen/logrus"
 )
 
 type S3Client2 struct {
 	client     *s3.Client
 	bucketName string
+	timeouts   OperationTimeouts
+	options    UploadOptions
 }
 
-func NewS3Client2(client *s3.Client, bucketName string) *S3Client2 {
-	return &S3Client2{client, bucketName}
+func NewS3Client2(client *s3.Client, bucketName string, timeouts OperationTimeouts) *S3Client2 {
+	return &S3Client2{client: client, bucketName: bucketName, timeouts: timeouts}
 }
 
-func (c *S3Client2) Write(s3ObjectKey string, b *[]byte, ct string, tid string) error {
+// WithUploadOptions returns a client for the same bucket that writes objects with o.
+func (c *S3Client2) WithUploadOptions(o UploadOptions) *S3Client2 {
+	withOptions := *c
+	withOptions.options = o
+	return &withOptions
+}
+
+func (c *S3Client2) Write(ctx context.Context, s3ObjectKey string, b *[]byte, ct string, tid string) error {
 	s3Param := &s3.PutObjectInput{
 		Bucket: aws.String(c.bucketName),
 		Key:    aws.String(s3ObjectKey),
@@ -29,12 +44,12 @@ func (c *S3Client2) Write(s3ObjectKey string, b *[]byte, ct string, tid string)
 		s3Param.ContentType = aws.String(ct)
 	}
 
-	if s3Param.Metadata == nil {
-		s3Param.Metadata = make(map[string]string)
-	}
-	s3Param.Metadata[transactionid.TransactionIDKey] = tid
+	s3Param.Metadata = objectMetadata(ctx, tid)
+	c.options.apply(&s3Param.ACL, &s3Param.ServerSideEncryption, &s3Param.SSEKMSKeyId, &s3Param.StorageClass, &s3Param.Tagging)
 
-	resp, err := c.client.PutObject(context.TODO(), s3Param)
+	ctx, cancel := withTimeout(ctx, c.timeouts.Write)
+	defer cancel()
+	resp, err := c.client.PutObject(ctx, s3Param)
 	if err != nil {
 		log.Errorf("Error found, Resp was : %v", resp)
 		return err
@@ -42,10 +57,240 @@ func (c *S3Client2) Write(s3ObjectKey string, b *[]byte, ct string, tid string)
 	return nil
 }
 
-func (c *S3Client2) ListBuckets() (int, error) {
-	result, err := c.client.ListBuckets(context.TODO(), &s3.ListBucketsInput{})
+func optionalString(v string) *string {
+	if v == "" {
+		return nil
+	}
+	return aws.String(v)
+}
+
+// objectMetadata records the transaction and, when known, the caller that wrote an object.
+func objectMetadata(ctx context.Context, tid string) map[string]string {
+	metadata := map[string]string{transactionid.TransactionIDKey: tid}
+	if id := ClientIdentity(ctx); id != "" {
+		metadata[ClientIdentityMetadataKey] = id
+	}
+	return metadata
+}
+
+func (c *S3Client2) HeadBucket(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, c.timeouts.Read)
+	defer cancel()
+	_, err := c.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(c.bucketName)})
+	return err
+}
+
+func (c *S3Client2) ListBuckets(ctx context.Context) (int, error) {
+	ctx, cancel := withTimeout(ctx, c.timeouts.List)
+	defer cancel()
+	result, err := c.client.ListBuckets(ctx, &s3.ListBucketsInput{})
 	if err != nil {
 		return 0, err
 	}
 	return len(result.Buckets), nil
 }
+
+// ObjectInfo describes an object without its body.
+type ObjectInfo struct {
+	ContentType   string    `json:"contentType,omitempty"`
+	ContentLength int64     `json:"contentLength"`
+	ETag          string    `json:"etag,omitempty"`
+	LastModified  time.Time `json:"lastModified"`
+}
+
+func isNotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	return errors.As(err, &noSuchKey) || errors.As(err, &notFound)
+}
+
+// Get reports a missing object as not found rather than as an error. The body must be closed by the caller.
+func (c *S3Client2) Get(ctx context.Context, s3ObjectKey string) (bool, io.ReadCloser, *string, error) {
+	ctx, cancel := withTimeout(ctx, c.timeouts.Read)
+	resp, err := c.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucketName),
+		Key:    aws.String(s3ObjectKey),
+	})
+	if err != nil {
+		cancel()
+		if isNotFound(err) {
+			return false, nil, nil, nil
+		}
+		return false, nil, nil, err
+	}
+	return true, &cancelOnClose{resp.Body, cancel}, resp.ContentType, nil
+}
+
+func (c *S3Client2) Head(ctx context.Context, s3ObjectKey string) (bool, ObjectInfo, error) {
+	ctx, cancel := withTimeout(ctx, c.timeouts.Read)
+	defer cancel()
+	resp, err := c.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(c.bucketName),
+		Key:    aws.String(s3ObjectKey),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return false, ObjectInfo{}, nil
+		}
+		return false, ObjectInfo{}, err
+	}
+	return true, ObjectInfo{
+		ContentType:   aws.ToString(resp.ContentType),
+		ContentLength: aws.ToInt64(resp.ContentLength),
+		ETag:          aws.ToString(resp.ETag),
+		LastModified:  aws.ToTime(resp.LastModified),
+	}, nil
+}
+
+func (c *S3Client2) Delete(ctx context.Context, s3ObjectKey string) error {
+	ctx, cancel := withTimeout(ctx, c.timeouts.Delete)
+	defer cancel()
+	_, err := c.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(c.bucketName),
+		Key:    aws.String(s3ObjectKey),
+	})
+	return err
+}
+
+// EachObject behaves like S3Reader.EachObject.
+func (c *S3Client2) EachObject(ctx context.Context, prefix string, fn func(key string) (bool, error)) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(c.bucketName),
+	}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+
+	ctx, cancel := withTimeout(ctx, c.timeouts.List)
+	defer cancel()
+
+	paginator := s3.NewListObjectsV2Paginator(c.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, o := range page.Contents {
+			key := aws.ToString(o.Key)
+			if strings.HasSuffix(key, "/") {
+				continue
+			}
+			more, err := fn(key)
+			if err != nil || !more {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Presign returns a GET URL for the object. URLs signed with assumed-role credentials stop working when those
+// credentials expire, even if ttl is longer.
+func (c *S3Client2) Presign(ctx context.Context, s3ObjectKey string, ttl time.Duration) (string, error) {
+	ctx, cancel := withTimeout(ctx, c.timeouts.Presign)
+	defer cancel()
+	req, err := s3.NewPresignClient(c.client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucketName),
+		Key:    aws.String(s3ObjectKey),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// CopyFrom copies an object server side, so the credentials of this client must be able to read the source.
+// The metadata is replaced to record the transaction of the copy.
+func (c *S3Client2) CopyFrom(ctx context.Context, sourceBucket, sourceKey, s3ObjectKey, ct, tid string) error {
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(c.bucketName),
+		Key:               aws.String(s3ObjectKey),
+		CopySource:        aws.String(url.PathEscape(sourceBucket + "/" + sourceKey)),
+		MetadataDirective: types.MetadataDirectiveReplace,
+		Metadata:          objectMetadata(ctx, tid),
+	}
+	if ct != "" {
+		input.ContentType = aws.String(ct)
+	}
+	c.options.apply(&input.ACL, &input.ServerSideEncryption, &input.SSEKMSKeyId, &input.StorageClass, &input.Tagging)
+	if input.Tagging != nil {
+		input.TaggingDirective = types.TaggingDirectiveReplace
+	}
+	_, err := c.client.CopyObject(ctx, input)
+	return err
+}
+
+// WriteStream uploads r in parts of partSize bytes, holding at most one part in memory.
+// A body that fits in a single part is written with a plain PutObject.
+func (c *S3Client2) WriteStream(ctx context.Context, s3ObjectKey string, r io.Reader, partSize int64, ct, tid string) error {
+	part := make([]byte, partSize)
+	n, err := io.ReadFull(r, part)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	if int64(n) < partSize {
+		b := part[:n]
+		return c.Write(ctx, s3ObjectKey, &b, ct, tid)
+	}
+
+	create := &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(c.bucketName),
+		Key:      aws.String(s3ObjectKey),
+		Metadata: objectMetadata(ctx, tid),
+	}
+	if ct != "" {
+		create.ContentType = aws.String(ct)
+	}
+	c.options.apply(&create.ACL, &create.ServerSideEncryption, &create.SSEKMSKeyId, &create.StorageClass, &create.Tagging)
+	upload, err := c.client.CreateMultipartUpload(ctx, create)
+	if err != nil {
+		return err
+	}
+
+	var completed []types.CompletedPart
+	for partNumber := int32(1); n > 0; partNumber++ {
+		var resp *s3.UploadPartOutput
+		resp, err = c.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(c.bucketName),
+			Key:           aws.String(s3ObjectKey),
+			UploadId:      upload.UploadId,
+			PartNumber:    aws.Int32(partNumber),
+			Body:          bytes.NewReader(part[:n]),
+			ContentLength: aws.Int64(int64(n)),
+		})
+		if err != nil {
+			break
+		}
+		completed = append(completed, types.CompletedPart{ETag: resp.ETag, PartNumber: aws.Int32(partNumber)})
+
+		n, err = io.ReadFull(r, part)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		_, err = c.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(c.bucketName),
+			Key:             aws.String(s3ObjectKey),
+			UploadId:        upload.UploadId,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+		})
+	}
+	if err != nil {
+		// Parts of an abandoned upload are billed until aborted, so this runs even if ctx is already done.
+		abortCtx, cancel := withTimeout(context.Background(), c.timeouts.Delete)
+		defer cancel()
+		if _, abortErr := c.client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(c.bucketName),
+			Key:      aws.String(s3ObjectKey),
+			UploadId: upload.UploadId,
+		}); abortErr != nil {
+			log.WithError(abortErr).WithField("key", s3ObjectKey).Error("Failed to abort multipart upload")
+		}
+		return err
+	}
+	return nil
+}
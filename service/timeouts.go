@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RequestTimeoutHeader lets a client ask for a tighter deadline than the server defaults.
+const RequestTimeoutHeader = "X-Request-Timeout"
+
+// OperationTimeouts holds the deadline applied to each kind of storage or STS call.
+// A zero value leaves the operation bounded only by the request context.
+type OperationTimeouts struct {
+	Read       time.Duration
+	Write      time.Duration
+	Delete     time.Duration
+	List       time.Duration
+	Presign    time.Duration
+	AssumeRole time.Duration
+	// Copy bounds a whole transfer between buckets, which may take many requests.
+	Copy time.Duration
+}
+
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// cancelOnClose releases an operation deadline only once the caller is done streaming the body.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// WithRequestTimeout bounds the request context by the X-Request-Timeout header, if the client sent one.
+// The header takes either a number of seconds or a Go duration such as "1500ms", and is capped at max.
+func WithRequestTimeout(max time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		h := r.Header.Get(RequestTimeoutHeader)
+		if h == "" {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		d, err := parseRequestTimeout(h)
+		if err != nil || d <= 0 {
+			respondWithBadRequest(rw, "Invalid "+RequestTimeoutHeader+" header.")
+			return
+		}
+		if max > 0 && d > max {
+			d = max
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+type responseControllerKey struct{}
+
+// WithResponseController keeps a controller of the ResponseWriter it is given in the request context. It goes
+// outside the request logging handler, whose ResponseWriter can't be unwrapped to reach the connection.
+func WithResponseController(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), responseControllerKey{}, http.NewResponseController(rw))
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+// responseController is the controller kept by WithResponseController, or one of rw when there is none.
+func responseController(rw http.ResponseWriter, r *http.Request) *http.ResponseController {
+	if rc, ok := r.Context().Value(responseControllerKey{}).(*http.ResponseController); ok {
+		return rc
+	}
+	return http.NewResponseController(rw)
+}
+
+// WithWriteDeadline lets the handlers of long transfers write their response for up to d, when that is longer than
+// the server WriteTimeout, which would otherwise cut a synchronous copy short whatever S3_COPY_TIMEOUT says.
+func WithWriteDeadline(d time.Duration, next http.Handler) http.Handler {
+	if d <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if err := responseController(rw, r).SetWriteDeadline(time.Now().Add(d)); err != nil {
+			log.WithError(err).Warn("Unable to extend the write deadline")
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+func parseRequestTimeout(v string) (time.Duration, error) {
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	return time.ParseDuration(v)
+}
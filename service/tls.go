@@ -0,0 +1,143 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	transactionid "github.com/Financial-Times/transactionid-utils-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// ClientIdentityMetadataKey is the S3 metadata key that records who wrote an object.
+const ClientIdentityMetadataKey = "client_identity"
+
+const certCheckInterval = 10 * time.Second
+
+// CertReloader serves a certificate from disk and picks up a renewed one without a restart.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	now      func() time.Time
+
+	mu          sync.RWMutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastCheck   time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile, now: time.Now}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *CertReloader) reload() error {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.mu.RLock()
+	unchanged := c.cert != nil && certInfo.ModTime().Equal(c.certModTime) && keyInfo.ModTime().Equal(c.keyModTime)
+	c.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS key pair: %w", err)
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.certModTime = certInfo.ModTime()
+	c.keyModTime = keyInfo.ModTime()
+	c.mu.Unlock()
+	log.WithField("certFile", c.certFile).Info("Loaded TLS certificate")
+	return nil
+}
+
+// GetCertificate is meant for tls.Config. It checks the files for changes at most every few seconds,
+// and keeps serving the previous certificate if a new one fails to load.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	now := c.now()
+	c.mu.Lock()
+	due := now.Sub(c.lastCheck) >= certCheckInterval
+	if due {
+		c.lastCheck = now
+	}
+	c.mu.Unlock()
+
+	if due {
+		if err := c.reload(); err != nil {
+			log.WithError(err).Error("Failed to reload TLS certificate, keeping the current one")
+		}
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// LoadCertPool reads PEM encoded CA certificates used to verify client certificates.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// ParseClientAuth maps "none", "optional" and "require" to the matching client certificate policy.
+func ParseClientAuth(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("unknown client auth mode %q", mode)
+}
+
+// WithTLSClientIdentity makes the subject of a verified client certificate the caller identity.
+// The common name is used when present, the full subject otherwise.
+func WithTLSClientIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		subject := r.TLS.VerifiedChains[0][0].Subject
+		id := subject.CommonName
+		if id == "" {
+			id = subject.String()
+		}
+		log.WithFields(log.Fields{
+			"clientIdentity":               id,
+			"method":                       r.Method,
+			"requestURI":                   r.URL.RequestURI(),
+			transactionid.TransactionIDKey: transactionid.GetTransactionIDFromRequest(r),
+		}).Info("Request from certificate authenticated client")
+		next.ServeHTTP(rw, r.WithContext(WithClientIdentity(r.Context(), id)))
+	})
+}
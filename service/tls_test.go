@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeSelfSignedCert(t *testing.T, dir, commonName string, modTime time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	assert.NoError(t, os.Chtimes(certFile, modTime, modTime))
+	assert.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	return certFile, keyFile
+}
+
+func servedCommonName(t *testing.T, c *CertReloader) string {
+	cert, err := c.GetCertificate(nil)
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now().Add(-time.Hour)
+	certFile, keyFile := writeSelfSignedCert(t, dir, "first", start)
+
+	c, err := NewCertReloader(certFile, keyFile)
+	assert.NoError(t, err)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	assert.Equal(t, "first", servedCommonName(t, c))
+
+	writeSelfSignedCert(t, dir, "second", start.Add(time.Minute))
+	assert.Equal(t, "first", servedCommonName(t, c), "files are not checked again before the interval")
+
+	now = now.Add(certCheckInterval)
+	assert.Equal(t, "second", servedCommonName(t, c))
+
+	assert.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0600))
+	now = now.Add(certCheckInterval)
+	assert.Equal(t, "second", servedCommonName(t, c), "a broken renewal keeps the current certificate")
+}
+
+func TestParseClientAuth(t *testing.T) {
+	for mode, expected := range map[string]tls.ClientAuthType{
+		"none":     tls.NoClientCert,
+		"optional": tls.VerifyClientCertIfGiven,
+		"require":  tls.RequireAndVerifyClientCert,
+	} {
+		actual, err := ParseClientAuth(mode)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+	_, err := ParseClientAuth("sometimes")
+	assert.Error(t, err)
+}
+
+func TestTLSClientIdentity(t *testing.T) {
+	var identity string
+	h := WithTLSClientIdentity(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		identity = ClientIdentity(r.Context())
+	}))
+
+	req := newRequest("PUT", "/content/x", "")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Empty(t, identity)
+
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "content-publisher"}}}}}
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "content-publisher", identity)
+
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{Organization: []string{"FT"}}}}}}
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "O=FT", identity)
+}
+
+func TestWritingToS3RecordsClientIdentity(t *testing.T) {
+	w, s := getWriter()
+	ctx := WithClientIdentity(context.Background(), "content-publisher")
+	err := w.WriteContent(ctx, expectedUUID, "2017-10-10", &[]byte{}, "", expectedTransactionId)
+	assert.NoError(t, err)
+	assert.Equal(t, "content-publisher", *s.putObjectInput.Metadata[ClientIdentityMetadataKey])
+}
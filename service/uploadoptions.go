@@ -0,0 +1,120 @@
+package service
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// maxObjectTags is the most tags S3 accepts on one object.
+const maxObjectTags = 10
+
+// UploadOptions are applied to every object a client writes.
+// Empty values leave the bucket defaults in place.
+type UploadOptions struct {
+	ACL                  string            `json:"acl,omitempty"`
+	ServerSideEncryption string            `json:"sse,omitempty"`
+	SSEKMSKeyID          string            `json:"kmsKeyId,omitempty"`
+	StorageClass         string            `json:"storageClass,omitempty"`
+	Tags                 map[string]string `json:"tags,omitempty"`
+}
+
+// ParseUploadOptions reads the 'acl', 'sse', 'kmsKeyId', 'storageClass' and repeated 'tag' query params,
+// tags being written as key=value.
+func ParseUploadOptions(q url.Values) (UploadOptions, error) {
+	o := UploadOptions{
+		ACL:                  q.Get("acl"),
+		ServerSideEncryption: q.Get("sse"),
+		SSEKMSKeyID:          q.Get("kmsKeyId"),
+		StorageClass:         q.Get("storageClass"),
+	}
+	for _, tag := range q["tag"] {
+		k, v, _ := strings.Cut(tag, "=")
+		if k == "" {
+			return o, fmt.Errorf("invalid tag %q", tag)
+		}
+		if o.Tags == nil {
+			o.Tags = make(map[string]string)
+		}
+		o.Tags[k] = v
+	}
+	return o, o.Validate()
+}
+
+// Validate rejects values S3 would refuse, before any object is written.
+func (o UploadOptions) Validate() error {
+	if o.ACL != "" && !containsEnum(types.ObjectCannedACL("").Values(), o.ACL) {
+		return fmt.Errorf("unknown canned ACL %q", o.ACL)
+	}
+	if o.ServerSideEncryption != "" && !containsEnum(types.ServerSideEncryption("").Values(), o.ServerSideEncryption) {
+		return fmt.Errorf("unknown server side encryption %q", o.ServerSideEncryption)
+	}
+	if o.SSEKMSKeyID != "" && o.ServerSideEncryption != string(types.ServerSideEncryptionAwsKms) {
+		return fmt.Errorf("a KMS key id needs server side encryption %s", types.ServerSideEncryptionAwsKms)
+	}
+	if o.StorageClass != "" && !containsEnum(types.StorageClass("").Values(), o.StorageClass) {
+		return fmt.Errorf("unknown storage class %q", o.StorageClass)
+	}
+	if len(o.Tags) > maxObjectTags {
+		return fmt.Errorf("at most %d tags are allowed", maxObjectTags)
+	}
+	return nil
+}
+
+// Fill returns o with the values it leaves empty taken from other. Tags are merged, those of o winning.
+// Destination profiles use it so that operators can pin a value while clients choose the rest.
+func (o UploadOptions) Fill(other UploadOptions) UploadOptions {
+	filled := o
+	if filled.ACL == "" {
+		filled.ACL = other.ACL
+	}
+	if filled.ServerSideEncryption == "" {
+		filled.ServerSideEncryption = other.ServerSideEncryption
+	}
+	if filled.SSEKMSKeyID == "" {
+		filled.SSEKMSKeyID = other.SSEKMSKeyID
+	}
+	if filled.StorageClass == "" {
+		filled.StorageClass = other.StorageClass
+	}
+	if len(other.Tags) > 0 {
+		filled.Tags = make(map[string]string, len(o.Tags)+len(other.Tags))
+		for k, v := range other.Tags {
+			filled.Tags[k] = v
+		}
+		for k, v := range o.Tags {
+			filled.Tags[k] = v
+		}
+	}
+	return filled
+}
+
+// apply sets the fields that PutObject, CopyObject and CreateMultipartUpload share, leaving nil or empty the
+// ones o leaves to the bucket defaults.
+func (o UploadOptions) apply(acl *types.ObjectCannedACL, sse *types.ServerSideEncryption, kmsKeyID **string, storageClass *types.StorageClass, tagging **string) {
+	*acl = types.ObjectCannedACL(o.ACL)
+	*sse = types.ServerSideEncryption(o.ServerSideEncryption)
+	*kmsKeyID = optionalString(o.SSEKMSKeyID)
+	*storageClass = types.StorageClass(o.StorageClass)
+	*tagging = optionalString(o.tagging())
+}
+
+// tagging encodes the tags the way the x-amz-tagging header expects them.
+func (o UploadOptions) tagging() string {
+	tags := url.Values{}
+	for k, v := range o.Tags {
+		tags.Set(k, v)
+	}
+	return tags.Encode()
+}
+
+func containsEnum[T ~string](values []T, v string) bool {
+	for _, candidate := range values {
+		if string(candidate) == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package service
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUploadOptions(t *testing.T) {
+	q, _ := url.ParseQuery("acl=bucket-owner-full-control&sse=aws:kms&kmsKeyId=partner-key&storageClass=STANDARD_IA&tag=team=exports&tag=year=2017")
+	o, err := ParseUploadOptions(q)
+	assert.NoError(t, err)
+	assert.Equal(t, UploadOptions{
+		ACL:                  "bucket-owner-full-control",
+		ServerSideEncryption: "aws:kms",
+		SSEKMSKeyID:          "partner-key",
+		StorageClass:         "STANDARD_IA",
+		Tags:                 map[string]string{"team": "exports", "year": "2017"},
+	}, o)
+	assert.Equal(t, "team=exports&year=2017", o.tagging())
+
+	for _, invalid := range []string{"acl=everyone", "sse=rot13", "kmsKeyId=k", "sse=AES256&kmsKeyId=k", "storageClass=CHEAP", "tag==v"} {
+		q, _ := url.ParseQuery(invalid)
+		_, err := ParseUploadOptions(q)
+		assert.Error(t, err, invalid)
+	}
+
+	o, err = ParseUploadOptions(url.Values{})
+	assert.NoError(t, err)
+	assert.Equal(t, "", o.tagging())
+}
+
+func TestUploadOptionsFill(t *testing.T) {
+	profile := UploadOptions{ACL: "bucket-owner-full-control", Tags: map[string]string{"team": "exports"}}
+	requested := UploadOptions{ACL: "private", StorageClass: "GLACIER", Tags: map[string]string{"team": "other", "year": "2017"}}
+
+	assert.Equal(t, UploadOptions{
+		ACL:          "bucket-owner-full-control",
+		StorageClass: "GLACIER",
+		Tags:         map[string]string{"team": "exports", "year": "2017"},
+	}, profile.Fill(requested))
+	assert.Equal(t, profile, profile.Fill(UploadOptions{}))
+}